@@ -0,0 +1,456 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/acme"
+	"gorm.io/gorm"
+)
+
+const (
+	// acmeIssueTimeout bounds a single certificate order
+	acmeIssueTimeout = 3 * time.Minute
+
+	// acmeChallengeTTL is how long an HTTP-01 token is served if an order is abandoned
+	acmeChallengeTTL = time.Hour
+
+	// acmeRenewalLockID is the Postgres advisory lock held by the replica running renewals
+	acmeRenewalLockID = 0x70657065
+
+	// acmeAccountLockID is the Postgres advisory lock serializing ACME account registration
+	acmeAccountLockID = 0x70657066
+)
+
+// acmeEnabled reports whether automated certificate issuance is configured with ACME_ENABLED
+func acmeEnabled() bool {
+	enabled, _ := strconv.ParseBool(getEnv("ACME_ENABLED", "false"))
+	return enabled
+}
+
+// acmeDirectoryURL returns the ACME directory, Let's Encrypt production by default.
+// Point ACME_DIRECTORY_URL at a local Pebble (e.g. https://localhost:14000/dir) for testing.
+func acmeDirectoryURL() string {
+	return getEnv("ACME_DIRECTORY_URL", acme.LetsEncryptURL)
+}
+
+// acmeRenewBefore returns how long before expiry certificates are renewed (ACME_RENEW_BEFORE_DAYS)
+func acmeRenewBefore() time.Duration {
+	days, err := strconv.Atoi(getEnv("ACME_RENEW_BEFORE_DAYS", "30"))
+	if err != nil || days < 1 {
+		days = 30
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// acmeRenewalInterval returns the time between renewal passes (ACME_RENEWAL_INTERVAL)
+func acmeRenewalInterval() time.Duration {
+	interval, err := time.ParseDuration(getEnv("ACME_RENEWAL_INTERVAL", "1h"))
+	if err != nil || interval < time.Minute {
+		interval = time.Hour
+	}
+	return interval
+}
+
+// acmeHTTPClient returns the client used to talk to the ACME server. ACME_CA_BUNDLE adds
+// trusted CAs (such as Pebble's) and ACME_INSECURE_SKIP_VERIFY disables verification.
+func acmeHTTPClient() (*http.Client, error) {
+	tlsConfig := &tls.Config{}
+
+	if path := getEnv("ACME_CA_BUNDLE", ""); path != "" {
+		roots, err := x509.SystemCertPool()
+		if err != nil {
+			roots = x509.NewCertPool()
+		}
+		bundle, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("could not read ACME_CA_BUNDLE: %v", err)
+		}
+		if !roots.AppendCertsFromPEM(bundle) {
+			return nil, fmt.Errorf("ACME_CA_BUNDLE contains no certificates")
+		}
+		tlsConfig.RootCAs = roots
+	}
+
+	if insecure, _ := strconv.ParseBool(getEnv("ACME_INSECURE_SKIP_VERIFY", "false")); insecure {
+		tlsConfig.InsecureSkipVerify = true
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	return &http.Client{Transport: transport, Timeout: 30 * time.Second}, nil
+}
+
+// withAdvisoryLock runs fn while holding a session-level Postgres advisory lock on a
+// dedicated connection, so no transaction stays open while fn works through DB. When wait
+// is false and another session holds the lock, fn is skipped and false is returned.
+func withAdvisoryLock(ctx context.Context, lockID int64, wait bool, fn func() error) (bool, error) {
+	ran := false
+	err := DB.WithContext(ctx).Connection(func(conn *gorm.DB) error {
+		if wait {
+			if err := conn.Exec("SELECT pg_advisory_lock(?)", lockID).Error; err != nil {
+				return err
+			}
+		} else {
+			var locked bool
+			if err := conn.Raw("SELECT pg_try_advisory_lock(?)", lockID).Scan(&locked).Error; err != nil {
+				return err
+			}
+			if !locked {
+				return nil
+			}
+		}
+		// The lock outlives ctx, so release it even when ctx is done
+		defer conn.WithContext(context.Background()).Exec("SELECT pg_advisory_unlock(?)", lockID)
+
+		ran = true
+		return fn()
+	})
+	return ran, err
+}
+
+// newACMEClient returns a client for the configured directory, registering an account on
+// first use. The account key is stored encrypted so every replica shares the account.
+func newACMEClient(ctx context.Context) (*acme.Client, error) {
+	httpClient, err := acmeHTTPClient()
+	if err != nil {
+		return nil, err
+	}
+
+	directoryURL := acmeDirectoryURL()
+	client, err := loadACMEAccount(httpClient, directoryURL)
+	if client != nil || err != nil {
+		return client, err
+	}
+
+	// Replicas racing to register the first account wait for each other; the losers find
+	// the winner's account once they hold the lock
+	_, err = withAdvisoryLock(ctx, acmeAccountLockID, true, func() error {
+		if client, err = loadACMEAccount(httpClient, directoryURL); client != nil || err != nil {
+			return err
+		}
+		client, err = registerACMEAccount(ctx, httpClient, directoryURL)
+		return err
+	})
+	return client, err
+}
+
+// loadACMEAccount returns a client for the stored account of directoryURL, or nil if there
+// is none yet
+func loadACMEAccount(httpClient *http.Client, directoryURL string) (*acme.Client, error) {
+	var account ACMEAccount
+	err := DB.Where("directory_url = ?", directoryURL).First(&account).Error
+	if err == gorm.ErrRecordNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	keyPEM, err := decryptSecret(account.KeyPEM)
+	if err != nil {
+		return nil, err
+	}
+	key, err := parseECPrivateKey(keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	return &acme.Client{Key: key, DirectoryURL: directoryURL, HTTPClient: httpClient, UserAgent: "pepes-api"}, nil
+}
+
+// registerACMEAccount registers a new account with directoryURL and stores its key
+func registerACMEAccount(ctx context.Context, httpClient *http.Client, directoryURL string) (*acme.Client, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	client := &acme.Client{Key: key, DirectoryURL: directoryURL, HTTPClient: httpClient, UserAgent: "pepes-api"}
+
+	var contact []string
+	if email := getEnv("ACME_EMAIL", ""); email != "" {
+		contact = []string{"mailto:" + email}
+	}
+	registered, err := client.Register(ctx, &acme.Account{Contact: contact}, acme.AcceptTOS)
+	if err != nil && !errors.Is(err, acme.ErrAccountAlreadyExists) {
+		return nil, fmt.Errorf("could not register ACME account: %v", err)
+	}
+
+	keyPEM, err := marshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	encryptedKey, err := encryptSecret(keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	account := ACMEAccount{DirectoryURL: directoryURL, KeyPEM: encryptedKey}
+	if registered != nil {
+		account.URI = registered.URI
+	}
+	if err := DB.Create(&account).Error; err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+// issueACMECertificate orders a certificate for a verified domain using the HTTP-01 challenge
+// and stores it as the domain's certificate. principal is the caller, or nil for renewals.
+func issueACMECertificate(ctx context.Context, principal *Principal, domain Domain) (Certificate, error) {
+	if domain.Status != DomainStatusVerified {
+		return Certificate{}, fmt.Errorf("domain %s is not verified", domain.Name)
+	}
+	if isWildcardDomain(domain.Name) {
+		return Certificate{}, fmt.Errorf("wildcard domains need the DNS-01 challenge, which is not supported")
+	}
+
+	client, err := newACMEClient(ctx)
+	if err != nil {
+		return Certificate{}, err
+	}
+
+	order, err := client.AuthorizeOrder(ctx, acme.DomainIDs(domain.Name))
+	if err != nil {
+		return Certificate{}, fmt.Errorf("could not create ACME order: %v", err)
+	}
+
+	for _, authzURL := range order.AuthzURLs {
+		if err := completeHTTP01(ctx, client, authzURL, domain.Name); err != nil {
+			return Certificate{}, err
+		}
+	}
+
+	if _, err := client.WaitOrder(ctx, order.URI); err != nil {
+		return Certificate{}, fmt.Errorf("ACME order did not become ready: %v", err)
+	}
+
+	certKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return Certificate{}, err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{DNSNames: []string{domain.Name}}, certKey)
+	if err != nil {
+		return Certificate{}, err
+	}
+
+	chain, _, err := client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return Certificate{}, fmt.Errorf("could not finalize ACME order: %v", err)
+	}
+	if len(chain) == 0 {
+		return Certificate{}, fmt.Errorf("ACME server returned an empty certificate chain")
+	}
+
+	leaf, err := x509.ParseCertificate(chain[0])
+	if err != nil {
+		return Certificate{}, err
+	}
+	if !certificateCoversDomain(leaf, domain.Name) {
+		return Certificate{}, fmt.Errorf("issued certificate does not cover %s", domain.Name)
+	}
+
+	var chainPEM strings.Builder
+	for _, der := range chain {
+		pem.Encode(&chainPEM, &pem.Block{Type: "CERTIFICATE", Bytes: der})
+	}
+	keyPEM, err := marshalECPrivateKey(certKey)
+	if err != nil {
+		return Certificate{}, err
+	}
+	encryptedKey, err := encryptSecret(keyPEM)
+	if err != nil {
+		return Certificate{}, err
+	}
+
+	cert, err := saveDomainCertificate(principal, domain, leaf, chainPEM.String(), encryptedKey, CertificateSourceACME)
+	if err != nil {
+		return Certificate{}, err
+	}
+
+	publishConfigChange(ConfigEntityCertificate, ConfigActionUpdated, cert.ID, domain.UserId, cert)
+	return cert, nil
+}
+
+// completeHTTP01 publishes the HTTP-01 key authorization of an authorization and waits for
+// the ACME server to validate it
+func completeHTTP01(ctx context.Context, client *acme.Client, authzURL, domainName string) error {
+	authz, err := client.GetAuthorization(ctx, authzURL)
+	if err != nil {
+		return fmt.Errorf("could not fetch ACME authorization: %v", err)
+	}
+	if authz.Status == acme.StatusValid {
+		return nil
+	}
+
+	var challenge *acme.Challenge
+	for _, candidate := range authz.Challenges {
+		if candidate.Type == "http-01" {
+			challenge = candidate
+			break
+		}
+	}
+	if challenge == nil {
+		return fmt.Errorf("ACME server offered no http-01 challenge for %s", domainName)
+	}
+
+	keyAuthorization, err := client.HTTP01ChallengeResponse(challenge.Token)
+	if err != nil {
+		return err
+	}
+
+	record := ACMEChallenge{
+		Token:            challenge.Token,
+		KeyAuthorization: keyAuthorization,
+		Domain:           domainName,
+		ExpiresAt:        time.Now().Add(acmeChallengeTTL),
+	}
+	if err := DB.Create(&record).Error; err != nil {
+		return err
+	}
+	defer DB.Delete(&record)
+
+	if _, err := client.Accept(ctx, challenge); err != nil {
+		return fmt.Errorf("could not accept ACME challenge: %v", err)
+	}
+	if _, err := client.WaitAuthorization(ctx, authzURL); err != nil {
+		return fmt.Errorf("ACME validation of %s failed: %v", domainName, err)
+	}
+	return nil
+}
+
+// runACMERenewals periodically orders certificates for verified auto_tls domains that have
+// none or whose certificate expires within ACME_RENEW_BEFORE_DAYS
+func runACMERenewals(ctx context.Context) {
+	ticker := time.NewTicker(acmeRenewalInterval())
+	defer ticker.Stop()
+
+	for {
+		renewACMECertificates(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// renewACMECertificates runs one renewal pass. An advisory lock ensures only one replica
+// orders certificates at a time.
+func renewACMECertificates(ctx context.Context) {
+	_, err := withAdvisoryLock(ctx, acmeRenewalLockID, false, func() error {
+		// Expired challenges are left behind by orders interrupted by a restart
+		DB.Where("expires_at < ?", time.Now()).Delete(&ACMEChallenge{})
+
+		var domains []Domain
+		err := DB.Where("status = ? AND auto_tls = ? AND name NOT LIKE ?", DomainStatusVerified, true, wildcardDomainPrefix+"%").
+			Where("id NOT IN (?)", DB.Model(&Certificate{}).Select("domain_id").Where("not_after > ?", time.Now().Add(acmeRenewBefore()))).
+			Order("id").Find(&domains).Error
+		if err != nil {
+			return err
+		}
+
+		for _, domain := range domains {
+			issueCtx, cancel := context.WithTimeout(ctx, acmeIssueTimeout)
+			if _, err := issueACMECertificate(issueCtx, nil, domain); err != nil {
+				log.Printf("ACME issuance for %s failed: %v", domain.Name, err)
+			} else {
+				log.Printf("ACME issued a certificate for %s", domain.Name)
+			}
+			cancel()
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("ACME renewal pass failed: %v", err)
+	}
+}
+
+// marshalECPrivateKey encodes an ECDSA key as PEM
+func marshalECPrivateKey(key *ecdsa.PrivateKey) (string, error) {
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return "", err
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})), nil
+}
+
+// parseECPrivateKey decodes a PEM encoded ECDSA key
+func parseECPrivateKey(keyPEM string) (crypto.Signer, error) {
+	block, _ := pem.Decode([]byte(keyPEM))
+	if block == nil {
+		return nil, fmt.Errorf("ACME account key is not valid PEM")
+	}
+	return x509.ParseECPrivateKey(block.Bytes)
+}
+
+// IssueDomainCertificate orders a certificate for a domain from the ACME server right away
+func IssueDomainCertificate(c *gin.Context) {
+	if !acmeEnabled() {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "ACME issuance is not enabled"})
+		return
+	}
+
+	domain, ok := findDomainForCertificate(c)
+	if !ok {
+		return
+	}
+
+	if domain.Status != DomainStatusVerified {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Domain must be verified before a certificate can be issued"})
+		return
+	}
+	if isWildcardDomain(domain.Name) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Certificates for wildcard domains cannot be issued with HTTP-01"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), acmeIssueTimeout)
+	defer cancel()
+
+	cert, err := issueACMECertificate(ctx, currentPrincipal(c), domain)
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Certificate issuance failed: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": cert})
+}
+
+// ServeACMEChallenge answers HTTP-01 validation requests. It is unauthenticated so the
+// gateway can proxy /.well-known/acme-challenge/ for every domain to it; a challenge is
+// only answered on the host it was issued for.
+func ServeACMEChallenge(c *gin.Context) {
+	var challenge ACMEChallenge
+	err := DB.Where("token = ? AND expires_at > ?", c.Param("token"), time.Now()).First(&challenge).Error
+	if err != nil || challenge.Domain != requestHostName(c.Request) {
+		c.String(http.StatusNotFound, "not found")
+		return
+	}
+
+	c.String(http.StatusOK, challenge.KeyAuthorization)
+}
+
+// requestHostName returns the lowercased host of a request without its port
+func requestHostName(r *http.Request) string {
+	host := r.Host
+	if name, _, err := net.SplitHostPort(host); err == nil {
+		host = name
+	}
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Environment of the ACME test against a local Pebble. Pebble must resolve the test domain
+// to this machine, e.g. by running pebble-challtestsrv -defaultIPv4 127.0.0.1 and starting
+// pebble with -dnsserver 127.0.0.1:8053.
+const (
+	// testACMEDirectoryEnv is Pebble's directory, e.g. https://localhost:14000/dir
+	testACMEDirectoryEnv = "PEPES_TEST_ACME_DIRECTORY_URL"
+
+	// testACMECABundleEnv is Pebble's TLS root (test/certs/pebble.minica.pem); without
+	// it certificate verification of the directory is skipped
+	testACMECABundleEnv = "PEPES_TEST_ACME_CA_BUNDLE"
+
+	// testACMEHTTPPortEnv is the port Pebble validates HTTP-01 challenges on, 5002 by default
+	testACMEHTTPPortEnv = "PEPES_TEST_ACME_HTTP_PORT"
+)
+
+func TestECPrivateKeyRoundTrip(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPEM, err := marshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := parseECPrivateKey(keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !key.PublicKey.Equal(parsed.Public()) {
+		t.Error("parsed key does not match the marshaled one")
+	}
+
+	if _, err := parseECPrivateKey("not a key"); err == nil {
+		t.Error("parsing garbage succeeded")
+	}
+}
+
+func TestACMEHTTPClientCABundle(t *testing.T) {
+	t.Setenv("ACME_CA_BUNDLE", t.TempDir()+"/missing.pem")
+	if _, err := acmeHTTPClient(); err == nil {
+		t.Error("a missing ACME_CA_BUNDLE was accepted")
+	}
+
+	empty := t.TempDir() + "/empty.pem"
+	if err := os.WriteFile(empty, []byte("no certificates here"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("ACME_CA_BUNDLE", empty)
+	if _, err := acmeHTTPClient(); err == nil {
+		t.Error("an ACME_CA_BUNDLE without certificates was accepted")
+	}
+}
+
+func TestServeACMEChallenge(t *testing.T) {
+	openTestDatabase(t)
+
+	mustCreate(t, &ACMEChallenge{Token: "live", KeyAuthorization: "live.thumbprint", Domain: "example.com", ExpiresAt: time.Now().Add(time.Hour)})
+	mustCreate(t, &ACMEChallenge{Token: "stale", KeyAuthorization: "stale.thumbprint", Domain: "example.com", ExpiresAt: time.Now().Add(-time.Minute)})
+	mustCreate(t, &ACMEChallenge{Token: "elsewhere", KeyAuthorization: "elsewhere.thumbprint", Domain: "other.example.com", ExpiresAt: time.Now().Add(time.Hour)})
+
+	serve := func(token string) (int, string) {
+		w := serveAs(t, nil, ServeACMEChallenge, http.MethodGet, "/.well-known/acme-challenge/:token", "/.well-known/acme-challenge/"+token, "")
+		return w.Code, w.Body.String()
+	}
+	if code, body := serve("live"); code != http.StatusOK || body != "live.thumbprint" {
+		t.Errorf("live challenge = %d %q", code, body)
+	}
+	if code, _ := serve("stale"); code != http.StatusNotFound {
+		t.Errorf("expired challenge = %d, want 404", code)
+	}
+	if code, _ := serve("unknown"); code != http.StatusNotFound {
+		t.Errorf("unknown challenge = %d, want 404", code)
+	}
+	// httptest requests are made to example.com
+	if code, _ := serve("elsewhere"); code != http.StatusNotFound {
+		t.Errorf("challenge of another host = %d, want 404", code)
+	}
+}
+
+// useTestEncryptionKey sets a random PEPES_ENCRYPTION_KEY for the duration of the test
+func useTestEncryptionKey(t *testing.T) {
+	t.Helper()
+	key := make([]byte, encryptionKeySize)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PEPES_ENCRYPTION_KEY", base64.StdEncoding.EncodeToString(key))
+}
+
+// usePebble points the ACME client at the Pebble from the environment and serves HTTP-01
+// challenges on the port Pebble validates them on. Tests are skipped without Pebble.
+func usePebble(t *testing.T) {
+	t.Helper()
+	directoryURL := os.Getenv(testACMEDirectoryEnv)
+	if directoryURL == "" {
+		t.Skipf("%s is not set", testACMEDirectoryEnv)
+	}
+	openTestDatabase(t)
+	useTestEncryptionKey(t)
+
+	t.Setenv("ACME_DIRECTORY_URL", directoryURL)
+	if bundle := os.Getenv(testACMECABundleEnv); bundle != "" {
+		t.Setenv("ACME_CA_BUNDLE", bundle)
+	} else {
+		t.Setenv("ACME_INSECURE_SKIP_VERIFY", "true")
+	}
+
+	port := os.Getenv(testACMEHTTPPortEnv)
+	if port == "" {
+		port = "5002"
+	}
+	listener, err := net.Listen("tcp", ":"+port)
+	if err != nil {
+		t.Fatalf("cannot serve HTTP-01 challenges on port %s: %v", port, err)
+	}
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/.well-known/acme-challenge/:token", ServeACMEChallenge)
+	server := &http.Server{Handler: r}
+	go server.Serve(listener)
+	t.Cleanup(func() { server.Close() })
+}
+
+func TestACMEAccountRegistrationIsSerialized(t *testing.T) {
+	usePebble(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	const replicas = 4
+	var wg sync.WaitGroup
+	errs := make(chan error, replicas)
+	for i := 0; i < replicas; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := newACMEClient(ctx)
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("newACMEClient: %v", err)
+		}
+	}
+
+	var accounts int64
+	if err := DB.Model(&ACMEAccount{}).Count(&accounts).Error; err != nil {
+		t.Fatal(err)
+	}
+	if accounts != 1 {
+		t.Errorf("%d ACME accounts registered by concurrent clients, want 1", accounts)
+	}
+}
+
+func TestACMERenewalIssuesCertificates(t *testing.T) {
+	usePebble(t)
+
+	domain := Domain{Name: "acme.example.com", UserId: "alice", Status: DomainStatusVerified, AutoTLS: true}
+	mustCreate(t, &domain)
+	// Not auto_tls, so left alone by renewals
+	mustCreate(t, &Domain{Name: "manual-tls.example.com", UserId: "alice", Status: DomainStatusVerified})
+
+	ctx, cancel := context.WithTimeout(context.Background(), acmeIssueTimeout)
+	defer cancel()
+	renewACMECertificates(ctx)
+
+	var certs []Certificate
+	if err := DB.Find(&certs).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(certs) != 1 || certs[0].DomainID != domain.ID {
+		t.Fatalf("renewal stored certificates %+v, want one for %s", certs, domain.Name)
+	}
+	cert := certs[0]
+	if cert.Source != CertificateSourceACME {
+		t.Errorf("certificate source = %s, want %s", cert.Source, CertificateSourceACME)
+	}
+
+	block, _ := pem.Decode([]byte(cert.Certificate))
+	if block == nil {
+		t.Fatal("stored certificate is not PEM")
+	}
+	leaf, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := leaf.VerifyHostname(domain.Name); err != nil {
+		t.Errorf("issued certificate: %v", err)
+	}
+	keyPEM, err := decryptSecret(cert.PrivateKey)
+	if err != nil {
+		t.Fatalf("stored private key: %v", err)
+	}
+	key, err := parseECPrivateKey(keyPEM)
+	if err != nil {
+		t.Fatalf("stored private key: %v", err)
+	}
+	if !key.Public().(*ecdsa.PublicKey).Equal(leaf.PublicKey) {
+		t.Error("stored private key does not match the certificate")
+	}
+
+	var challenges int64
+	if err := DB.Model(&ACMEChallenge{}).Count(&challenges).Error; err != nil {
+		t.Fatal(err)
+	}
+	if challenges != 0 {
+		t.Errorf("%d HTTP-01 challenges left behind", challenges)
+	}
+
+	// A certificate far from expiry is not renewed
+	renewACMECertificates(ctx)
+	var renewed Certificate
+	if err := DB.Where("domain_id = ?", domain.ID).First(&renewed).Error; err != nil {
+		t.Fatal(err)
+	}
+	if renewed.Fingerprint != cert.Fingerprint {
+		t.Error("a valid certificate was renewed")
+	}
+}
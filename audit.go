@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Entities audited in addition to the configuration change event entities
+const (
+	AuditEntityDomainPolicy = "domain_policy"
+	AuditEntityAPIKey       = "api_key"
+)
+
+// auditSystemActor is recorded for changes made by the API itself, such as ACME renewals
+const auditSystemActor = "system"
+
+// auditPruneInterval is the time between deletions of expired audit events
+const auditPruneInterval = time.Hour
+
+// recordAudit stores an audit event for a change made by principal, which is nil for
+// changes made by the API itself. It takes the transaction of the change so the event is
+// only kept when the change commits. before is nil for creates and after for deletes.
+func recordAudit(tx *gorm.DB, principal *Principal, entity, action string, id uint, owner string, before, after interface{}) error {
+	event := AuditEvent{
+		Actor:      auditSystemActor,
+		Action:     action,
+		EntityType: entity,
+		EntityID:   id,
+		Owner:      owner,
+	}
+	if principal != nil {
+		event.Actor = principal.UserId
+		event.ActorRole = principal.Role
+		event.APIKeyID = principal.KeyID
+	}
+
+	// Entities redact their secrets when marshaled, so snapshots never hold plaintext secrets
+	var err error
+	if event.Before, err = auditSnapshot(before); err != nil {
+		return err
+	}
+	if event.After, err = auditSnapshot(after); err != nil {
+		return err
+	}
+	return tx.Create(&event).Error
+}
+
+func auditSnapshot(value interface{}) (json.RawMessage, error) {
+	if value == nil {
+		return nil, nil
+	}
+	return json.Marshal(value)
+}
+
+// loadRouteSnapshot loads a route with its domain, plugins, upstream targets and health
+// check, as recorded in the audit log
+func loadRouteSnapshot(tx *gorm.DB, id uint) (Route, error) {
+	var route Route
+	err := preloadRouteDetails(tx.Preload("Domain")).First(&route, id).Error
+	return route, err
+}
+
+// auditRoute records a route create or update and returns the saved route with its details
+func auditRoute(tx *gorm.DB, principal *Principal, action string, id uint, before interface{}) (Route, error) {
+	route, err := loadRouteSnapshot(tx, id)
+	if err != nil {
+		return route, err
+	}
+	return route, recordAudit(tx, principal, ConfigEntityRoute, action, id, route.Domain.UserId, before, route)
+}
+
+// auditRouteUpdate wraps a transaction function that changes a route, recording the route
+// as it was before and after the change
+func auditRouteUpdate(principal *Principal, id uint, change func(tx *gorm.DB) error) func(tx *gorm.DB) error {
+	return func(tx *gorm.DB) error {
+		before, err := loadRouteSnapshot(tx, id)
+		if err != nil {
+			return err
+		}
+		if err := change(tx); err != nil {
+			return err
+		}
+		_, err = auditRoute(tx, principal, ConfigActionUpdated, id, before)
+		return err
+	}
+}
+
+// auditRetention returns how long audit events are kept (AUDIT_RETENTION_DAYS, default 90).
+// 0 keeps them forever.
+func auditRetention() time.Duration {
+	days, err := strconv.Atoi(getEnv("AUDIT_RETENTION_DAYS", "90"))
+	if err != nil || days < 0 {
+		days = 90
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// runAuditRetention periodically deletes audit events older than the retention period
+func runAuditRetention(ctx context.Context) {
+	ticker := time.NewTicker(auditPruneInterval)
+	defer ticker.Stop()
+
+	for {
+		if retention := auditRetention(); retention > 0 {
+			result := DB.Where("created_at < ?", time.Now().Add(-retention)).Delete(&AuditEvent{})
+			if result.Error != nil {
+				log.Printf("Failed to prune audit events: %v", result.Error)
+			} else if result.RowsAffected > 0 {
+				log.Printf("Pruned %d audit events older than %s", result.RowsAffected, retention)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// GetAuditEvents returns a page of audit events, filtered by entity, actor, action and
+// time range. Users only see events about their own entities.
+func GetAuditEvents(c *gin.Context) {
+	params, err := parseListParams(c, auditEventSortFields)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	query := DB.Model(&AuditEvent{})
+	if userId := scopeUserId(c); userId != "" {
+		query = query.Where("owner = ?", userId)
+	}
+
+	if entity := c.Query("entity"); entity != "" {
+		query = query.Where("entity_type = ?", entity)
+	}
+	if entityID := c.Query("entity_id"); entityID != "" {
+		id, err := strconv.ParseUint(entityID, 10, 32)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "entity_id must be a number"})
+			return
+		}
+		query = query.Where("entity_id = ?", id)
+	}
+	if actor := c.Query("actor"); actor != "" {
+		query = query.Where("actor = ?", actor)
+	}
+	if action := c.Query("action"); action != "" {
+		query = query.Where("action = ?", action)
+	}
+	for param, condition := range map[string]string{"since": "created_at >= ?", "until": "created_at < ?"} {
+		value := c.Query(param)
+		if value == "" {
+			continue
+		}
+		at, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": param + " must be an RFC 3339 timestamp"})
+			return
+		}
+		query = query.Where(condition, at)
+	}
+
+	var events []AuditEvent
+	total, err := paginate(query, params, &events)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": formatDatabaseError(err)})
+		return
+	}
+
+	respondList(c, params, events, total)
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Roles a principal can have
+const (
+	RoleAdmin = "admin"
+	RoleUser  = "user"
+)
+
+const (
+	// principalContextKey is the gin context key holding the authenticated *Principal
+	principalContextKey = "principal"
+
+	// apiKeyPrefix marks tokens issued by this API
+	apiKeyPrefix = "pk_"
+
+	// apiKeyLastUsedResolution limits how often last_used_at is written for a key
+	apiKeyLastUsedResolution = time.Minute
+)
+
+// Principal is the authenticated caller of the management API
+type Principal struct {
+	UserId string `json:"user_id"`
+	Role   string `json:"role"`
+	KeyID  uint   `json:"key_id,omitempty"`
+}
+
+// IsAdmin reports whether the principal has the admin role
+func (p *Principal) IsAdmin() bool {
+	return p != nil && p.Role == RoleAdmin
+}
+
+// currentPrincipal returns the principal set by AuthMiddleware
+func currentPrincipal(c *gin.Context) *Principal {
+	if value, ok := c.Get(principalContextKey); ok {
+		if principal, ok := value.(*Principal); ok {
+			return principal
+		}
+	}
+	return nil
+}
+
+// adminTokens returns the static admin tokens configured in ADMIN_TOKENS
+func adminTokens() []string {
+	var tokens []string
+	for _, token := range strings.Split(getEnv("ADMIN_TOKENS", ""), ",") {
+		if token = strings.TrimSpace(token); token != "" {
+			tokens = append(tokens, token)
+		}
+	}
+	return tokens
+}
+
+// AuthMiddleware authenticates requests with a static admin token or a per-user API key,
+// passed as "Authorization: Bearer <token>" or "X-API-Key: <token>"
+func AuthMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token := requestToken(c)
+		if token == "" {
+			abortUnauthorized(c, "Authentication required")
+			return
+		}
+
+		principal, err := authenticateToken(token)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": formatDatabaseError(err)})
+			return
+		}
+		if principal == nil {
+			abortUnauthorized(c, "Invalid or revoked credentials")
+			return
+		}
+
+		c.Set(principalContextKey, principal)
+		c.Next()
+	}
+}
+
+// canRevealSecrets reports whether the caller may read decrypted secrets in the config feed.
+// Only admin credentials, which the gateway uses, qualify.
+func canRevealSecrets(c *gin.Context) bool {
+	return currentPrincipal(c).IsAdmin()
+}
+
+// RequireAdmin rejects requests whose principal is not an admin
+func RequireAdmin() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !currentPrincipal(c).IsAdmin() {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Admin role required"})
+			return
+		}
+		c.Next()
+	}
+}
+
+func abortUnauthorized(c *gin.Context, message string) {
+	c.Header("WWW-Authenticate", "Bearer")
+	c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": message})
+}
+
+// requestToken extracts the credential from the request headers
+func requestToken(c *gin.Context) string {
+	if header := c.GetHeader("Authorization"); header != "" {
+		if scheme, token, ok := strings.Cut(header, " "); ok && strings.EqualFold(scheme, "Bearer") {
+			return strings.TrimSpace(token)
+		}
+	}
+	return strings.TrimSpace(c.GetHeader("X-API-Key"))
+}
+
+// authenticateToken resolves a token to a principal, returning nil for unknown tokens
+func authenticateToken(token string) (*Principal, error) {
+	for _, adminToken := range adminTokens() {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) == 1 {
+			return &Principal{UserId: RoleAdmin, Role: RoleAdmin}, nil
+		}
+	}
+
+	prefix, ok := apiKeyLookupPrefix(token)
+	if !ok {
+		return nil, nil
+	}
+
+	var key APIKey
+	if err := DB.Where("prefix = ?", prefix).First(&key).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	if subtle.ConstantTimeCompare([]byte(hashAPIKey(token)), []byte(key.KeyHash)) != 1 {
+		return nil, nil
+	}
+
+	now := time.Now()
+	if key.RevokedAt != nil || (key.ExpiresAt != nil && now.After(*key.ExpiresAt)) {
+		return nil, nil
+	}
+
+	if key.LastUsedAt == nil || now.Sub(*key.LastUsedAt) > apiKeyLastUsedResolution {
+		DB.Model(&key).UpdateColumn("last_used_at", now)
+	}
+
+	return &Principal{UserId: key.UserId, Role: key.Role, KeyID: key.ID}, nil
+}
+
+// generateAPIKey returns a new plaintext key and its lookup prefix
+func generateAPIKey() (string, string, error) {
+	prefixBytes := make([]byte, 6)
+	if _, err := rand.Read(prefixBytes); err != nil {
+		return "", "", err
+	}
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", "", err
+	}
+
+	prefix := hex.EncodeToString(prefixBytes)
+	return apiKeyPrefix + prefix + "." + base64.RawURLEncoding.EncodeToString(secret), prefix, nil
+}
+
+// apiKeyLookupPrefix extracts the lookup prefix from a plaintext key
+func apiKeyLookupPrefix(token string) (string, bool) {
+	if !strings.HasPrefix(token, apiKeyPrefix) {
+		return "", false
+	}
+	prefix, _, ok := strings.Cut(strings.TrimPrefix(token, apiKeyPrefix), ".")
+	return prefix, ok && prefix != ""
+}
+
+// hashAPIKey hashes a plaintext key for storage
+func hashAPIKey(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// GetAPIKeys returns the caller's API keys, or every key for admins
+func GetAPIKeys(c *gin.Context) {
+	principal := currentPrincipal(c)
+	var keys []APIKey
+	query := DB.Order("id")
+
+	if !principal.IsAdmin() {
+		query = query.Where("user_id = ?", principal.UserId)
+	} else if userId := c.Query("user_id"); userId != "" {
+		query = query.Where("user_id = ?", userId)
+	}
+
+	if err := query.Find(&keys).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": formatDatabaseError(err)})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"data":  keys,
+		"count": len(keys),
+	})
+}
+
+// CreateAPIKey issues a new API key. The plaintext key is only returned in this response.
+func CreateAPIKey(c *gin.Context) {
+	principal := currentPrincipal(c)
+
+	var req CreateAPIKeyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": formatValidationError(err)})
+		return
+	}
+
+	userId := principal.UserId
+	role := RoleUser
+	if req.UserId != "" || req.Role != "" {
+		if !principal.IsAdmin() {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Only admins can issue keys for other users or roles"})
+			return
+		}
+		if req.UserId != "" {
+			userId = req.UserId
+		}
+		if req.Role != "" {
+			role = req.Role
+		}
+	}
+
+	plaintext, prefix, err := generateAPIKey()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate API key"})
+		return
+	}
+
+	key := APIKey{
+		Name:    req.Name,
+		UserId:  userId,
+		Role:    role,
+		Prefix:  prefix,
+		KeyHash: hashAPIKey(plaintext),
+	}
+	if req.ExpiresInDays > 0 {
+		expiresAt := time.Now().AddDate(0, 0, req.ExpiresInDays)
+		key.ExpiresAt = &expiresAt
+	}
+
+	err = DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&key).Error; err != nil {
+			return err
+		}
+		return recordAudit(tx, principal, AuditEntityAPIKey, ConfigActionCreated, key.ID, key.UserId, nil, key)
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": formatDatabaseError(err)})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"data": key, "key": plaintext})
+}
+
+// RevokeAPIKey revokes an API key owned by the caller (or any key for admins)
+func RevokeAPIKey(c *gin.Context) {
+	principal := currentPrincipal(c)
+	id := c.Param("id")
+	var key APIKey
+
+	query := DB
+	if !principal.IsAdmin() {
+		query = query.Where("user_id = ?", principal.UserId)
+	}
+	if err := query.First(&key, id).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "API key not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": formatDatabaseError(err)})
+		return
+	}
+
+	if key.RevokedAt == nil {
+		before := key
+		now := time.Now()
+		key.RevokedAt = &now
+		err := DB.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Save(&key).Error; err != nil {
+				return err
+			}
+			return recordAudit(tx, principal, AuditEntityAPIKey, ConfigActionUpdated, key.ID, key.UserId, before, key)
+		})
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": formatDatabaseError(err)})
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "API key revoked successfully"})
+}
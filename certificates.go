@@ -0,0 +1,344 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Sources of certificates
+const (
+	CertificateSourceUpload = "upload"
+	CertificateSourceACME   = "acme"
+)
+
+// defaultCertificateExpiryDays is the window used by the expiring certificates listing
+const defaultCertificateExpiryDays = 30
+
+// parseCertificateChain checks that certPEM (leaf first, then intermediates) and keyPEM form a
+// valid key pair, that the leaf is currently valid and covers domainName, and that the chain
+// is trusted. It returns the leaf and the chain re-encoded as PEM.
+func parseCertificateChain(domainName, certPEM, keyPEM string, now time.Time) (*x509.Certificate, string, error) {
+	pair, err := tls.X509KeyPair([]byte(certPEM), []byte(keyPEM))
+	if err != nil {
+		return nil, "", fmt.Errorf("certificate and private key are not a valid PEM key pair: %v", err)
+	}
+
+	leaf, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, "", fmt.Errorf("certificate is not valid: %v", err)
+	}
+
+	var chain strings.Builder
+	intermediates := x509.NewCertPool()
+	for i, der := range pair.Certificate {
+		if i > 0 {
+			cert, err := x509.ParseCertificate(der)
+			if err != nil {
+				return nil, "", fmt.Errorf("intermediate certificate %d is not valid: %v", i, err)
+			}
+			intermediates.AddCert(cert)
+		}
+		pem.Encode(&chain, &pem.Block{Type: "CERTIFICATE", Bytes: der})
+	}
+
+	if now.Before(leaf.NotBefore) || now.After(leaf.NotAfter) {
+		return nil, "", fmt.Errorf("certificate is only valid from %s to %s",
+			leaf.NotBefore.Format(time.RFC3339), leaf.NotAfter.Format(time.RFC3339))
+	}
+	if !certificateCoversDomain(leaf, domainName) {
+		return nil, "", fmt.Errorf("certificate does not cover %s (SANs: %s)", domainName, strings.Join(leaf.DNSNames, ", "))
+	}
+
+	roots, err := trustedCertificateRoots()
+	if err != nil {
+		return nil, "", err
+	}
+	_, err = leaf.Verify(x509.VerifyOptions{
+		Intermediates: intermediates,
+		Roots:         roots,
+		CurrentTime:   now,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	if err != nil {
+		return nil, "", fmt.Errorf("certificate chain is not trusted: %v", err)
+	}
+
+	return leaf, chain.String(), nil
+}
+
+// certificateCoversDomain reports whether the SANs of leaf cover a domain name. A wildcard
+// domain needs the same wildcard SAN.
+func certificateCoversDomain(leaf *x509.Certificate, domainName string) bool {
+	if isWildcardDomain(domainName) {
+		for _, name := range leaf.DNSNames {
+			if strings.EqualFold(name, domainName) {
+				return true
+			}
+		}
+		return false
+	}
+	return leaf.VerifyHostname(domainName) == nil
+}
+
+// trustedCertificateRoots returns the system roots plus the CAs in CERTIFICATE_TRUSTED_CA_FILE
+func trustedCertificateRoots() (*x509.CertPool, error) {
+	roots, err := x509.SystemCertPool()
+	if err != nil {
+		roots = x509.NewCertPool()
+	}
+
+	if path := getEnv("CERTIFICATE_TRUSTED_CA_FILE", ""); path != "" {
+		bundle, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("could not read CERTIFICATE_TRUSTED_CA_FILE: %v", err)
+		}
+		if !roots.AppendCertsFromPEM(bundle) {
+			return nil, fmt.Errorf("CERTIFICATE_TRUSTED_CA_FILE contains no certificates")
+		}
+	}
+	return roots, nil
+}
+
+// storeDomainCertificate creates or replaces the certificate of a domain. The private key
+// must already be encrypted with encryptSecret.
+func storeDomainCertificate(tx *gorm.DB, domainID uint, leaf *x509.Certificate, chainPEM, encryptedKey, source string) (Certificate, error) {
+	var cert Certificate
+	if err := tx.Where("domain_id = ?", domainID).First(&cert).Error; err != nil && err != gorm.ErrRecordNotFound {
+		return cert, err
+	}
+
+	fingerprint := sha256.Sum256(leaf.Raw)
+	cert.DomainID = domainID
+	cert.Certificate = chainPEM
+	cert.PrivateKey = encryptedKey
+	cert.DNSNames = leaf.DNSNames
+	cert.Issuer = leaf.Issuer.String()
+	cert.Fingerprint = hex.EncodeToString(fingerprint[:])
+	cert.Source = source
+	cert.NotBefore = leaf.NotBefore
+	cert.NotAfter = leaf.NotAfter
+
+	return cert, tx.Save(&cert).Error
+}
+
+// saveDomainCertificate stores a certificate for a domain in a transaction that records the
+// change, made by principal, in the audit log
+func saveDomainCertificate(principal *Principal, domain Domain, leaf *x509.Certificate, chainPEM, encryptedKey, source string) (Certificate, error) {
+	var cert Certificate
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		var previous Certificate
+		err := tx.Where("domain_id = ?", domain.ID).First(&previous).Error
+		if err != nil && err != gorm.ErrRecordNotFound {
+			return err
+		}
+		existed := err == nil
+
+		if cert, err = storeDomainCertificate(tx, domain.ID, leaf, chainPEM, encryptedKey, source); err != nil {
+			return err
+		}
+		if existed {
+			return recordAudit(tx, principal, ConfigEntityCertificate, ConfigActionUpdated, cert.ID, domain.UserId, previous, cert)
+		}
+		return recordAudit(tx, principal, ConfigEntityCertificate, ConfigActionCreated, cert.ID, domain.UserId, nil, cert)
+	})
+	return cert, err
+}
+
+// scopeCertificates restricts a certificates query to certificates of the caller's domains
+func scopeCertificates(c *gin.Context, query *gorm.DB) *gorm.DB {
+	if userId := scopeUserId(c); userId != "" {
+		return query.Where("certificates.domain_id IN (?)", DB.Model(&Domain{}).Select("id").Where("user_id = ?", userId))
+	}
+	return query
+}
+
+// findDomainForCertificate loads the domain referenced by the :id path parameter
+func findDomainForCertificate(c *gin.Context) (Domain, bool) {
+	var domain Domain
+	if err := scopeDomains(c, DB).First(&domain, c.Param("id")).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Domain not found"})
+			return domain, false
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": formatDatabaseError(err)})
+		return domain, false
+	}
+	return domain, true
+}
+
+// GetCertificates returns a page of certificates
+func GetCertificates(c *gin.Context) {
+	params, err := parseListParams(c, certificateSortFields)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var certs []Certificate
+	query := scopeCertificates(c, DB.Model(&Certificate{}))
+
+	// Filter by domain if provided
+	if domainID := c.Query("domain_id"); domainID != "" {
+		if id, err := strconv.ParseUint(domainID, 10, 32); err == nil {
+			query = query.Where("domain_id = ?", uint(id))
+		}
+	}
+
+	total, err := paginate(query, params, &certs)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": formatDatabaseError(err)})
+		return
+	}
+
+	respondList(c, params, certs, total)
+}
+
+// GetExpiringCertificates returns the certificates expiring within ?days= days (30 by default),
+// soonest first, including those already expired
+func GetExpiringCertificates(c *gin.Context) {
+	days := defaultCertificateExpiryDays
+	if value := c.Query("days"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "days must be a non-negative number"})
+			return
+		}
+		days = parsed
+	}
+
+	var certs []Certificate
+	cutoff := time.Now().AddDate(0, 0, days)
+	if err := scopeCertificates(c, DB).Where("not_after <= ?", cutoff).Order("not_after, id").Find(&certs).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": formatDatabaseError(err)})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"data":  certs,
+		"count": len(certs),
+		"days":  days,
+	})
+}
+
+// GetCertificateBundle returns a certificate with its decrypted private key for the gateway
+func GetCertificateBundle(c *gin.Context) {
+	var cert Certificate
+	if err := DB.First(&cert, c.Param("id")).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Certificate not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": formatDatabaseError(err)})
+		return
+	}
+
+	privateKey, err := decryptSecret(cert.PrivateKey)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decrypt private key: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": cert, "private_key": privateKey})
+}
+
+// GetDomainCertificate returns the certificate attached to a domain
+func GetDomainCertificate(c *gin.Context) {
+	domain, ok := findDomainForCertificate(c)
+	if !ok {
+		return
+	}
+
+	var cert Certificate
+	if err := DB.Where("domain_id = ?", domain.ID).First(&cert).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Domain has no certificate"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": formatDatabaseError(err)})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": cert})
+}
+
+// PutDomainCertificate uploads a PEM certificate chain and private key for a domain,
+// replacing any existing certificate
+func PutDomainCertificate(c *gin.Context) {
+	domain, ok := findDomainForCertificate(c)
+	if !ok {
+		return
+	}
+
+	var req UploadCertificateRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": formatValidationError(err)})
+		return
+	}
+
+	leaf, chainPEM, err := parseCertificateChain(domain.Name, req.Certificate, req.PrivateKey, time.Now())
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	encryptedKey, err := encryptSecret(req.PrivateKey)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to encrypt private key: " + err.Error()})
+		return
+	}
+
+	cert, err := saveDomainCertificate(currentPrincipal(c), domain, leaf, chainPEM, encryptedKey, CertificateSourceUpload)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": formatDatabaseError(err)})
+		return
+	}
+
+	publishConfigChange(ConfigEntityCertificate, ConfigActionUpdated, cert.ID, domain.UserId, cert)
+
+	c.JSON(http.StatusOK, gin.H{"data": cert})
+}
+
+// DeleteDomainCertificate removes the certificate attached to a domain
+func DeleteDomainCertificate(c *gin.Context) {
+	domain, ok := findDomainForCertificate(c)
+	if !ok {
+		return
+	}
+
+	var cert Certificate
+	if err := DB.Where("domain_id = ?", domain.ID).First(&cert).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Domain has no certificate"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": formatDatabaseError(err)})
+		return
+	}
+
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Delete(&cert).Error; err != nil {
+			return err
+		}
+		return recordAudit(tx, currentPrincipal(c), ConfigEntityCertificate, ConfigActionDeleted, cert.ID, domain.UserId, cert, nil)
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": formatDatabaseError(err)})
+		return
+	}
+
+	publishConfigChange(ConfigEntityCertificate, ConfigActionDeleted, cert.ID, domain.UserId, cert)
+
+	c.JSON(http.StatusOK, gin.H{"message": "Certificate deleted successfully"})
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// requestTimeout bounds every API call
+const requestTimeout = 30 * time.Second
+
+// client calls the management API with the configured server and token
+type client struct {
+	server string
+	token  string
+	http   *http.Client
+}
+
+func newClient(s settings) *client {
+	return &client{
+		server: strings.TrimRight(s.Server, "/"),
+		token:  s.Token,
+		http:   &http.Client{Timeout: requestTimeout},
+	}
+}
+
+// apiError is an error response of the API
+type apiError struct {
+	Status  int             `json:"-"`
+	Message string          `json:"error"`
+	Details []apiFieldError `json:"details"`
+}
+
+// apiFieldError is one field of a config validation error
+type apiFieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+func (e *apiError) Error() string {
+	message := e.Message
+	if message == "" {
+		message = http.StatusText(e.Status)
+	}
+	for _, detail := range e.Details {
+		message += fmt.Sprintf("\n  %s: %s", detail.Field, detail.Message)
+	}
+	return fmt.Sprintf("%s (HTTP %d)", message, e.Status)
+}
+
+// do sends a request and returns the raw JSON body of a successful response
+func (c *client) do(method, path string, query url.Values, body []byte) ([]byte, error) {
+	target := c.server + path
+	if len(query) > 0 {
+		target += "?" + query.Encode()
+	}
+
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(method, target, reader)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	raw, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 400 {
+		apiErr := &apiError{Status: resp.StatusCode}
+		if json.Unmarshal(raw, apiErr) != nil {
+			apiErr.Message = strings.TrimSpace(string(raw))
+		}
+		return nil, apiErr
+	}
+	return raw, nil
+}
+
+// envelope is the common shape of API responses
+type envelope struct {
+	Data     json.RawMessage `json:"data"`
+	Count    *int            `json:"count"`
+	Total    *int64          `json:"total"`
+	Message  string          `json:"message"`
+	Warnings json.RawMessage `json:"warnings"`
+}
+
+func decodeEnvelope(raw []byte) (envelope, error) {
+	var env envelope
+	if err := json.Unmarshal(raw, &env); err != nil {
+		return env, fmt.Errorf("unexpected response: %v", err)
+	}
+	return env, nil
+}
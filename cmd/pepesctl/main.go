@@ -0,0 +1,442 @@
+// Command pepesctl is a command-line client for the pepes management API.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+const usage = `Usage: pepesctl [flags] <command>
+
+Resources (domains, routes, plugins, plugin-services):
+  pepesctl <resource> list [--limit N] [--offset N] [--sort FIELDS] [--param KEY=VALUE]
+  pepesctl <resource> get <id>
+  pepesctl <resource> create [-f FILE] [--set KEY=VALUE]...
+  pepesctl <resource> update <id> [-f FILE] [--set KEY=VALUE]...
+  pepesctl <resource> delete <id>
+
+Configuration:
+  pepesctl config get                 Render the gateway configuration (/config)
+  pepesctl config view                Show the connection settings in use
+  pepesctl config set server <url>    Store the API server URL in the config file
+  pepesctl config set token <token>   Store the API token in the config file
+
+Request bodies are read from FILE (JSON or YAML, "-" for stdin) and --set overrides,
+where KEY may be a dotted path and VALUE is parsed as JSON when possible. Plugin envs and
+plugin service baseconfig and schema may be given as objects.
+
+Flags:
+  -o, --output FORMAT   table, json or yaml (default table)
+  --server URL          API server URL (env PEPES_SERVER)
+  --token TOKEN         API token (env PEPES_TOKEN)
+  --config FILE         Config file (env PEPESCTL_CONFIG)
+  --param KEY=VALUE     Extra query parameter, e.g. --param domain_id=3 or --param shadowing=reject
+`
+
+// stringList is a repeatable string flag
+type stringList []string
+
+func (l *stringList) String() string { return strings.Join(*l, ",") }
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// options are the flags of an invocation
+type options struct {
+	server     string
+	token      string
+	configPath string
+	output     string
+	file       string
+	sets       stringList
+	params     stringList
+	limit      int
+	offset     int
+	sort       string
+}
+
+func main() {
+	if err := run(os.Args[1:], os.Stdout); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return
+		}
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(1)
+	}
+}
+
+// parseArgs parses flags anywhere on the command line and returns the positional arguments
+func parseArgs(args []string) (options, []string, error) {
+	opts := options{offset: -1}
+	fs := flag.NewFlagSet("pepesctl", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	fs.StringVar(&opts.server, "server", "", "")
+	fs.StringVar(&opts.token, "token", "", "")
+	fs.StringVar(&opts.configPath, "config", "", "")
+	fs.StringVar(&opts.output, "output", outputTable, "")
+	fs.StringVar(&opts.output, "o", outputTable, "")
+	fs.StringVar(&opts.file, "filename", "", "")
+	fs.StringVar(&opts.file, "f", "", "")
+	fs.Var(&opts.sets, "set", "")
+	fs.Var(&opts.params, "param", "")
+	fs.IntVar(&opts.limit, "limit", 0, "")
+	fs.IntVar(&opts.offset, "offset", -1, "")
+	fs.StringVar(&opts.sort, "sort", "", "")
+
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			if errors.Is(err, flag.ErrHelp) {
+				fmt.Print(usage)
+			}
+			return opts, nil, err
+		}
+		if fs.NArg() == 0 {
+			break
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+
+	switch opts.output {
+	case outputTable, outputJSON, outputYAML:
+	default:
+		return opts, nil, fmt.Errorf("unknown output format %q, expected table, json or yaml", opts.output)
+	}
+	return opts, positional, nil
+}
+
+func run(args []string, stdout io.Writer) error {
+	opts, positional, err := parseArgs(args)
+	if err != nil {
+		return err
+	}
+	if len(positional) == 0 || positional[0] == "help" {
+		fmt.Fprint(stdout, usage)
+		return nil
+	}
+
+	path := opts.configPath
+	if path == "" {
+		if path, err = settingsPath(); err != nil {
+			return err
+		}
+	}
+	file, err := loadSettings(path)
+	if err != nil {
+		return err
+	}
+	resolved := resolveSettings(file, opts.server, opts.token)
+
+	if positional[0] == "config" {
+		return runConfig(newClient(resolved), opts, positional[1:], path, file, resolved, stdout)
+	}
+
+	r, ok := findResource(positional[0])
+	if !ok {
+		return fmt.Errorf("unknown command %q, run pepesctl help for usage", positional[0])
+	}
+	if len(positional) < 2 {
+		return fmt.Errorf("%s needs a verb: list, get, create, update or delete", r.name)
+	}
+	return runResource(newClient(resolved), r, opts, positional[1], positional[2:], stdout)
+}
+
+// runConfig handles the config subcommands
+func runConfig(c *client, opts options, args []string, path string, file, resolved settings, stdout io.Writer) error {
+	if len(args) == 0 {
+		return fmt.Errorf("config needs a subcommand: get, view or set")
+	}
+
+	switch args[0] {
+	case "get":
+		query, err := queryParams(opts)
+		if err != nil {
+			return err
+		}
+		raw, err := c.do(http.MethodGet, "/config", query, nil)
+		if err != nil {
+			return err
+		}
+		if opts.output != outputTable {
+			return writeRaw(stdout, opts.output, raw)
+		}
+		var config map[string]interface{}
+		if err := decodeJSON(raw, &config); err != nil {
+			return err
+		}
+		return writeTable(stdout, configColumns, configRows(config))
+
+	case "view":
+		token := ""
+		if resolved.Token != "" {
+			token = maskToken(resolved.Token)
+		}
+		fmt.Fprintf(stdout, "config: %s\nserver: %s\ntoken:  %s\n", path, resolved.Server, token)
+		return nil
+
+	case "set":
+		if len(args) != 3 {
+			return fmt.Errorf("usage: pepesctl config set <server|token> <value>")
+		}
+		switch args[1] {
+		case "server":
+			if _, err := url.ParseRequestURI(args[2]); err != nil {
+				return fmt.Errorf("invalid server URL: %v", err)
+			}
+			file.Server = args[2]
+		case "token":
+			file.Token = args[2]
+		default:
+			return fmt.Errorf("unknown setting %q, expected server or token", args[1])
+		}
+		if err := saveSettings(path, file); err != nil {
+			return err
+		}
+		fmt.Fprintf(stdout, "Saved %s to %s\n", args[1], path)
+		return nil
+	}
+	return fmt.Errorf("unknown config subcommand %q", args[0])
+}
+
+// runResource handles the list, get, create, update and delete verbs of a resource
+func runResource(c *client, r resource, opts options, verb string, args []string, stdout io.Writer) error {
+	query, err := queryParams(opts)
+	if err != nil {
+		return err
+	}
+
+	needID := func() (string, error) {
+		if len(args) != 1 {
+			return "", fmt.Errorf("usage: pepesctl %s %s <id>", r.name, verb)
+		}
+		return url.PathEscape(args[0]), nil
+	}
+
+	switch verb {
+	case "list", "ls":
+		if opts.limit > 0 {
+			query.Set("limit", strconv.Itoa(opts.limit))
+		}
+		if opts.offset >= 0 {
+			query.Set("offset", strconv.Itoa(opts.offset))
+		}
+		if opts.sort != "" {
+			query.Set("sort", opts.sort)
+		}
+		raw, err := c.do(http.MethodGet, r.path, query, nil)
+		if err != nil {
+			return err
+		}
+		env, err := decodeEnvelope(raw)
+		if err != nil {
+			return err
+		}
+		if env.Total != nil && env.Count != nil && int64(*env.Count) < *env.Total {
+			fmt.Fprintf(os.Stderr, "Showing %d of %d %s; use --limit and --offset for more\n", *env.Count, *env.Total, r.name)
+		}
+		return writeItems(stdout, r, opts.output, env.Data, true)
+
+	case "get":
+		id, err := needID()
+		if err != nil {
+			return err
+		}
+		raw, err := c.do(http.MethodGet, r.path+"/"+id, query, nil)
+		if err != nil {
+			return err
+		}
+		return writeResult(stdout, r, opts.output, raw)
+
+	case "create", "update":
+		method, target := http.MethodPost, r.path
+		if verb == "update" {
+			id, err := needID()
+			if err != nil {
+				return err
+			}
+			method, target = http.MethodPut, r.path+"/"+id
+		} else if len(args) != 0 {
+			return fmt.Errorf("usage: pepesctl %s create [-f FILE] [--set KEY=VALUE]...", r.name)
+		}
+
+		body, err := requestBody(r, opts)
+		if err != nil {
+			return err
+		}
+		raw, err := c.do(method, target, query, body)
+		if err != nil {
+			return err
+		}
+		return writeResult(stdout, r, opts.output, raw)
+
+	case "delete", "rm":
+		id, err := needID()
+		if err != nil {
+			return err
+		}
+		raw, err := c.do(http.MethodDelete, r.path+"/"+id, query, nil)
+		if err != nil {
+			return err
+		}
+		env, err := decodeEnvelope(raw)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(stdout, env.Message)
+		return nil
+	}
+	return fmt.Errorf("unknown verb %q for %s, expected list, get, create, update or delete", verb, r.name)
+}
+
+// writeResult prints the entity of a get, create or update response and any warnings
+func writeResult(stdout io.Writer, r resource, format string, raw []byte) error {
+	env, err := decodeEnvelope(raw)
+	if err != nil {
+		return err
+	}
+
+	var warnings []struct {
+		Message string `json:"message"`
+	}
+	if len(env.Warnings) > 0 && json.Unmarshal(env.Warnings, &warnings) == nil {
+		for _, warning := range warnings {
+			fmt.Fprintln(os.Stderr, "Warning:", warning.Message)
+		}
+	}
+
+	return writeItems(stdout, r, format, env.Data, false)
+}
+
+// writeItems prints data, a list or a single entity, in the requested format
+func writeItems(stdout io.Writer, r resource, format string, data json.RawMessage, list bool) error {
+	if format != outputTable {
+		return writeRaw(stdout, format, data)
+	}
+
+	var items []map[string]interface{}
+	if list {
+		if err := decodeJSON(data, &items); err != nil {
+			return err
+		}
+	} else {
+		var item map[string]interface{}
+		if err := decodeJSON(data, &item); err != nil {
+			return err
+		}
+		items = append(items, item)
+	}
+	return writeTable(stdout, r.columns, items)
+}
+
+// queryParams collects the --param flags
+func queryParams(opts options) (url.Values, error) {
+	query := url.Values{}
+	for _, param := range opts.params {
+		key, value, ok := strings.Cut(param, "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("invalid --param %q, expected KEY=VALUE", param)
+		}
+		query.Add(key, value)
+	}
+	return query, nil
+}
+
+// requestBody builds a JSON request body from the -f file and the --set overrides
+func requestBody(r resource, opts options) ([]byte, error) {
+	body := map[string]interface{}{}
+
+	if opts.file != "" {
+		var raw []byte
+		var err error
+		if opts.file == "-" {
+			raw, err = io.ReadAll(os.Stdin)
+		} else {
+			raw, err = os.ReadFile(opts.file)
+		}
+		if err != nil {
+			return nil, err
+		}
+		// YAML is a superset of JSON, so one decoder reads both
+		var decoded interface{}
+		if err := yaml.Unmarshal(raw, &decoded); err != nil {
+			return nil, fmt.Errorf("%s: %v", opts.file, err)
+		}
+		if decoded != nil {
+			object, ok := decoded.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("%s: expected an object", opts.file)
+			}
+			body = object
+		}
+	}
+
+	for _, set := range opts.sets {
+		key, value, ok := strings.Cut(set, "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("invalid --set %q, expected KEY=VALUE", set)
+		}
+		if err := setPath(body, key, parseSetValue(value)); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(body) == 0 {
+		return nil, fmt.Errorf("nothing to send, use -f FILE or --set KEY=VALUE")
+	}
+
+	// The API stores these as JSON strings
+	for _, field := range r.configFields {
+		if value, ok := body[field]; ok && value != nil {
+			if _, isString := value.(string); !isString {
+				encoded, err := json.Marshal(value)
+				if err != nil {
+					return nil, fmt.Errorf("%s: %v", field, err)
+				}
+				body[field] = string(encoded)
+			}
+		}
+	}
+
+	return json.Marshal(body)
+}
+
+// parseSetValue reads a --set value as JSON, falling back to a plain string
+func parseSetValue(value string) interface{} {
+	var parsed interface{}
+	if err := json.Unmarshal([]byte(value), &parsed); err == nil {
+		return parsed
+	}
+	return value
+}
+
+// setPath sets a dotted key such as "health_check.active.enabled", creating objects on the way
+func setPath(body map[string]interface{}, key string, value interface{}) error {
+	parts := strings.Split(key, ".")
+	object := body
+	for _, part := range parts[:len(parts)-1] {
+		next, ok := object[part].(map[string]interface{})
+		if !ok {
+			if object[part] != nil {
+				return fmt.Errorf("cannot set %s: %s is not an object", key, part)
+			}
+			next = map[string]interface{}{}
+			object[part] = next
+		}
+		object = next
+	}
+	object[parts[len(parts)-1]] = value
+	return nil
+}
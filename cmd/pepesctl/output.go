@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Output formats
+const (
+	outputTable = "table"
+	outputJSON  = "json"
+	outputYAML  = "yaml"
+)
+
+// column is one column of a table: a header and how to render it from an item
+type column struct {
+	header string
+	value  func(item map[string]interface{}) string
+}
+
+// fieldColumn renders the value at a dotted path of the item
+func fieldColumn(header, path string) column {
+	return column{header: header, value: func(item map[string]interface{}) string {
+		return formatValue(lookup(item, path))
+	}}
+}
+
+// lookup returns the value at a dotted path such as "domain.name"
+func lookup(item map[string]interface{}, path string) interface{} {
+	var value interface{} = item
+	for _, key := range strings.Split(path, ".") {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		value = object[key]
+	}
+	return value
+}
+
+// formatValue renders a scalar for a table cell; objects and arrays are shown as JSON
+func formatValue(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case bool:
+		if v {
+			return "yes"
+		}
+		return "no"
+	default:
+		encoded, _ := json.Marshal(v)
+		return string(encoded)
+	}
+}
+
+// decodeJSON decodes raw JSON keeping numbers exact
+func decodeJSON(raw []byte, dest interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+	return decoder.Decode(dest)
+}
+
+// writeTable renders items as an aligned table
+func writeTable(w io.Writer, columns []column, items []map[string]interface{}) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 3, ' ', 0)
+	headers := make([]string, len(columns))
+	for i, col := range columns {
+		headers[i] = col.header
+	}
+	fmt.Fprintln(tw, strings.Join(headers, "\t"))
+	for _, item := range items {
+		cells := make([]string, len(columns))
+		for i, col := range columns {
+			// Keep every row on one line
+			cells[i] = strings.ReplaceAll(col.value(item), "\n", " ")
+		}
+		fmt.Fprintln(tw, strings.Join(cells, "\t"))
+	}
+	return tw.Flush()
+}
+
+// writeRaw renders raw JSON in the JSON or YAML output format
+func writeRaw(w io.Writer, format string, raw []byte) error {
+	if format == outputYAML {
+		return writeYAML(w, raw)
+	}
+	var indented bytes.Buffer
+	if err := json.Indent(&indented, raw, "", "  "); err != nil {
+		return err
+	}
+	indented.WriteByte('\n')
+	_, err := w.Write(indented.Bytes())
+	return err
+}
+
+// writeYAML converts JSON to block style YAML, keeping field order and number formatting
+func writeYAML(w io.Writer, raw []byte) error {
+	var node yaml.Node
+	if err := yaml.Unmarshal(raw, &node); err != nil {
+		return err
+	}
+	clearYAMLStyle(&node)
+
+	encoder := yaml.NewEncoder(w)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(&node); err != nil {
+		return err
+	}
+	return encoder.Close()
+}
+
+func clearYAMLStyle(node *yaml.Node) {
+	node.Style = 0
+	for _, child := range node.Content {
+		clearYAMLStyle(child)
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"strings"
+)
+
+// resource describes a REST collection of the management API
+type resource struct {
+	name    string
+	path    string
+	columns []column
+
+	// configFields hold JSON documents stored as strings; files may give them as objects
+	configFields []string
+}
+
+var resources = []resource{
+	{
+		name: "domains",
+		path: "/domains",
+		columns: []column{
+			fieldColumn("ID", "id"),
+			fieldColumn("NAME", "name"),
+			fieldColumn("STATUS", "status"),
+			fieldColumn("AUTO TLS", "auto_tls"),
+			fieldColumn("USER", "user_id"),
+			countColumn("ROUTES", "routes"),
+			fieldColumn("CREATED", "created_at"),
+		},
+	},
+	{
+		name: "routes",
+		path: "/routes",
+		columns: []column{
+			fieldColumn("ID", "id"),
+			fieldColumn("DOMAIN", "domain.name"),
+			fieldColumn("PATH", "path"),
+			fieldColumn("PREFIX", "usePathAsPrefix"),
+			fieldColumn("UPSTREAM", "upstream"),
+			fieldColumn("BALANCING", "load_balancing"),
+			{header: "PLUGINS", value: routePluginNames},
+		},
+	},
+	{
+		name: "plugins",
+		path: "/plugins",
+		columns: []column{
+			fieldColumn("ID", "id"),
+			fieldColumn("NAME", "name_plugin"),
+			fieldColumn("SERVICE", "plugin_svc_name"),
+			fieldColumn("USER", "user_id"),
+			fieldColumn("DESC", "desc"),
+		},
+		configFields: []string{"envs"},
+	},
+	{
+		name: "plugin-services",
+		path: "/plugin-services",
+		columns: []column{
+			fieldColumn("ID", "id"),
+			fieldColumn("NAME", "name"),
+			{header: "SCHEMA", value: func(item map[string]interface{}) string {
+				return formatValue(formatValue(item["schema"]) != "")
+			}},
+			fieldColumn("UPDATED", "updated_at"),
+		},
+		configFields: []string{"baseconfig", "schema"},
+	},
+}
+
+// findResource returns the resource with the given name, accepting singular names too
+func findResource(name string) (resource, bool) {
+	for _, r := range resources {
+		if name == r.name || name == strings.TrimSuffix(r.name, "s") {
+			return r, true
+		}
+	}
+	return resource{}, false
+}
+
+// countColumn renders the length of an array field
+func countColumn(header, path string) column {
+	return column{header: header, value: func(item map[string]interface{}) string {
+		items, _ := lookup(item, path).([]interface{})
+		return formatValue(len(items))
+	}}
+}
+
+// routePluginNames lists the plugins attached to a route in execution order
+func routePluginNames(item map[string]interface{}) string {
+	attachments, _ := item["plugins"].([]interface{})
+	names := make([]string, 0, len(attachments))
+	for _, attachment := range attachments {
+		if object, ok := attachment.(map[string]interface{}); ok {
+			names = append(names, formatValue(lookup(object, "plugin.name_plugin")))
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+// configColumns are the columns of `config get`, one row per route
+var configColumns = []column{
+	fieldColumn("DOMAIN", "domain"),
+	fieldColumn("PATH", "path"),
+	fieldColumn("PREFIX", "usePathAsPrefix"),
+	fieldColumn("UPSTREAM", "upstream"),
+	fieldColumn("BALANCING", "load_balancing"),
+	{header: "PLUGINS", value: func(item map[string]interface{}) string {
+		plugins, _ := item["plugins_data"].([]interface{})
+		names := make([]string, 0, len(plugins))
+		for _, plugin := range plugins {
+			if object, ok := plugin.(map[string]interface{}); ok {
+				names = append(names, formatValue(object["name_plugin"]))
+			}
+		}
+		return strings.Join(names, ",")
+	}},
+}
+
+// configRows flattens a /config response into one row per route, in host match order
+func configRows(config map[string]interface{}) []map[string]interface{} {
+	domains, _ := config["domains"].(map[string]interface{})
+	order, _ := config["match_order"].([]interface{})
+
+	var rows []map[string]interface{}
+	for _, name := range order {
+		domain, _ := domains[formatValue(name)].(map[string]interface{})
+		routes, _ := domain["routes"].([]interface{})
+		if len(routes) == 0 {
+			rows = append(rows, map[string]interface{}{"domain": name})
+			continue
+		}
+		for _, route := range routes {
+			if row, ok := route.(map[string]interface{}); ok {
+				row["domain"] = name
+				rows = append(rows, row)
+			}
+		}
+	}
+	return rows
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"gopkg.in/yaml.v3"
+)
+
+// defaultServer is the API address used when neither the config file nor the environment set one
+const defaultServer = "http://localhost:8081"
+
+// settings are the connection settings stored in the config file
+type settings struct {
+	Server string `yaml:"server"`
+	Token  string `yaml:"token"`
+}
+
+// settingsPath returns the config file location: PEPESCTL_CONFIG, or pepesctl/config.yaml
+// in the user config directory
+func settingsPath() (string, error) {
+	if path := os.Getenv("PEPESCTL_CONFIG"); path != "" {
+		return path, nil
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "pepesctl", "config.yaml"), nil
+}
+
+// loadSettings reads the config file at path; a missing file yields empty settings
+func loadSettings(path string) (settings, error) {
+	var s settings
+	raw, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return s, err
+	}
+	if err := yaml.Unmarshal(raw, &s); err != nil {
+		return s, fmt.Errorf("%s: %v", path, err)
+	}
+	return s, nil
+}
+
+// saveSettings writes the config file, readable only by its owner since it holds the token
+func saveSettings(path string, s settings) error {
+	raw, err := yaml.Marshal(s)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	return os.WriteFile(path, raw, 0o600)
+}
+
+// resolveSettings layers the environment (PEPES_SERVER, PEPES_TOKEN) and then the command
+// line flags over the config file
+func resolveSettings(file settings, server, token string) settings {
+	resolved := file
+	if value := os.Getenv("PEPES_SERVER"); value != "" {
+		resolved.Server = value
+	}
+	if value := os.Getenv("PEPES_TOKEN"); value != "" {
+		resolved.Token = value
+	}
+	if server != "" {
+		resolved.Server = server
+	}
+	if token != "" {
+		resolved.Token = token
+	}
+	if resolved.Server == "" {
+		resolved.Server = defaultServer
+	}
+	return resolved
+}
+
+// maskToken hides all but the start of a token for display
+func maskToken(token string) string {
+	if len(token) <= 8 {
+		return "********"
+	}
+	return token[:8] + "********"
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"log"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// buildConfig assembles the gateway configuration from the database using a
+// constant number of queries regardless of how many routes there are.
+// Only verified domains are included, and when userId is not empty only that user's
+// domains and plugins. Secret plugin envs are decrypted when reveal is set and redacted otherwise;
+// routes using a secret that cannot be decrypted are left out.
+// Each plugin carries its effective config: service defaults merged with plugin and route envs.
+func buildConfig(userId string, reveal bool) (ConfigResponse, error) {
+	domainQuery := DB.Model(&Domain{}).Where("status = ?", DomainStatusVerified)
+	pluginQuery := DB.Model(&Plugin{})
+	if userId != "" {
+		domainQuery = domainQuery.Where("user_id = ?", userId)
+		pluginQuery = pluginQuery.Where("user_id = ?", userId)
+	}
+	routeQuery := DB.Model(&Route{}).Where("domain_id IN (?)", domainQuery.Session(&gorm.Session{}).Select("id"))
+	routePluginQuery := DB.Model(&RoutePlugin{}).Where("route_id IN (?)", routeQuery.Session(&gorm.Session{}).Select("id"))
+	routeUpstreamQuery := DB.Model(&RouteUpstream{}).Where("route_id IN (?)", routeQuery.Session(&gorm.Session{}).Select("id"))
+	healthCheckQuery := DB.Model(&RouteHealthCheck{}).Where("route_id IN (?)", routeQuery.Session(&gorm.Session{}).Select("id"))
+	certificateQuery := DB.Model(&Certificate{}).Where("domain_id IN (?)", domainQuery.Session(&gorm.Session{}).Select("id"))
+
+	var domains []Domain
+	if err := domainQuery.Order("id").Find(&domains).Error; err != nil {
+		return ConfigResponse{}, err
+	}
+
+	var routes []Route
+	if err := routeQuery.Order("domain_id, id").Find(&routes).Error; err != nil {
+		return ConfigResponse{}, err
+	}
+
+	var routePlugins []RoutePlugin
+	if err := routePluginQuery.Order("route_id, position").Find(&routePlugins).Error; err != nil {
+		return ConfigResponse{}, err
+	}
+
+	var routeUpstreams []RouteUpstream
+	if err := routeUpstreamQuery.Order("route_id, position").Find(&routeUpstreams).Error; err != nil {
+		return ConfigResponse{}, err
+	}
+
+	var healthChecks []RouteHealthCheck
+	if err := healthCheckQuery.Find(&healthChecks).Error; err != nil {
+		return ConfigResponse{}, err
+	}
+
+	// Expired certificates are left out so the gateway falls back to its default
+	var certificates []Certificate
+	if err := certificateQuery.Omit("certificate", "private_key").Where("not_after > ?", time.Now()).Find(&certificates).Error; err != nil {
+		return ConfigResponse{}, err
+	}
+
+	var plugins []Plugin
+	if err := pluginQuery.Order("id").Find(&plugins).Error; err != nil {
+		return ConfigResponse{}, err
+	}
+
+	var pluginServices []PluginService
+	if err := DB.Where("name IN (?)", pluginQuery.Session(&gorm.Session{}).Select("plugin_svc_name")).Find(&pluginServices).Error; err != nil {
+		return ConfigResponse{}, err
+	}
+
+	if reveal {
+		if broken := revealSecretView(routePlugins, plugins, pluginServices); len(broken) > 0 {
+			kept := routes[:0]
+			for _, route := range routes {
+				if !broken[route.ID] {
+					kept = append(kept, route)
+				}
+			}
+			routes = kept
+		}
+	} else {
+		redactSecretView(routePlugins, plugins, pluginServices)
+	}
+
+	config := assembleConfig(domains, routes, routePlugins, routeUpstreams, healthChecks, plugins, pluginServices)
+	attachCertificates(config, domains, certificates)
+	return config, nil
+}
+
+// assembleConfig converts already loaded domains, routes, route plugin attachments,
+// route upstreams, health checks, plugins and plugin services into a ConfigResponse
+func assembleConfig(domains []Domain, routes []Route, routePlugins []RoutePlugin, routeUpstreams []RouteUpstream, healthChecks []RouteHealthCheck, plugins []Plugin, pluginServices []PluginService) ConfigResponse {
+	index := newPluginIndex(plugins, pluginServices)
+
+	attachments := make(map[uint][]RoutePlugin, len(routes))
+	for _, routePlugin := range routePlugins {
+		attachments[routePlugin.RouteID] = append(attachments[routePlugin.RouteID], routePlugin)
+	}
+
+	targets := make(map[uint][]UpstreamConfig, len(routes))
+	for _, upstream := range routeUpstreams {
+		targets[upstream.RouteID] = append(targets[upstream.RouteID], UpstreamConfig{
+			Target: upstream.Target,
+			Weight: upstream.Weight,
+		})
+	}
+
+	checks := make(map[uint]*HealthCheckConfig, len(healthChecks))
+	for _, check := range healthChecks {
+		checks[check.RouteID] = newHealthCheckConfig(check)
+	}
+
+	routesByDomain := make(map[uint][]Route, len(domains))
+	for _, route := range routes {
+		// Skip soft-deleted routes
+		if route.DeletedAt.Valid {
+			continue
+		}
+		routesByDomain[route.DomainID] = append(routesByDomain[route.DomainID], route)
+	}
+
+	// Convert to the expected format
+	config := ConfigResponse{
+		Domains: make(map[string]DomainConfig, len(domains)),
+	}
+	names := make([]string, 0, len(domains))
+
+	for _, domain := range domains {
+		var validRoutes []RouteConfig
+		for _, route := range routesByDomain[domain.ID] {
+			pluginsData := index.match(attachments[route.ID])
+
+			names := make([]string, 0, len(pluginsData))
+			for _, plugin := range pluginsData {
+				names = append(names, plugin.NamePlugin)
+			}
+
+			upstreams := targets[route.ID]
+			if len(upstreams) == 0 {
+				upstreams = []UpstreamConfig{{Target: route.Upstream, Weight: defaultUpstreamWeight}}
+			}
+
+			routeConfig := RouteConfig{
+				Path:            route.Path,
+				Upstream:        route.Upstream,
+				Plugin:          strings.Join(names, ","),
+				UsePathAsPrefix: route.UsePathAsPrefix,
+				PluginsData:     pluginsData,
+				Upstreams:       upstreams,
+				LoadBalancing:   route.LoadBalancing,
+				HashHeader:      route.HashHeader,
+				HealthCheck:     checks[route.ID],
+			}
+			validRoutes = append(validRoutes, routeConfig)
+		}
+
+		config.Domains[domain.Name] = DomainConfig{
+			Routes:   validRoutes,
+			Wildcard: isWildcardDomain(domain.Name),
+		}
+		names = append(names, domain.Name)
+	}
+	config.MatchOrder = domainMatchOrder(names)
+
+	return config
+}
+
+// redactSecretView replaces the secret envs of loaded plugins and attachments and the
+// secret base config of plugin services with the placeholder
+func redactSecretView(routePlugins []RoutePlugin, plugins []Plugin, pluginServices []PluginService) {
+	serviceFields := make(map[string]secretFields, len(pluginServices))
+	for i := range pluginServices {
+		serviceFields[pluginServices[i].Name] = pluginServiceSecretFields(pluginServices[i].Schema)
+		pluginServices[i].BaseConfig = redactSecrets(pluginServices[i].BaseConfig, serviceFields[pluginServices[i].Name])
+	}
+
+	pluginFields := make(map[uint]secretFields, len(plugins))
+	for i := range plugins {
+		fields, ok := serviceFields[plugins[i].PluginSvcName]
+		if !ok {
+			fields = allSecretFields
+		}
+		pluginFields[plugins[i].ID] = fields
+		plugins[i].Envs = redactSecrets(plugins[i].Envs, fields)
+	}
+	for i := range routePlugins {
+		fields, ok := pluginFields[routePlugins[i].PluginID]
+		if !ok {
+			fields = allSecretFields
+		}
+		routePlugins[i].Envs = redactSecrets(routePlugins[i].Envs, fields)
+	}
+}
+
+// revealSecretView decrypts the secret envs of loaded plugins and attachments and the secret
+// base config of plugin services. A value that cannot be decrypted is logged and the IDs of
+// the routes depending on it are returned, so they can be left out of the config instead of
+// failing it as a whole or serving them without their plugin.
+func revealSecretView(routePlugins []RoutePlugin, plugins []Plugin, pluginServices []PluginService) map[uint]bool {
+	brokenServices := make(map[string]bool)
+	for i := range pluginServices {
+		baseConfig, err := revealSecrets(pluginServices[i].BaseConfig)
+		if err != nil {
+			log.Printf("Cannot decrypt base config of plugin service %s: %v", pluginServices[i].Name, err)
+			brokenServices[pluginServices[i].Name] = true
+			continue
+		}
+		pluginServices[i].BaseConfig = baseConfig
+	}
+
+	brokenPlugins := make(map[uint]bool)
+	for i := range plugins {
+		envs, err := revealSecrets(plugins[i].Envs)
+		if err != nil {
+			log.Printf("Cannot decrypt envs of plugin %d: %v", plugins[i].ID, err)
+		}
+		if err != nil || brokenServices[plugins[i].PluginSvcName] {
+			brokenPlugins[plugins[i].ID] = true
+			continue
+		}
+		plugins[i].Envs = envs
+	}
+
+	brokenRoutes := make(map[uint]bool)
+	for i := range routePlugins {
+		envs, err := revealSecrets(routePlugins[i].Envs)
+		if err != nil {
+			log.Printf("Cannot decrypt envs of plugin %d on route %d: %v", routePlugins[i].PluginID, routePlugins[i].RouteID, err)
+		}
+		if err != nil || brokenPlugins[routePlugins[i].PluginID] {
+			if !brokenRoutes[routePlugins[i].RouteID] {
+				log.Printf("Leaving route %d out of the config because a plugin secret cannot be decrypted", routePlugins[i].RouteID)
+			}
+			brokenRoutes[routePlugins[i].RouteID] = true
+			continue
+		}
+		routePlugins[i].Envs = envs
+	}
+	return brokenRoutes
+}
+
+// attachCertificates adds the certificate reference of each domain to the config
+func attachCertificates(config ConfigResponse, domains []Domain, certificates []Certificate) {
+	byDomain := make(map[uint]Certificate, len(certificates))
+	for _, cert := range certificates {
+		byDomain[cert.DomainID] = cert
+	}
+
+	for _, domain := range domains {
+		cert, ok := byDomain[domain.ID]
+		if !ok {
+			continue
+		}
+		domainConfig := config.Domains[domain.Name]
+		domainConfig.Certificate = &CertificateRef{
+			ID:          cert.ID,
+			Fingerprint: cert.Fingerprint,
+			NotAfter:    cert.NotAfter,
+		}
+		config.Domains[domain.Name] = domainConfig
+	}
+}
+
+// pluginIndex holds plugins converted to PluginData, indexed by ID
+type pluginIndex struct {
+	byID map[uint]PluginData
+}
+
+// newPluginIndex converts the given plugins once so they can be shared by every route,
+// merging the base config of each plugin's service with its envs
+func newPluginIndex(plugins []Plugin, pluginServices []PluginService) *pluginIndex {
+	baseConfigs := make(map[string]map[string]interface{}, len(pluginServices))
+	for _, pluginService := range pluginServices {
+		baseConfigs[pluginService.Name] = configLayer(pluginService.BaseConfig)
+	}
+
+	index := &pluginIndex{byID: make(map[uint]PluginData, len(plugins))}
+	for _, plugin := range plugins {
+		// Skip soft-deleted plugins
+		if plugin.DeletedAt.Valid {
+			continue
+		}
+		data := newPluginData(plugin)
+		data.Config = mergeConfig(baseConfigs[plugin.PluginSvcName], configLayer(plugin.Envs))
+		index.byID[plugin.ID] = data
+	}
+	return index
+}
+
+// match returns the plugins attached to a route in position order, with the
+// per-route envs of each attachment merged into their effective config
+func (idx *pluginIndex) match(routePlugins []RoutePlugin) []PluginData {
+	var matched []PluginData
+	for _, routePlugin := range routePlugins {
+		plugin, ok := idx.byID[routePlugin.PluginID]
+		if !ok {
+			continue
+		}
+		plugin.RouteEnvs = routePlugin.Envs
+		if routePlugin.Envs != "" {
+			plugin.Config = mergeConfig(plugin.Config, configLayer(routePlugin.Envs))
+		}
+		matched = append(matched, plugin)
+	}
+	return matched
+}
+
+// parsePluginNames splits a comma-delimited list of plugin names into an ordered
+// list of unique names
+func parsePluginNames(routePlugin string) []string {
+	var names []string
+	seen := make(map[string]bool)
+	for _, name := range strings.Split(routePlugin, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" || seen[name] {
+			continue
+		}
+		seen[name] = true
+		names = append(names, name)
+	}
+	return names
+}
+
+// newPluginData converts a Plugin to the PluginData emitted in the config
+func newPluginData(plugin Plugin) PluginData {
+	var deletedAt *string
+	if plugin.DeletedAt.Valid {
+		deletedAtStr := plugin.DeletedAt.Time.Format(time.RFC3339)
+		deletedAt = &deletedAtStr
+	}
+
+	return PluginData{
+		ID:            int(plugin.ID),
+		NamePlugin:    plugin.NamePlugin,
+		PluginSvcName: plugin.PluginSvcName,
+		Envs:          plugin.Envs,
+		Desc:          plugin.Desc,
+		CreatedAt:     plugin.CreatedAt.Format(time.RFC3339),
+		UpdatedAt:     plugin.UpdatedAt.Format(time.RFC3339),
+		DeletedAt:     deletedAt,
+	}
+}
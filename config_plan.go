@@ -0,0 +1,173 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// errDryRun rolls back the transaction of a plan once its steps have been checked
+var errDryRun = errors.New("dry run")
+
+// ConfigChangeCounts counts the planned changes of one entity type
+type ConfigChangeCounts struct {
+	Create int `json:"create"`
+	Update int `json:"update"`
+	Delete int `json:"delete"`
+}
+
+// planMismatchError aborts an apply whose changes differ from the plan that was reviewed
+type planMismatchError struct {
+	fingerprint string
+}
+
+func (e *planMismatchError) Error() string {
+	return "Configuration changed since the plan was made"
+}
+
+// summarizeChanges counts the changes of a plan per entity type
+func summarizeChanges(changes []ConfigChange) map[string]ConfigChangeCounts {
+	summary := map[string]ConfigChangeCounts{
+		ConfigEntityPluginService: {},
+		ConfigEntityPlugin:        {},
+		ConfigEntityDomain:        {},
+		ConfigEntityRoute:         {},
+	}
+	for _, change := range changes {
+		counts := summary[change.Entity]
+		switch change.Action {
+		case ConfigChangeCreate:
+			counts.Create++
+		case ConfigChangeUpdate:
+			counts.Update++
+		case ConfigChangeDelete:
+			counts.Delete++
+		}
+		summary[change.Entity] = counts
+	}
+	return summary
+}
+
+// fingerprint identifies the changes of a plan, so an apply can make sure it performs
+// exactly the changes that were reviewed
+func (p *configPlan) fingerprint() string {
+	encoded, _ := json.Marshal(p.changes)
+	sum := sha256.Sum256(encoded)
+	return hex.EncodeToString(sum[:])
+}
+
+// planResponse builds the body describing a plan and, once applied, what it changed
+func planResponse(plan *configPlan) gin.H {
+	response := gin.H{
+		"data":    plan.changes,
+		"count":   len(plan.changes),
+		"summary": summarizeChanges(plan.changes),
+		"plan":    plan.fingerprint(),
+	}
+	if len(plan.warnings) > 0 {
+		response["warnings"] = plan.warnings
+	}
+	return response
+}
+
+// runConfigDocument reads a document from the request, plans it for the requested tenant
+// and runs the plan in a single transaction. With dryRun the transaction is rolled back, so
+// the plan is fully checked, route conflicts and database constraints included, without
+// writing anything. A non-empty expected fingerprint aborts the transaction when the plan
+// differs from it. Errors are written to the response and reported by returning false.
+func runConfigDocument(c *gin.Context, prune, dryRun bool, expected string) (*configPlan, bool) {
+	userId, ok := documentUserId(c)
+	if !ok {
+		return nil, false
+	}
+
+	doc, err := readConfigDocument(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return nil, false
+	}
+
+	var plan *configPlan
+	err = DB.Transaction(func(tx *gorm.DB) error {
+		var err error
+		if plan, err = planConfigDocument(tx, userId, doc, currentPrincipal(c), shadowPolicy(c), prune); err != nil {
+			return err
+		}
+		if expected != "" && plan.fingerprint() != expected {
+			return &planMismatchError{fingerprint: plan.fingerprint()}
+		}
+		if err := plan.apply(tx); err != nil {
+			return err
+		}
+		if dryRun {
+			return errDryRun
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, errDryRun) {
+		var mismatchErr *planMismatchError
+		if errors.As(err, &mismatchErr) {
+			c.JSON(http.StatusConflict, gin.H{"error": mismatchErr.Error(), "plan": mismatchErr.fingerprint})
+			return nil, false
+		}
+		respondDeclarativeError(c, err)
+		return nil, false
+	}
+	return plan, true
+}
+
+// parsePrune reads the prune query parameter
+func parsePrune(c *gin.Context) (bool, bool) {
+	value := c.Query("prune")
+	if value == "" {
+		return false, true
+	}
+	prune, err := strconv.ParseBool(value)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "prune must be true or false"})
+		return false, false
+	}
+	return prune, true
+}
+
+// PlanConfig returns the changes needed to bring the stored configuration to a declarative
+// document, per entity, without writing anything. The returned plan fingerprint can be
+// passed to ApplyConfig to make sure exactly these changes are applied.
+func PlanConfig(c *gin.Context) {
+	prune, ok := parsePrune(c)
+	if !ok {
+		return
+	}
+
+	plan, ok := runConfigDocument(c, prune, true, "")
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusOK, planResponse(plan))
+}
+
+// ApplyConfig executes the plan of a declarative document atomically. With prune=true the
+// caller's domains, routes and plugins missing from the document are deleted; with plan=
+// the apply is rejected if the changes no longer match that plan.
+func ApplyConfig(c *gin.Context) {
+	prune, ok := parsePrune(c)
+	if !ok {
+		return
+	}
+
+	plan, ok := runConfigDocument(c, prune, false, c.Query("plan"))
+	if !ok {
+		return
+	}
+
+	plan.publish()
+
+	c.JSON(http.StatusOK, planResponse(plan))
+}
@@ -0,0 +1,544 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// supportedSchemaKeywords is the subset of JSON Schema understood by configSchema.
+// Schemas using anything else are rejected rather than silently half-enforced.
+var supportedSchemaKeywords = map[string]bool{
+	"$schema": true, "title": true, "description": true, "default": true, "examples": true,
+	"type": true, "properties": true, "required": true, "additionalProperties": true,
+	"items": true, "enum": true, "minimum": true, "maximum": true, "minLength": true,
+	"maxLength": true, "pattern": true, "minItems": true, "maxItems": true, "writeOnly": true,
+}
+
+// configSchema is a JSON Schema describing a plugin service config
+type configSchema struct {
+	Type                 schemaTypes              `json:"type"`
+	Properties           map[string]*configSchema `json:"properties"`
+	Required             []string                 `json:"required"`
+	AdditionalProperties *bool                    `json:"additionalProperties"`
+	Items                *configSchema            `json:"items"`
+	Enum                 []interface{}            `json:"enum"`
+	Minimum              *float64                 `json:"minimum"`
+	Maximum              *float64                 `json:"maximum"`
+	MinLength            *int                     `json:"minLength"`
+	MaxLength            *int                     `json:"maxLength"`
+	Pattern              string                   `json:"pattern"`
+	MinItems             *int                     `json:"minItems"`
+	MaxItems             *int                     `json:"maxItems"`
+	Default              interface{}              `json:"default"`
+	WriteOnly            bool                     `json:"writeOnly"`
+
+	pattern *regexp.Regexp
+}
+
+// schemaTypes holds the "type" keyword, which may be a single type or a list
+type schemaTypes []string
+
+func (t *schemaTypes) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*t = schemaTypes{single}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return fmt.Errorf("type must be a string or a list of strings")
+	}
+	*t = list
+	return nil
+}
+
+// ConfigFieldError describes a config value that does not match its schema
+type ConfigFieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// parseConfigSchema parses and checks a schema; an empty schema returns nil
+func parseConfigSchema(raw string) (*configSchema, error) {
+	if strings.TrimSpace(raw) == "" {
+		return nil, nil
+	}
+
+	var keywords interface{}
+	if err := json.Unmarshal([]byte(raw), &keywords); err != nil {
+		return nil, fmt.Errorf("schema is not valid JSON: %v", err)
+	}
+	if err := checkSchemaKeywords(keywords, "schema"); err != nil {
+		return nil, err
+	}
+
+	var schema configSchema
+	if err := json.Unmarshal([]byte(raw), &schema); err != nil {
+		return nil, fmt.Errorf("schema is not valid: %v", err)
+	}
+	if err := schema.compile("schema"); err != nil {
+		return nil, err
+	}
+	return &schema, nil
+}
+
+// checkSchemaKeywords rejects keywords configSchema does not support
+func checkSchemaKeywords(raw interface{}, path string) error {
+	object, ok := raw.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("%s must be an object", path)
+	}
+
+	for keyword, value := range object {
+		if !supportedSchemaKeywords[keyword] {
+			return fmt.Errorf("%s uses unsupported keyword %q", path, keyword)
+		}
+		switch keyword {
+		case "properties":
+			properties, ok := value.(map[string]interface{})
+			if !ok {
+				return fmt.Errorf("%s.properties must be an object", path)
+			}
+			for name, property := range properties {
+				if err := checkSchemaKeywords(property, path+".properties."+name); err != nil {
+					return err
+				}
+			}
+		case "items":
+			if err := checkSchemaKeywords(value, path+".items"); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// compile checks type names and compiles patterns
+func (s *configSchema) compile(path string) error {
+	for _, name := range s.Type {
+		switch name {
+		case "string", "number", "integer", "boolean", "object", "array", "null":
+		default:
+			return fmt.Errorf("%s has unknown type %q", path, name)
+		}
+	}
+	if s.Pattern != "" {
+		pattern, err := regexp.Compile(s.Pattern)
+		if err != nil {
+			return fmt.Errorf("%s has an invalid pattern: %v", path, err)
+		}
+		s.pattern = pattern
+	}
+	for name, property := range s.Properties {
+		if err := property.compile(path + ".properties." + name); err != nil {
+			return err
+		}
+	}
+	if s.Items != nil {
+		return s.Items.compile(path + ".items")
+	}
+	return nil
+}
+
+// validateConfig checks a JSON object config against schema. With partial set, required
+// properties may be missing (for defaults and overrides). Values equal to the redaction
+// placeholder are skipped since they stand for an already validated stored secret.
+func validateConfig(schema *configSchema, config string, partial bool) []ConfigFieldError {
+	if schema == nil {
+		return nil
+	}
+	if strings.TrimSpace(config) == "" {
+		config = "{}"
+	}
+
+	fields, ok := parseConfigObject(config)
+	if !ok {
+		return []ConfigFieldError{{Field: "(root)", Message: "must be a JSON object"}}
+	}
+	return validateConfigFields(schema, fields, partial)
+}
+
+// validateConfigFields checks an already decoded config object against schema
+func validateConfigFields(schema *configSchema, fields map[string]interface{}, partial bool) []ConfigFieldError {
+	var errs []ConfigFieldError
+	schema.validate(fields, "", partial, &errs)
+	sort.Slice(errs, func(i, j int) bool { return errs[i].Field < errs[j].Field })
+	return errs
+}
+
+func (s *configSchema) validate(value interface{}, path string, partial bool, errs *[]ConfigFieldError) {
+	field := path
+	if field == "" {
+		field = "(root)"
+	}
+	fail := func(message string) {
+		*errs = append(*errs, ConfigFieldError{Field: field, Message: message})
+	}
+
+	if text, ok := value.(string); ok && text == redactedSecret {
+		return
+	}
+
+	if len(s.Type) > 0 && !matchesSchemaType(value, s.Type) {
+		fail("must be of type " + strings.Join(s.Type, " or "))
+		return
+	}
+
+	if len(s.Enum) > 0 && !matchesEnum(value, s.Enum) {
+		allowed := make([]string, 0, len(s.Enum))
+		for _, option := range s.Enum {
+			encoded, _ := json.Marshal(option)
+			allowed = append(allowed, string(encoded))
+		}
+		fail("must be one of: " + strings.Join(allowed, ", "))
+	}
+
+	switch typed := value.(type) {
+	case string:
+		length := len([]rune(typed))
+		if s.MinLength != nil && length < *s.MinLength {
+			fail(fmt.Sprintf("must be at least %d characters", *s.MinLength))
+		}
+		if s.MaxLength != nil && length > *s.MaxLength {
+			fail(fmt.Sprintf("must be at most %d characters", *s.MaxLength))
+		}
+		if s.pattern != nil && !s.pattern.MatchString(typed) {
+			fail("must match pattern " + s.Pattern)
+		}
+
+	case json.Number:
+		number, _ := typed.Float64()
+		if s.Minimum != nil && number < *s.Minimum {
+			fail("must be at least " + strconv.FormatFloat(*s.Minimum, 'f', -1, 64))
+		}
+		if s.Maximum != nil && number > *s.Maximum {
+			fail("must be at most " + strconv.FormatFloat(*s.Maximum, 'f', -1, 64))
+		}
+
+	case []interface{}:
+		if s.MinItems != nil && len(typed) < *s.MinItems {
+			fail(fmt.Sprintf("must have at least %d items", *s.MinItems))
+		}
+		if s.MaxItems != nil && len(typed) > *s.MaxItems {
+			fail(fmt.Sprintf("must have at most %d items", *s.MaxItems))
+		}
+		if s.Items != nil {
+			for i, item := range typed {
+				s.Items.validate(item, fmt.Sprintf("%s[%d]", path, i), partial, errs)
+			}
+		}
+
+	case map[string]interface{}:
+		if !partial {
+			for _, name := range s.Required {
+				if _, ok := typed[name]; !ok {
+					*errs = append(*errs, ConfigFieldError{Field: joinConfigPath(path, name), Message: "is required"})
+				}
+			}
+		}
+		for name, item := range typed {
+			property, ok := s.Properties[name]
+			if !ok {
+				if s.AdditionalProperties != nil && !*s.AdditionalProperties {
+					*errs = append(*errs, ConfigFieldError{Field: joinConfigPath(path, name), Message: "is not a known setting"})
+				}
+				continue
+			}
+			property.validate(item, joinConfigPath(path, name), partial, errs)
+		}
+	}
+}
+
+func joinConfigPath(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+// matchesSchemaType reports whether a decoded JSON value has one of the given types
+func matchesSchemaType(value interface{}, types []string) bool {
+	for _, name := range types {
+		switch typed := value.(type) {
+		case string:
+			if name == "string" {
+				return true
+			}
+		case json.Number:
+			if name == "number" {
+				return true
+			}
+			if name == "integer" {
+				if _, err := typed.Int64(); err == nil {
+					return true
+				}
+				if number, err := typed.Float64(); err == nil && number == float64(int64(number)) {
+					return true
+				}
+			}
+		case bool:
+			if name == "boolean" {
+				return true
+			}
+		case map[string]interface{}:
+			if name == "object" {
+				return true
+			}
+		case []interface{}:
+			if name == "array" {
+				return true
+			}
+		case nil:
+			if name == "null" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// matchesEnum compares a decoded value with enum options by their JSON encoding
+func matchesEnum(value interface{}, options []interface{}) bool {
+	encoded, _ := json.Marshal(value)
+	for _, option := range options {
+		candidate, _ := json.Marshal(option)
+		if string(candidate) == string(encoded) {
+			return true
+		}
+	}
+	return false
+}
+
+// configForValidation returns a stored config with secrets decrypted when possible,
+// or redacted (and so skipped by validation) otherwise
+func configForValidation(stored string) string {
+	if revealed, err := revealSecrets(stored); err == nil {
+		return revealed
+	}
+	return redactSecrets(stored, func(string) bool { return false })
+}
+
+// configValidationError lists the fields of a config that do not match its schema
+type configValidationError struct {
+	subject string
+	errs    []ConfigFieldError
+}
+
+func (e *configValidationError) Error() string {
+	messages := make([]string, 0, len(e.errs))
+	for _, fieldError := range e.errs {
+		messages = append(messages, fieldError.Field+" "+fieldError.Message)
+	}
+	return e.subject + " do not match the schema: " + strings.Join(messages, "; ")
+}
+
+// respondConfigValidationError writes a 400 response listing the fields that failed validation
+func respondConfigValidationError(c *gin.Context, err *configValidationError) {
+	c.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "details": err.errs})
+}
+
+// validatePluginEnvs checks envs, merged over the base config of the plugin service, against
+// the service's schema. Validating the effective config means settings the service provides
+// need not be repeated by the plugin, and null removes an inherited setting.
+// Mismatches are returned as a *configValidationError.
+func validatePluginEnvs(pluginService PluginService, envs string) error {
+	return validateLayeredEnvs(pluginService, envs, pluginService.BaseConfig)
+}
+
+// validateRoutePluginEnvs checks the per-route envs of an attachment, merged over the base
+// config of the plugin service and the stored envs of the plugin, against the service's schema
+func validateRoutePluginEnvs(pluginService PluginService, pluginEnvs, envs string) error {
+	return validateLayeredEnvs(pluginService, envs, pluginService.BaseConfig, pluginEnvs)
+}
+
+// validateLayeredEnvs checks envs, merged over stored config layers given lowest first,
+// against the schema of pluginService
+func validateLayeredEnvs(pluginService PluginService, envs string, layers ...string) error {
+	schema, err := parseConfigSchema(pluginService.Schema)
+	if err != nil {
+		return fmt.Errorf("plugin service %s has an invalid schema: %v", pluginService.Name, err)
+	}
+	if schema == nil {
+		return nil
+	}
+
+	if strings.TrimSpace(envs) == "" {
+		envs = "{}"
+	}
+	fields, ok := parseConfigObject(envs)
+	if !ok {
+		return &configValidationError{
+			subject: "Environment Variables",
+			errs:    []ConfigFieldError{{Field: "(root)", Message: "must be a JSON object"}},
+		}
+	}
+
+	effective := map[string]interface{}{}
+	for _, layer := range layers {
+		effective = mergeConfig(effective, configLayer(configForValidation(layer)))
+	}
+	effective = mergeConfig(effective, fields)
+	if errs := validateConfigFields(schema, effective, false); len(errs) > 0 {
+		return &configValidationError{subject: "Environment Variables", errs: errs}
+	}
+	return nil
+}
+
+// validatePluginServiceConfig parses a plugin service schema and checks its base config
+// against it, allowing required settings to be left to plugins. Mismatches are returned
+// as a *configValidationError.
+func validatePluginServiceConfig(rawSchema, baseConfig string) error {
+	schema, err := parseConfigSchema(rawSchema)
+	if err != nil {
+		return err
+	}
+
+	if errs := validateConfig(schema, baseConfig, true); len(errs) > 0 {
+		return &configValidationError{subject: "Base Configuration", errs: errs}
+	}
+	return nil
+}
+
+// revalidateServicePlugins checks the envs of every plugin using pluginService, and their
+// per-route envs, against the service's current schema and base config, so a service change
+// cannot invalidate configs that were accepted before. Envs whose fields the schema now
+// declares writeOnly are sealed again. Mismatches are returned as a *configValidationError
+// listing the failing plugins and attachments by ID.
+func revalidateServicePlugins(tx *gorm.DB, pluginService PluginService) error {
+	var plugins []Plugin
+	if err := tx.Where("plugin_svc_name = ?", pluginService.Name).Order("id").Find(&plugins).Error; err != nil {
+		return err
+	}
+	if len(plugins) == 0 {
+		return nil
+	}
+
+	secret := pluginServiceSecretFields(pluginService.Schema)
+	var errs []ConfigFieldError
+	byID := make(map[uint]Plugin, len(plugins))
+	pluginIDs := make([]uint, 0, len(plugins))
+	for _, plugin := range plugins {
+		byID[plugin.ID] = plugin
+		pluginIDs = append(pluginIDs, plugin.ID)
+		if err := validatePluginEnvs(pluginService, configForValidation(plugin.Envs)); err != nil {
+			if !appendNestedErrors(&errs, fmt.Sprintf("plugins[%d]", plugin.ID), err) {
+				return err
+			}
+			continue
+		}
+		sealed, err := sealSecrets(plugin.Envs, plugin.Envs, secret)
+		if err != nil {
+			return fmt.Errorf("plugin %d: %v", plugin.ID, err)
+		}
+		if sealed != plugin.Envs {
+			if err := tx.Model(&Plugin{}).Where("id = ?", plugin.ID).UpdateColumn("envs", sealed).Error; err != nil {
+				return err
+			}
+		}
+	}
+
+	var routePlugins []RoutePlugin
+	if err := tx.Where("plugin_id IN ?", pluginIDs).Order("route_id, plugin_id").Find(&routePlugins).Error; err != nil {
+		return err
+	}
+	for _, routePlugin := range routePlugins {
+		plugin := byID[routePlugin.PluginID]
+		if err := validateRoutePluginEnvs(pluginService, plugin.Envs, configForValidation(routePlugin.Envs)); err != nil {
+			if !appendNestedErrors(&errs, fmt.Sprintf("routes[%d].plugins[%d]", routePlugin.RouteID, plugin.ID), err) {
+				return err
+			}
+			continue
+		}
+		sealed, err := sealSecrets(routePlugin.Envs, routePlugin.Envs, secret)
+		if err != nil {
+			return fmt.Errorf("route plugin %d: %v", routePlugin.ID, err)
+		}
+		if sealed != routePlugin.Envs {
+			if err := tx.Model(&RoutePlugin{}).Where("id = ?", routePlugin.ID).UpdateColumn("envs", sealed).Error; err != nil {
+				return err
+			}
+		}
+	}
+
+	if len(errs) > 0 {
+		return &configValidationError{subject: "Plugins using plugin service " + pluginService.Name, errs: errs}
+	}
+	return nil
+}
+
+// appendNestedErrors adds the field errors of a *configValidationError to errs, prefixing
+// their fields. It reports false for any other error.
+func appendNestedErrors(errs *[]ConfigFieldError, prefix string, err error) bool {
+	validationErr, ok := err.(*configValidationError)
+	if !ok {
+		return false
+	}
+	for _, fieldErr := range validationErr.errs {
+		field := prefix
+		if fieldErr.Field != "(root)" {
+			field += "." + fieldErr.Field
+		}
+		*errs = append(*errs, ConfigFieldError{Field: field, Message: fieldErr.Message})
+	}
+	return true
+}
+
+// checkPluginEnvs verifies that the plugin service exists and that envs match its schema,
+// returning the service. It writes an error response and returns false otherwise.
+func checkPluginEnvs(c *gin.Context, pluginSvcName, envs string) (PluginService, bool) {
+	return checkServiceEnvs(c, pluginSvcName, func(pluginService PluginService) error {
+		return validatePluginEnvs(pluginService, envs)
+	})
+}
+
+// checkRoutePluginEnvs verifies that the per-route envs of plugin match the schema of its
+// service, returning the service. It writes an error response and returns false otherwise.
+func checkRoutePluginEnvs(c *gin.Context, plugin Plugin, envs string) (PluginService, bool) {
+	return checkServiceEnvs(c, plugin.PluginSvcName, func(pluginService PluginService) error {
+		return validateRoutePluginEnvs(pluginService, plugin.Envs, envs)
+	})
+}
+
+func checkServiceEnvs(c *gin.Context, pluginSvcName string, validate func(pluginService PluginService) error) (PluginService, bool) {
+	var pluginService PluginService
+	if err := DB.Where("name = ?", pluginSvcName).First(&pluginService).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Plugin service " + pluginSvcName + " does not exist"})
+			return PluginService{}, false
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": formatDatabaseError(err)})
+		return PluginService{}, false
+	}
+
+	if err := validate(pluginService); err != nil {
+		if validationErr, ok := err.(*configValidationError); ok {
+			respondConfigValidationError(c, validationErr)
+			return PluginService{}, false
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return PluginService{}, false
+	}
+	return pluginService, true
+}
+
+// checkPluginServiceConfig validates a plugin service schema and base config, writing an
+// error response and returning false when either is invalid
+func checkPluginServiceConfig(c *gin.Context, rawSchema, baseConfig string) bool {
+	if err := validatePluginServiceConfig(rawSchema, baseConfig); err != nil {
+		if validationErr, ok := err.(*configValidationError); ok {
+			respondConfigValidationError(c, validationErr)
+			return false
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return false
+	}
+	return true
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// configFixture builds the rows of domainCount domains with routesPerDomain routes each, every
+// route using the same three plugins of one service with per-route envs on the last one, two
+// weighted upstreams and, on every other route, a passive health check
+func configFixture(domainCount, routesPerDomain int) ([]Domain, []Route, []RoutePlugin, []RouteUpstream, []RouteHealthCheck, []Plugin, []PluginService) {
+	pluginServices := []PluginService{
+		{Name: "auth", BaseConfig: `{"realm":"api","timeout":5}`},
+	}
+	plugins := []Plugin{
+		{ID: 1, NamePlugin: "basic-auth", PluginSvcName: "auth", Envs: `{"timeout":10}`},
+		{ID: 2, NamePlugin: "rate-limit", PluginSvcName: "auth"},
+		{ID: 3, NamePlugin: "cors", PluginSvcName: "auth", Envs: `{"realm":"cors"}`},
+	}
+
+	var domains []Domain
+	var routes []Route
+	var routePlugins []RoutePlugin
+	var routeUpstreams []RouteUpstream
+	var healthChecks []RouteHealthCheck
+	for d := 1; d <= domainCount; d++ {
+		domains = append(domains, Domain{ID: uint(d), Name: fmt.Sprintf("app%d.example.com", d), Status: DomainStatusVerified})
+		for r := 0; r < routesPerDomain; r++ {
+			id := uint(len(routes) + 1)
+			routes = append(routes, Route{
+				ID:            id,
+				DomainID:      uint(d),
+				Path:          fmt.Sprintf("/service-%d", r),
+				Upstream:      fmt.Sprintf("http://backend-%d:8080", id),
+				LoadBalancing: LoadBalancingRoundRobin,
+			})
+			for position, plugin := range plugins {
+				routePlugin := RoutePlugin{RouteID: id, PluginID: plugin.ID, Position: position}
+				if position == len(plugins)-1 {
+					routePlugin.Envs = fmt.Sprintf(`{"route":%d}`, id)
+				}
+				routePlugins = append(routePlugins, routePlugin)
+			}
+			routeUpstreams = append(routeUpstreams,
+				RouteUpstream{RouteID: id, Target: fmt.Sprintf("http://backend-%d:8080", id), Weight: 3},
+				RouteUpstream{RouteID: id, Target: fmt.Sprintf("http://backup-%d:8080", id), Weight: 1},
+			)
+			if r%2 == 0 {
+				healthChecks = append(healthChecks, RouteHealthCheck{RouteID: id, Passive: PassiveHealthCheck{Enabled: true, UnhealthyThreshold: 3, EjectionSeconds: 30}})
+			}
+		}
+	}
+	return domains, routes, routePlugins, routeUpstreams, healthChecks, plugins, pluginServices
+}
+
+func TestAssembleConfig(t *testing.T) {
+	domains := []Domain{
+		{ID: 1, Name: "*.example.com"},
+		{ID: 2, Name: "api.example.com"},
+	}
+	routes := []Route{
+		{ID: 1, DomainID: 2, Path: "/users", Upstream: "http://users:8080", LoadBalancing: LoadBalancingRoundRobin},
+		{ID: 2, DomainID: 2, Path: "/old", Upstream: "http://old:8080", DeletedAt: gorm.DeletedAt{Valid: true}},
+		{ID: 3, DomainID: 1, Path: "/", Upstream: "http://web:8080", LoadBalancing: LoadBalancingRoundRobin},
+	}
+	plugins := []Plugin{
+		{ID: 1, NamePlugin: "jwt", PluginSvcName: "jwt-auth", Envs: `{"header":"X-Token"}`},
+		{ID: 2, NamePlugin: "log", PluginSvcName: "logger"},
+		{ID: 3, NamePlugin: "gone", PluginSvcName: "logger", DeletedAt: gorm.DeletedAt{Valid: true}},
+	}
+	pluginServices := []PluginService{
+		{Name: "jwt-auth", BaseConfig: `{"header":"Authorization","claims":{"iss":"pepes","aud":"api"}}`},
+		{Name: "logger", BaseConfig: `{"log_level":"info"}`},
+	}
+	routePlugins := []RoutePlugin{
+		{RouteID: 1, PluginID: 2, Position: 0},
+		{RouteID: 1, PluginID: 1, Position: 1, Envs: `{"claims":{"aud":"users"}}`},
+		{RouteID: 1, PluginID: 3, Position: 2},
+	}
+	routeUpstreams := []RouteUpstream{
+		{RouteID: 1, Target: "http://users-a:8080", Weight: 2},
+		{RouteID: 1, Target: "http://users-b:8080", Weight: 1},
+	}
+
+	config := assembleConfig(domains, routes, routePlugins, routeUpstreams, nil, plugins, pluginServices)
+
+	if got, want := fmt.Sprint(config.MatchOrder), "[api.example.com *.example.com]"; got != want {
+		t.Errorf("match order = %s, want %s", got, want)
+	}
+	if !config.Domains["*.example.com"].Wildcard || config.Domains["api.example.com"].Wildcard {
+		t.Errorf("wildcard flags = %+v", config.Domains)
+	}
+
+	api := config.Domains["api.example.com"].Routes
+	if len(api) != 1 {
+		t.Fatalf("api.example.com has %d routes, want 1 (soft-deleted routes are skipped)", len(api))
+	}
+	route := api[0]
+	if route.Plugin != "log,jwt" {
+		t.Errorf("plugin = %q, want attachments in position order without deleted plugins", route.Plugin)
+	}
+	if len(route.Upstreams) != 2 || route.Upstreams[0].Weight != 2 {
+		t.Errorf("upstreams = %+v", route.Upstreams)
+	}
+
+	jwt := route.PluginsData[1]
+	if jwt.Config["header"] != "X-Token" {
+		t.Errorf("plugin envs should override the base config, got header %v", jwt.Config["header"])
+	}
+	claims, _ := jwt.Config["claims"].(map[string]interface{})
+	if claims["iss"] != "pepes" || claims["aud"] != "users" {
+		t.Errorf("route envs should be deep merged, got claims %v", claims)
+	}
+	if route.PluginsData[0].Config["log_level"] != "info" {
+		t.Errorf("base config should be inherited, got %v", route.PluginsData[0].Config)
+	}
+
+	web := config.Domains["*.example.com"].Routes
+	if len(web) != 1 || len(web[0].Upstreams) != 1 || web[0].Upstreams[0].Target != "http://web:8080" {
+		t.Errorf("routes without targets should fall back to their upstream, got %+v", web)
+	}
+}
+
+func TestAssembleConfigThousandsOfRoutes(t *testing.T) {
+	const domainCount, routesPerDomain = 40, 100
+	config := assembleConfig(configFixture(domainCount, routesPerDomain))
+
+	if len(config.Domains) != domainCount {
+		t.Fatalf("got %d domains, want %d", len(config.Domains), domainCount)
+	}
+	total := 0
+	for name, domain := range config.Domains {
+		if len(domain.Routes) != routesPerDomain {
+			t.Fatalf("%s has %d routes, want %d", name, len(domain.Routes), routesPerDomain)
+		}
+		for _, route := range domain.Routes {
+			total++
+			if route.Plugin != "basic-auth,rate-limit,cors" || len(route.PluginsData) != 3 {
+				t.Fatalf("route %s has plugins %q", route.Path, route.Plugin)
+			}
+			if len(route.Upstreams) != 2 {
+				t.Fatalf("route %s has %d upstreams", route.Path, len(route.Upstreams))
+			}
+			cors := route.PluginsData[2].Config
+			if cors["realm"] != "cors" || cors["route"] == nil {
+				t.Fatalf("route %s has cors config %v", route.Path, cors)
+			}
+		}
+	}
+	if total != domainCount*routesPerDomain {
+		t.Errorf("got %d routes, want %d", total, domainCount*routesPerDomain)
+	}
+
+	// Per-route envs must not leak into the plugin shared by other routes
+	first := config.Domains["app1.example.com"].Routes
+	if first[0].PluginsData[2].Config["route"] == first[1].PluginsData[2].Config["route"] {
+		t.Errorf("routes share per-route envs: %v", first[0].PluginsData[2].Config)
+	}
+}
+
+// countConfigQueries seeds an empty test database with configFixture and returns the number
+// of statements buildConfig runs against it
+func countConfigQueries(t *testing.T, domainCount, routesPerDomain int) int {
+	t.Helper()
+	openTestDatabase(t)
+
+	domains, routes, routePlugins, routeUpstreams, healthChecks, plugins, pluginServices := configFixture(domainCount, routesPerDomain)
+	for _, rows := range []interface{}{domains, routes, plugins, routePlugins, routeUpstreams, healthChecks} {
+		if err := DB.CreateInBatches(rows, 500).Error; err != nil {
+			t.Fatalf("failed to seed %T: %v", rows, err)
+		}
+	}
+	// The fixture's plugin service may already be seeded
+	if err := DB.Clauses(clause.OnConflict{DoNothing: true}).Create(&pluginServices).Error; err != nil {
+		t.Fatalf("failed to seed plugin services: %v", err)
+	}
+
+	queries := 0
+	count := func(*gorm.DB) { queries++ }
+	if err := DB.Callback().Query().Before("gorm:query").Register("test:count_queries", count); err != nil {
+		t.Fatal(err)
+	}
+	if err := DB.Callback().Row().Before("gorm:row").Register("test:count_rows", count); err != nil {
+		t.Fatal(err)
+	}
+	if err := DB.Callback().Raw().Before("gorm:raw").Register("test:count_raw", count); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := buildConfig("", false); err != nil {
+		t.Fatalf("buildConfig: %v", err)
+	}
+	return queries
+}
+
+func TestBuildConfigQueryCountIsConstant(t *testing.T) {
+	few := countConfigQueries(t, 2, 5)
+	many := countConfigQueries(t, 20, 100)
+	if few != many {
+		t.Errorf("buildConfig ran %d statements for 10 routes but %d for 2,000 routes", few, many)
+	}
+}
+
+func BenchmarkAssembleConfig(b *testing.B) {
+	domains, routes, routePlugins, routeUpstreams, healthChecks, plugins, pluginServices := configFixture(100, 50)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		assembleConfig(domains, routes, routePlugins, routeUpstreams, healthChecks, plugins, pluginServices)
+	}
+}
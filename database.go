@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strings"
 
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
@@ -46,13 +47,55 @@ func InitDatabase() error {
 
 // runMigrations runs the database migrations
 func runMigrations() error {
-	SeedPluginServices()
+	// Domains created before ownership verification existed are grandfathered in as verified
+	grandfatherDomains := DB.Migrator().HasTable(&Domain{}) && !DB.Migrator().HasColumn(&Domain{}, "status")
+
+	// Reserved names are only seeded once, so admins can remove them later
+	seedPolicies := !DB.Migrator().HasTable(&DomainPolicy{})
+
+	// Plugin names used to be unique across all users; they are now unique per user
+	if err := dropGlobalUniqueIndex("plugins", "idx_plugins_name_plugin"); err != nil {
+		return err
+	}
+
+	// Domain names used to be unique across all users, so pending claims could squat them;
+	// they are now unique per user and only verified names are unique across users
+	if err := dropGlobalUniqueIndex("domains", "idx_domains_name"); err != nil {
+		return err
+	}
+
 	// Auto migrate the models
-	err := DB.AutoMigrate(&Domain{}, &Route{}, &Plugin{}, &PluginService{})
+	err := DB.AutoMigrate(&Domain{}, &Route{}, &Plugin{}, &PluginService{}, &RoutePlugin{}, &RouteUpstream{}, &RouteHealthCheck{}, &DomainPolicy{}, &Certificate{}, &ACMEAccount{}, &ACMEChallenge{}, &ConfigRevision{}, &APIKey{}, &AuditEvent{})
 	if err != nil {
 		return err
 	}
 
+	if err := SeedPluginServices(); err != nil {
+		return err
+	}
+
+	if err := migrateRoutePluginStrings(); err != nil {
+		return err
+	}
+
+	if err := migrateRouteUpstreams(); err != nil {
+		return err
+	}
+
+	if err := migrateDomainVerification(grandfatherDomains); err != nil {
+		return err
+	}
+
+	if seedPolicies {
+		if err := seedDomainPolicies(); err != nil {
+			return err
+		}
+	}
+
+	if err := initConfigRevision(); err != nil {
+		return err
+	}
+
 	// Create indexes for better performance
 	err = DB.Exec("CREATE INDEX IF NOT EXISTS idx_routes_domain_id ON routes(domain_id)").Error
 	if err != nil {
@@ -64,6 +107,11 @@ func runMigrations() error {
 		return err
 	}
 
+	err = DB.Exec("CREATE UNIQUE INDEX IF NOT EXISTS idx_domains_verified_name ON domains(name) WHERE status = 'verified' AND deleted_at IS NULL").Error
+	if err != nil {
+		return err
+	}
+
 	err = DB.Exec("CREATE INDEX IF NOT EXISTS idx_plugins_name_plugin ON plugins(name_plugin)").Error
 	if err != nil {
 		return err
@@ -77,6 +125,21 @@ func runMigrations() error {
 	return nil
 }
 
+// dropGlobalUniqueIndex drops a unique index on a name column created before the records
+// were scoped to users. The plain index of the same name is recreated by runMigrations.
+func dropGlobalUniqueIndex(table, index string) error {
+	var definitions []string
+	err := DB.Raw("SELECT indexdef FROM pg_indexes WHERE tablename = ? AND indexname = ?", table, index).Scan(&definitions).Error
+	if err != nil {
+		return err
+	}
+	if len(definitions) == 0 || !strings.Contains(definitions[0], "UNIQUE") {
+		return nil
+	}
+	log.Printf("Dropping the global unique index %s", index)
+	return DB.Exec("DROP INDEX " + index).Error
+}
+
 // getEnv gets an environment variable or returns a default value
 func getEnv(key, defaultValue string) string {
 	if value := os.Getenv(key); value != "" {
@@ -90,26 +153,32 @@ func SeedPluginServices() error {
 		{
 			Name:       "auth",
 			BaseConfig: `{"auth_user":"admin","auth_pass":"password"}`,
+			Schema:     `{"type":"object","properties":{"auth_user":{"type":"string","minLength":1},"auth_pass":{"type":"string","minLength":1,"writeOnly":true}},"required":["auth_user","auth_pass"]}`,
 		},
 		{
 			Name:       "cors",
 			BaseConfig: `{"cors_origin":"*","cors_methods":"GET,POST","cors_headers":"Content-Type,Authorization"}`,
+			Schema:     `{"type":"object","properties":{"cors_origin":{"type":"string","minLength":1},"cors_methods":{"type":"string","pattern":"^[A-Z]+(,[A-Z]+)*$"},"cors_headers":{"type":"string"}},"required":["cors_origin"]}`,
 		},
 		{
 			Name:       "ratelimit",
 			BaseConfig: `{"rate_limit":60,"rate_window":60}`,
+			Schema:     `{"type":"object","properties":{"rate_limit":{"type":"integer","minimum":1},"rate_window":{"type":"integer","minimum":1}},"required":["rate_limit","rate_window"]}`,
 		},
 		{
 			Name:       "ipwhitelist",
 			BaseConfig: `{"whitelist_ips":"127.0.0.1,192.168.1.0/24"}`,
+			Schema:     `{"type":"object","properties":{"whitelist_ips":{"type":"string","minLength":1}},"required":["whitelist_ips"]}`,
 		},
 		{
 			Name:       "jwt",
 			BaseConfig: `{"jwt_secret":"mysecret"}`,
+			Schema:     `{"type":"object","properties":{"jwt_secret":{"type":"string","minLength":1,"writeOnly":true}},"required":["jwt_secret"]}`,
 		},
 		{
 			Name:       "logging",
 			BaseConfig: `{"log_level":"info"}`,
+			Schema:     `{"type":"object","properties":{"log_level":{"type":"string","enum":["debug","info","warn","error"]}}}`,
 		},	
 	}
 
@@ -117,8 +186,29 @@ func SeedPluginServices() error {
 		var existing PluginService
 		// Check if the plugin service already exists
 		if err := DB.Where("name = ?", svc.Name).First(&existing).Error; err == nil {
+			// Give services seeded before schemas existed their schema
+			if existing.Schema == "" {
+				if err := DB.Model(&existing).Update("schema", svc.Schema).Error; err != nil {
+					return err
+				}
+			}
+			// Encrypt default secrets seeded before an encryption key was configured
+			sealed, err := sealSecrets(existing.BaseConfig, existing.BaseConfig, pluginServiceSecretFields(existing.Schema))
+			if err != nil {
+				return fmt.Errorf("plugin service %s: %v", svc.Name, err)
+			}
+			if sealed != existing.BaseConfig {
+				if err := DB.Model(&existing).UpdateColumn("base_config", sealed).Error; err != nil {
+					return err
+				}
+			}
 			continue // already exists, skip
 		}
+		sealed, err := sealSecrets(svc.BaseConfig, "", pluginServiceSecretFields(svc.Schema))
+		if err != nil {
+			return err
+		}
+		svc.BaseConfig = sealed
 		if err := DB.Create(&svc).Error; err != nil {
 			log.Printf("Failed to seed plugin service %s: %v", svc.Name, err)
 			return err
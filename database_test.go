@@ -0,0 +1,93 @@
+package main
+
+import (
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// testDatabaseEnv names the PostgreSQL DSN of the database tests needing one run against.
+// The database is migrated and emptied by every such test, so never point it at real data.
+const testDatabaseEnv = "PEPES_TEST_DATABASE_DSN"
+
+// openTestDatabase points DB at an empty, migrated test database for the duration of the
+// test. Tests are skipped when no test database is configured.
+func openTestDatabase(t *testing.T) {
+	t.Helper()
+	dsn := os.Getenv(testDatabaseEnv)
+	if dsn == "" {
+		t.Skipf("%s is not set", testDatabaseEnv)
+	}
+
+	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		t.Fatalf("failed to connect to the test database: %v", err)
+	}
+	previous := DB
+	DB = db
+	t.Cleanup(func() {
+		if sqlDB, err := db.DB(); err == nil {
+			sqlDB.Close()
+		}
+		DB = previous
+	})
+
+	if err := runMigrations(); err != nil {
+		t.Fatalf("failed to migrate the test database: %v", err)
+	}
+	// Seeded plugin services and the config revision are kept
+	err = DB.Exec("TRUNCATE domains, routes, plugins, route_plugins, route_upstreams, route_health_checks, " +
+		"certificates, acme_accounts, acme_challenges, api_keys, audit_events RESTART IDENTITY CASCADE").Error
+	if err != nil {
+		t.Fatalf("failed to empty the test database: %v", err)
+	}
+}
+
+var registerTestValidators sync.Once
+
+// serveAs runs handler, registered at route, for a request made by principal
+func serveAs(t *testing.T, principal *Principal, handler gin.HandlerFunc, method, route, path, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	registerTestValidators.Do(func() {
+		if err := registerValidators(); err != nil {
+			t.Fatalf("failed to register validators: %v", err)
+		}
+	})
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Handle(method, route, func(c *gin.Context) {
+		c.Set(principalContextKey, principal)
+	}, handler)
+
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+// mustCreate inserts a fixture row, failing the test on error
+func mustCreate(t *testing.T, value interface{}) {
+	t.Helper()
+	if err := DB.Create(value).Error; err != nil {
+		t.Fatalf("failed to create %T: %v", value, err)
+	}
+}
+
+// expectStatus fails the test when a response does not have the wanted status
+func expectStatus(t *testing.T, w *httptest.ResponseRecorder, want int) {
+	t.Helper()
+	if w.Code != want {
+		t.Errorf("status = %d, want %d: %s", w.Code, want, w.Body.String())
+	}
+}
@@ -0,0 +1,1130 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"gopkg.in/yaml.v3"
+	"gorm.io/gorm"
+)
+
+const (
+	// configDocumentVersion is the version of the declarative config format
+	configDocumentVersion = 1
+
+	// maxConfigDocumentSize is the largest declarative document accepted by the API
+	maxConfigDocumentSize = 8 << 20
+)
+
+// Actions of the changes needed to apply a declarative document
+const (
+	ConfigChangeCreate = "create"
+	ConfigChangeUpdate = "update"
+	ConfigChangeDelete = "delete"
+)
+
+// ConfigDocument is the declarative form of a tenant's gateway configuration. Entities are
+// identified by natural keys (plugin service and plugin names, domain names and route paths)
+// rather than IDs, so a document can be kept in git and applied to any environment.
+type ConfigDocument struct {
+	Version        int                 `json:"version" binding:"omitempty,eq=1"`
+	PluginServices []PluginServiceSpec `json:"plugin_services,omitempty" binding:"omitempty,dive"`
+	Plugins        []PluginSpec        `json:"plugins,omitempty" binding:"omitempty,dive"`
+	Domains        []DomainSpec        `json:"domains,omitempty" binding:"omitempty,dive"`
+}
+
+// PluginServiceSpec declares a plugin service. Configs are JSON objects.
+type PluginServiceSpec struct {
+	Name       string      `json:"name" binding:"required,min=1,max=255"`
+	BaseConfig interface{} `json:"baseconfig,omitempty"`
+	Schema     interface{} `json:"schema,omitempty"`
+}
+
+// PluginSpec declares a plugin
+type PluginSpec struct {
+	Name          string      `json:"name" binding:"required,min=1,max=255"`
+	PluginSvcName string      `json:"plugin_svc_name" binding:"required,min=1,max=255"`
+	Envs          interface{} `json:"envs,omitempty"`
+	Desc          string      `json:"desc,omitempty" binding:"max=1000"`
+}
+
+// DomainSpec declares a domain and its routes
+type DomainSpec struct {
+	Name    string      `json:"name" binding:"required,min=1,max=255"`
+	AutoTLS bool        `json:"auto_tls,omitempty"`
+	Routes  []RouteSpec `json:"routes,omitempty" binding:"omitempty,dive"`
+}
+
+// RouteSpec declares a route of a domain, identified by its path
+type RouteSpec struct {
+	Path            string                  `json:"path" binding:"required,min=1,max=255"`
+	UsePathAsPrefix bool                    `json:"usePathAsPrefix,omitempty"`
+	Upstream        string                  `json:"upstream,omitempty" binding:"omitempty,max=500,upstream,upstream_policy"`
+	Upstreams       []UpstreamTargetRequest `json:"upstreams,omitempty" binding:"omitempty,max=50,dive"`
+	LoadBalancing   string                  `json:"load_balancing,omitempty" binding:"omitempty,oneof=round_robin weighted least_conn consistent_hash"`
+	HashHeader      string                  `json:"hash_header,omitempty" binding:"required_if=LoadBalancing consistent_hash,omitempty,max=255"`
+	HealthCheck     *HealthCheckRequest     `json:"health_check,omitempty"`
+	Plugins         []RoutePluginSpec       `json:"plugins,omitempty" binding:"omitempty,max=50,dive"`
+}
+
+// RoutePluginSpec attaches a plugin to a route, in list order, with optional per-route envs
+type RoutePluginSpec struct {
+	Name string      `json:"name" binding:"required,min=1,max=255"`
+	Envs interface{} `json:"envs,omitempty"`
+}
+
+// ConfigChange describes a change needed to bring the stored configuration to a document
+type ConfigChange struct {
+	Entity string      `json:"entity"`
+	Key    string      `json:"key"`
+	Action string      `json:"action"`
+	Before interface{} `json:"before,omitempty"`
+	After  interface{} `json:"after,omitempty"`
+}
+
+// declarativeError rejects a document that cannot be applied
+type declarativeError struct {
+	status  int
+	message string
+}
+
+func (e *declarativeError) Error() string {
+	return e.message
+}
+
+func invalidDocument(format string, args ...interface{}) error {
+	return &declarativeError{status: http.StatusBadRequest, message: fmt.Sprintf(format, args...)}
+}
+
+// respondDeclarativeError writes the response for an error planning or applying a document
+func respondDeclarativeError(c *gin.Context, err error) {
+	var docErr *declarativeError
+	var validationErr *configValidationError
+	var conflictErr *routeConflictError
+	switch {
+	case errors.As(err, &docErr):
+		c.JSON(docErr.status, gin.H{"error": docErr.Error()})
+	case errors.As(err, &validationErr):
+		respondConfigValidationError(c, validationErr)
+	case errors.As(err, &conflictErr):
+		c.JSON(http.StatusConflict, gin.H{"error": conflictErr.Error(), "conflict": conflictErr.conflict})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": formatDatabaseError(err)})
+	}
+}
+
+// secretView converts a stored config, whose secret fields are given, to the form shown in
+// a document
+type secretView func(stored string, secret secretFields) (string, error)
+
+func redactedView(stored string, secret secretFields) (string, error) {
+	return redactSecrets(stored, secret), nil
+}
+
+func comparableView(stored string, secret secretFields) (string, error) {
+	return configForValidation(stored), nil
+}
+
+// documentConfig converts a stored config to a document value: an object for JSON objects,
+// the raw string for anything else and nil when empty
+func documentConfig(stored string) interface{} {
+	if strings.TrimSpace(stored) == "" {
+		return nil
+	}
+	fields, ok := parseConfigObject(stored)
+	if !ok {
+		return stored
+	}
+	return plainConfigValue(fields)
+}
+
+// plainConfigValue converts json.Number values so they render as numbers in YAML
+func plainConfigValue(value interface{}) interface{} {
+	switch typed := value.(type) {
+	case json.Number:
+		if number, err := typed.Int64(); err == nil {
+			return number
+		}
+		number, _ := typed.Float64()
+		return number
+	case map[string]interface{}:
+		for key, item := range typed {
+			typed[key] = plainConfigValue(item)
+		}
+		return typed
+	case []interface{}:
+		for i, item := range typed {
+			typed[i] = plainConfigValue(item)
+		}
+		return typed
+	default:
+		return value
+	}
+}
+
+// storedConfig converts a document config value back to its stored string form
+func storedConfig(value interface{}) (string, error) {
+	switch typed := value.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return typed, nil
+	case map[string]interface{}:
+		encoded, err := json.Marshal(typed)
+		return string(encoded), err
+	default:
+		return "", fmt.Errorf("must be an object")
+	}
+}
+
+// keepRedactedSecrets replaces placeholder secrets in a desired config with the current
+// values, mirroring what sealSecrets does when the config is written
+func keepRedactedSecrets(desired, current string) string {
+	currentFields, _ := parseConfigObject(current)
+	kept, err := transformConfigStrings(desired, func(field, secret string) (string, error) {
+		if stored, ok := currentFields[field].(string); ok && secret == redactedSecret {
+			return stored, nil
+		}
+		return secret, nil
+	})
+	if err != nil {
+		return desired
+	}
+	return kept
+}
+
+// sameSpec reports whether two specs have the same canonical JSON encoding
+func sameSpec(a, b interface{}) bool {
+	encodedA, errA := json.Marshal(a)
+	encodedB, errB := json.Marshal(b)
+	return errA == nil && errB == nil && bytes.Equal(encodedA, encodedB)
+}
+
+func pluginServiceSpecFor(pluginService PluginService, view secretView) (PluginServiceSpec, error) {
+	baseConfig, err := view(pluginService.BaseConfig, pluginServiceSecretFields(pluginService.Schema))
+	if err != nil {
+		return PluginServiceSpec{}, fmt.Errorf("plugin service %s: %v", pluginService.Name, err)
+	}
+	return PluginServiceSpec{
+		Name:       pluginService.Name,
+		BaseConfig: documentConfig(baseConfig),
+		Schema:     documentConfig(pluginService.Schema),
+	}, nil
+}
+
+func pluginSpecFor(plugin Plugin, view secretView) (PluginSpec, error) {
+	envs, err := view(plugin.Envs, serviceSecretFields(plugin.PluginSvcName))
+	if err != nil {
+		return PluginSpec{}, fmt.Errorf("plugin %s: %v", plugin.NamePlugin, err)
+	}
+	return PluginSpec{
+		Name:          plugin.NamePlugin,
+		PluginSvcName: plugin.PluginSvcName,
+		Envs:          documentConfig(envs),
+		Desc:          plugin.Desc,
+	}, nil
+}
+
+// routeSpecFor converts a route, loaded with preloadRouteDetails, to its spec
+func routeSpecFor(route Route, view secretView) (RouteSpec, error) {
+	spec := RouteSpec{
+		Path:            route.Path,
+		UsePathAsPrefix: route.UsePathAsPrefix,
+		LoadBalancing:   route.LoadBalancing,
+		HashHeader:      route.HashHeader,
+	}
+
+	for _, upstream := range route.Upstreams {
+		weight := upstream.Weight
+		spec.Upstreams = append(spec.Upstreams, UpstreamTargetRequest{Target: upstream.Target, Weight: &weight})
+	}
+	if len(spec.Upstreams) == 0 {
+		weight := defaultUpstreamWeight
+		spec.Upstreams = []UpstreamTargetRequest{{Target: route.Upstream, Weight: &weight}}
+	}
+
+	if check := route.HealthCheck; check != nil {
+		spec.HealthCheck = &HealthCheckRequest{
+			Active: &ActiveHealthCheckRequest{
+				Enabled:            check.Active.Enabled,
+				Path:               check.Active.Path,
+				IntervalSeconds:    check.Active.IntervalSeconds,
+				TimeoutSeconds:     check.Active.TimeoutSeconds,
+				HealthyThreshold:   check.Active.HealthyThreshold,
+				UnhealthyThreshold: check.Active.UnhealthyThreshold,
+			},
+			Passive: &PassiveHealthCheckRequest{
+				Enabled:            check.Passive.Enabled,
+				UnhealthyThreshold: check.Passive.UnhealthyThreshold,
+				EjectionSeconds:    check.Passive.EjectionSeconds,
+			},
+		}
+	}
+
+	for _, routePlugin := range route.Plugins {
+		envs, err := view(routePlugin.Envs, routePluginSecretFields(routePlugin))
+		if err != nil {
+			return RouteSpec{}, fmt.Errorf("route %s plugin %s: %v", route.Path, routePlugin.Plugin.NamePlugin, err)
+		}
+		spec.Plugins = append(spec.Plugins, RoutePluginSpec{Name: routePlugin.Plugin.NamePlugin, Envs: documentConfig(envs)})
+	}
+	return spec, nil
+}
+
+// declarativeState is the stored configuration of a tenant, indexed by natural keys
+type declarativeState struct {
+	pluginServices map[string]PluginService
+	plugins        map[string]Plugin
+	domains        map[string]Domain
+	routes         map[string]Route
+}
+
+// routeKey identifies a route by its domain name and normalized path
+func routeKey(domainName, routePath string) string {
+	return domainName + normalizeRoutePath(routePath)
+}
+
+// loadDeclarativeState loads every plugin service and the plugins, domains and routes of userId
+func loadDeclarativeState(db *gorm.DB, userId string) (*declarativeState, error) {
+	state := &declarativeState{
+		pluginServices: map[string]PluginService{},
+		plugins:        map[string]Plugin{},
+		domains:        map[string]Domain{},
+		routes:         map[string]Route{},
+	}
+
+	var pluginServices []PluginService
+	if err := db.Find(&pluginServices).Error; err != nil {
+		return nil, err
+	}
+	for _, pluginService := range pluginServices {
+		state.pluginServices[pluginService.Name] = pluginService
+	}
+
+	var plugins []Plugin
+	if err := db.Where("user_id = ?", userId).Find(&plugins).Error; err != nil {
+		return nil, err
+	}
+	for _, plugin := range plugins {
+		state.plugins[plugin.NamePlugin] = plugin
+	}
+
+	var domains []Domain
+	if err := db.Where("user_id = ?", userId).Find(&domains).Error; err != nil {
+		return nil, err
+	}
+	domainNames := make(map[uint]string, len(domains))
+	for _, domain := range domains {
+		state.domains[domain.Name] = domain
+		domainNames[domain.ID] = domain.Name
+	}
+
+	var routes []Route
+	domainIDs := db.Model(&Domain{}).Select("id").Where("user_id = ?", userId)
+	if err := preloadRouteDetails(db.Where("domain_id IN (?)", domainIDs)).Find(&routes).Error; err != nil {
+		return nil, err
+	}
+	for _, route := range routes {
+		state.routes[routeKey(domainNames[route.DomainID], route.Path)] = route
+	}
+
+	return state, nil
+}
+
+// exportConfigDocument builds the declarative document of a tenant's configuration,
+// sorted by natural key, with secrets redacted
+func exportConfigDocument(db *gorm.DB, userId string) (ConfigDocument, error) {
+	view := redactedView
+
+	state, err := loadDeclarativeState(db, userId)
+	if err != nil {
+		return ConfigDocument{}, err
+	}
+
+	doc := ConfigDocument{Version: configDocumentVersion}
+	for _, name := range sortedKeys(state.pluginServices) {
+		spec, err := pluginServiceSpecFor(state.pluginServices[name], view)
+		if err != nil {
+			return ConfigDocument{}, err
+		}
+		doc.PluginServices = append(doc.PluginServices, spec)
+	}
+	for _, name := range sortedKeys(state.plugins) {
+		spec, err := pluginSpecFor(state.plugins[name], view)
+		if err != nil {
+			return ConfigDocument{}, err
+		}
+		doc.Plugins = append(doc.Plugins, spec)
+	}
+
+	routesByDomain := make(map[uint][]Route, len(state.domains))
+	for _, route := range state.routes {
+		routesByDomain[route.DomainID] = append(routesByDomain[route.DomainID], route)
+	}
+	for _, name := range sortedKeys(state.domains) {
+		domain := state.domains[name]
+		spec := DomainSpec{Name: domain.Name, AutoTLS: domain.AutoTLS}
+
+		routes := routesByDomain[domain.ID]
+		sort.Slice(routes, func(i, j int) bool { return routes[i].Path < routes[j].Path })
+		for _, route := range routes {
+			routeSpec, err := routeSpecFor(route, view)
+			if err != nil {
+				return ConfigDocument{}, err
+			}
+			spec.Routes = append(spec.Routes, routeSpec)
+		}
+		doc.Domains = append(doc.Domains, spec)
+	}
+
+	return doc, nil
+}
+
+func sortedKeys[V any](items map[string]V) []string {
+	keys := make([]string, 0, len(items))
+	for key := range items {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// configPlan is the ordered list of changes that brings a tenant's stored configuration
+// to a declarative document
+type configPlan struct {
+	userId    string
+	principal *Principal
+	policy    string
+	prune     bool
+	changes   []ConfigChange
+	steps     []func(tx *gorm.DB) error
+	events    []ConfigChangeEvent
+	// revalidate names the updated plugin services whose plugins are checked once every
+	// step ran, so plugins fixed by the same document are checked as they end up
+	revalidate []string
+	warnings   []RouteConflict
+}
+
+// add records a change and the step that performs it
+func (p *configPlan) add(change ConfigChange, step func(tx *gorm.DB) error) {
+	p.changes = append(p.changes, change)
+	p.steps = append(p.steps, step)
+}
+
+// record audits a change made in tx and queues its event to publish once the plan is
+// committed. before is nil for creates and after for deletes.
+func (p *configPlan) record(tx *gorm.DB, entity, action string, id uint, owner string, before, after interface{}) error {
+	data := after
+	if action == ConfigActionDeleted {
+		data = before
+	}
+	p.events = append(p.events, ConfigChangeEvent{Entity: entity, Action: action, ID: id, Data: data, owner: owner})
+	return recordAudit(tx, p.principal, entity, action, id, owner, before, after)
+}
+
+// apply performs every step of the plan in tx
+func (p *configPlan) apply(tx *gorm.DB) error {
+	for _, step := range p.steps {
+		if err := step(tx); err != nil {
+			return err
+		}
+	}
+	for _, name := range p.revalidate {
+		var pluginService PluginService
+		if err := tx.Where("name = ?", name).First(&pluginService).Error; err != nil {
+			return err
+		}
+		if err := revalidateServicePlugins(tx, pluginService); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// publish sends the queued change events after the plan was committed
+func (p *configPlan) publish() {
+	for _, event := range p.events {
+		if pluginService, ok := event.Data.(PluginService); ok {
+			cacheSecretFields(pluginService)
+		}
+		publishConfigChange(event.Entity, event.Action, event.ID, event.owner, event.Data)
+	}
+}
+
+// planConfigDocument compares a document with the stored configuration of userId and returns
+// the changes needed to apply it. Stored domains, routes and plugins missing from the document
+// are deleted when prune is set and left untouched otherwise; plugin services are shared by
+// every tenant and never pruned. Changing plugin services requires principal to be an admin.
+func planConfigDocument(tx *gorm.DB, userId string, doc ConfigDocument, principal *Principal, policy string, prune bool) (*configPlan, error) {
+	state, err := loadDeclarativeState(tx, userId)
+	if err != nil {
+		return nil, err
+	}
+	plan := &configPlan{userId: userId, principal: principal, policy: policy, prune: prune, changes: []ConfigChange{}}
+
+	// Deletes go first so nothing declared can conflict with an object about to be removed
+	if prune {
+		if err := plan.planPrunes(state, doc); err != nil {
+			return nil, err
+		}
+	}
+
+	pluginServices, err := plan.planPluginServices(state, doc.PluginServices, principal.IsAdmin())
+	if err != nil {
+		return nil, err
+	}
+
+	plugins, err := plan.planPlugins(state, doc.Plugins, pluginServices)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := plan.planDomains(tx, state, doc.Domains, plugins, pluginServices); err != nil {
+		return nil, err
+	}
+
+	return plan, nil
+}
+
+// planPluginServices plans plugin service changes and returns every plugin service as it
+// will be after the plan, for validating plugin envs
+func (p *configPlan) planPluginServices(state *declarativeState, specs []PluginServiceSpec, admin bool) (map[string]PluginService, error) {
+	result := make(map[string]PluginService, len(state.pluginServices)+len(specs))
+	for name, pluginService := range state.pluginServices {
+		result[name] = PluginService{Name: name, BaseConfig: configForValidation(pluginService.BaseConfig), Schema: pluginService.Schema}
+	}
+
+	seen := map[string]bool{}
+	for _, spec := range specs {
+		if seen[spec.Name] {
+			return nil, invalidDocument("Plugin service %s is declared more than once", spec.Name)
+		}
+		seen[spec.Name] = true
+
+		baseConfig, err := storedConfig(spec.BaseConfig)
+		if err != nil {
+			return nil, invalidDocument("Plugin service %s: baseconfig %v", spec.Name, err)
+		}
+		schema, err := storedConfig(spec.Schema)
+		if err != nil {
+			return nil, invalidDocument("Plugin service %s: schema %v", spec.Name, err)
+		}
+		if err := validatePluginServiceConfig(schema, baseConfig); err != nil {
+			if validationErr, ok := err.(*configValidationError); ok {
+				validationErr.subject = "Base Configuration of plugin service " + spec.Name
+				return nil, validationErr
+			}
+			return nil, invalidDocument("Plugin service %s: %v", spec.Name, err)
+		}
+
+		existing, exists := state.pluginServices[spec.Name]
+		baseConfig = keepRedactedSecrets(baseConfig, configForValidation(existing.BaseConfig))
+		result[spec.Name] = PluginService{Name: spec.Name, BaseConfig: baseConfig, Schema: schema}
+
+		before, err := pluginServiceSpecFor(existing, comparableView)
+		if err != nil {
+			return nil, err
+		}
+		after := PluginServiceSpec{Name: spec.Name, BaseConfig: documentConfig(baseConfig), Schema: documentConfig(schema)}
+		if exists && sameSpec(before, after) {
+			continue
+		}
+		if !admin {
+			return nil, &declarativeError{status: http.StatusForbidden, message: "Only admins can change plugin service " + spec.Name}
+		}
+
+		change := ConfigChange{Entity: ConfigEntityPluginService, Key: spec.Name, Action: ConfigChangeCreate}
+		change.After, _ = pluginServiceSpecFor(PluginService{Name: spec.Name, BaseConfig: baseConfig, Schema: schema}, redactedView)
+		if exists {
+			change.Action = ConfigChangeUpdate
+			change.Before, _ = pluginServiceSpecFor(existing, redactedView)
+		}
+		p.add(change, func(tx *gorm.DB) error {
+			pluginService := existing
+			pluginService.Name = spec.Name
+			pluginService.Schema = schema
+			sealed, err := sealSecrets(baseConfig, existing.BaseConfig, pluginServiceSecretFields(schema))
+			if err != nil {
+				return invalidDocument("Plugin service %s: Base Configuration: %v", spec.Name, err)
+			}
+			pluginService.BaseConfig = sealed
+			if err := tx.Save(&pluginService).Error; err != nil {
+				return err
+			}
+			if exists {
+				p.revalidate = append(p.revalidate, pluginService.Name)
+			}
+			return p.record(tx, ConfigEntityPluginService, configEventAction(exists), pluginService.ID, "", storedBefore(exists, existing), pluginService)
+		})
+	}
+	return result, nil
+}
+
+// planPlugins plans plugin changes and returns every plugin of the tenant as it will be
+// after the plan, by name, for validating per-route envs
+func (p *configPlan) planPlugins(state *declarativeState, specs []PluginSpec, pluginServices map[string]PluginService) (map[string]Plugin, error) {
+	result := make(map[string]Plugin, len(state.plugins)+len(specs))
+	if !p.prune {
+		for name, plugin := range state.plugins {
+			result[name] = Plugin{NamePlugin: name, PluginSvcName: plugin.PluginSvcName, Envs: configForValidation(plugin.Envs)}
+		}
+	}
+
+	seen := map[string]bool{}
+	for _, spec := range specs {
+		if seen[spec.Name] {
+			return nil, invalidDocument("Plugin %s is declared more than once", spec.Name)
+		}
+		seen[spec.Name] = true
+	}
+
+	for _, spec := range specs {
+		pluginService, ok := pluginServices[spec.PluginSvcName]
+		if !ok {
+			return nil, invalidDocument("Plugin %s: plugin service %s does not exist", spec.Name, spec.PluginSvcName)
+		}
+		envs, err := storedConfig(spec.Envs)
+		if err != nil {
+			return nil, invalidDocument("Plugin %s: envs %v", spec.Name, err)
+		}
+		if err := validatePluginEnvs(pluginService, envs); err != nil {
+			if validationErr, ok := err.(*configValidationError); ok {
+				validationErr.subject = "Environment Variables of plugin " + spec.Name
+				return nil, validationErr
+			}
+			return nil, err
+		}
+
+		existing, exists := state.plugins[spec.Name]
+		envs = keepRedactedSecrets(envs, configForValidation(existing.Envs))
+		result[spec.Name] = Plugin{NamePlugin: spec.Name, PluginSvcName: spec.PluginSvcName, Envs: envs}
+
+		before, err := pluginSpecFor(existing, comparableView)
+		if err != nil {
+			return nil, err
+		}
+		after := PluginSpec{Name: spec.Name, PluginSvcName: spec.PluginSvcName, Envs: documentConfig(envs), Desc: spec.Desc}
+		if exists && sameSpec(before, after) {
+			continue
+		}
+
+		change := ConfigChange{Entity: ConfigEntityPlugin, Key: spec.Name, Action: ConfigChangeCreate}
+		secret := pluginServiceSecretFields(pluginService.Schema)
+		change.After = PluginSpec{Name: spec.Name, PluginSvcName: spec.PluginSvcName, Envs: documentConfig(redactSecrets(envs, secret)), Desc: spec.Desc}
+		if exists {
+			change.Action = ConfigChangeUpdate
+			change.Before, _ = pluginSpecFor(existing, redactedView)
+		}
+		p.add(change, func(tx *gorm.DB) error {
+			plugin := existing
+			plugin.NamePlugin = spec.Name
+			plugin.PluginSvcName = spec.PluginSvcName
+			plugin.Desc = spec.Desc
+			plugin.UserId = p.userId
+			sealed, err := sealSecrets(envs, existing.Envs, secret)
+			if err != nil {
+				return invalidDocument("Plugin %s: Environment Variables: %v", spec.Name, err)
+			}
+			plugin.Envs = sealed
+			if err := tx.Save(&plugin).Error; err != nil {
+				return err
+			}
+			return p.record(tx, ConfigEntityPlugin, configEventAction(exists), plugin.ID, plugin.UserId, storedBefore(exists, existing), plugin)
+		})
+	}
+	return result, nil
+}
+
+// planDomains plans domain and route changes
+func (p *configPlan) planDomains(tx *gorm.DB, state *declarativeState, specs []DomainSpec, plugins map[string]Plugin, pluginServices map[string]PluginService) error {
+	names := make([]string, 0, len(specs))
+	seen := map[string]bool{}
+	for i := range specs {
+		name, err := normalizeDomainName(specs[i].Name)
+		if err != nil {
+			return invalidDocument("Domain %s: %v", specs[i].Name, err)
+		}
+		if seen[name] {
+			return invalidDocument("Domain %s is declared more than once", name)
+		}
+		seen[name] = true
+		specs[i].Name = name
+		names = append(names, name)
+	}
+	if err := checkNotVerifiedByOthers(tx, names, p.userId); err != nil {
+		return err
+	}
+
+	for _, spec := range specs {
+		existing, exists := state.domains[spec.Name]
+		if !exists {
+			allowed, err := domainNameAllowed(spec.Name)
+			if err != nil {
+				return err
+			}
+			if !allowed {
+				return invalidDocument("Domain name %s is not allowed", spec.Name)
+			}
+		}
+
+		if !exists || existing.AutoTLS != spec.AutoTLS {
+			change := ConfigChange{
+				Entity: ConfigEntityDomain,
+				Key:    spec.Name,
+				Action: ConfigChangeCreate,
+				After:  DomainSpec{Name: spec.Name, AutoTLS: spec.AutoTLS},
+			}
+			if exists {
+				change.Action = ConfigChangeUpdate
+				change.Before = DomainSpec{Name: existing.Name, AutoTLS: existing.AutoTLS}
+			}
+			p.add(change, func(tx *gorm.DB) error {
+				domain := existing
+				if !exists {
+					domain = Domain{Name: spec.Name, UserId: p.userId}
+					if err := resetDomainVerification(&domain); err != nil {
+						return err
+					}
+				}
+				domain.AutoTLS = spec.AutoTLS
+				if err := tx.Omit("Routes").Save(&domain).Error; err != nil {
+					return err
+				}
+				return p.record(tx, ConfigEntityDomain, configEventAction(exists), domain.ID, domain.UserId, storedBefore(exists, existing), domain)
+			})
+		}
+
+		if err := p.planRoutes(state, spec, plugins, pluginServices); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// planRoutes plans the route changes of a declared domain
+func (p *configPlan) planRoutes(state *declarativeState, domainSpec DomainSpec, plugins map[string]Plugin, pluginServices map[string]PluginService) error {
+	seen := map[string]bool{}
+	for _, spec := range domainSpec.Routes {
+		key := routeKey(domainSpec.Name, spec.Path)
+		if seen[key] {
+			return invalidDocument("Route %s is declared more than once on domain %s", normalizeRoutePath(spec.Path), domainSpec.Name)
+		}
+		seen[key] = true
+
+		route, upstreams, healthCheck, err := buildRouteFromSpec(spec)
+		if err != nil {
+			return invalidDocument("Route %s of domain %s: %v", spec.Path, domainSpec.Name, err)
+		}
+
+		var attached []string
+		routeEnvs := make(map[string]string, len(spec.Plugins))
+		for _, pluginSpec := range spec.Plugins {
+			if _, ok := plugins[pluginSpec.Name]; !ok {
+				return invalidDocument("Route %s of domain %s: unknown plugin %s", spec.Path, domainSpec.Name, pluginSpec.Name)
+			}
+			if _, ok := routeEnvs[pluginSpec.Name]; ok {
+				return invalidDocument("Route %s of domain %s: plugin %s is attached more than once", spec.Path, domainSpec.Name, pluginSpec.Name)
+			}
+			envs, err := storedConfig(pluginSpec.Envs)
+			if err != nil {
+				return invalidDocument("Route %s of domain %s: plugin %s envs %v", spec.Path, domainSpec.Name, pluginSpec.Name, err)
+			}
+			attached = append(attached, pluginSpec.Name)
+			routeEnvs[pluginSpec.Name] = envs
+		}
+
+		existing, exists := state.routes[key]
+		storedEnvs := make(map[string]string, len(existing.Plugins))
+		for _, routePlugin := range existing.Plugins {
+			storedEnvs[routePlugin.Plugin.NamePlugin] = routePlugin.Envs
+		}
+		for _, name := range attached {
+			envs := keepRedactedSecrets(routeEnvs[name], configForValidation(storedEnvs[name]))
+			routeEnvs[name] = envs
+
+			plugin := plugins[name]
+			pluginService, ok := pluginServices[plugin.PluginSvcName]
+			if !ok {
+				return invalidDocument("Plugin %s: plugin service %s does not exist", name, plugin.PluginSvcName)
+			}
+			if err := validateRoutePluginEnvs(pluginService, plugin.Envs, envs); err != nil {
+				if validationErr, ok := err.(*configValidationError); ok {
+					validationErr.subject = fmt.Sprintf("Environment Variables of plugin %s on route %s of domain %s", name, normalizeRoutePath(spec.Path), domainSpec.Name)
+					return validationErr
+				}
+				return err
+			}
+		}
+
+		// Compare in the canonical form the route would be exported in
+		desiredRoute := route
+		desiredRoute.Upstreams = upstreams
+		if healthCheck.Active.Enabled || healthCheck.Passive.Enabled {
+			desiredRoute.HealthCheck = &healthCheck
+		}
+		for _, name := range attached {
+			desiredRoute.Plugins = append(desiredRoute.Plugins, RoutePlugin{Plugin: Plugin{NamePlugin: name, PluginSvcName: plugins[name].PluginSvcName}, Envs: routeEnvs[name]})
+		}
+		after, err := routeSpecFor(desiredRoute, comparableView)
+		if err != nil {
+			return err
+		}
+		if exists {
+			before, err := routeSpecFor(existing, comparableView)
+			if err != nil {
+				return err
+			}
+			if sameSpec(before, after) {
+				continue
+			}
+		}
+
+		change := ConfigChange{Entity: ConfigEntityRoute, Key: key, Action: ConfigChangeCreate}
+		change.After, _ = routeSpecFor(desiredRoute, redactedView)
+		if exists {
+			change.Action = ConfigChangeUpdate
+			change.Before, _ = routeSpecFor(existing, redactedView)
+		}
+		domainName := domainSpec.Name
+		p.add(change, func(tx *gorm.DB) error {
+			var domain Domain
+			if err := tx.Where("name = ? AND user_id = ?", domainName, p.userId).First(&domain).Error; err != nil {
+				return err
+			}
+
+			var before interface{}
+			saved := route
+			if exists {
+				snapshot, err := loadRouteSnapshot(tx, existing.ID)
+				if err != nil {
+					return err
+				}
+				before = snapshot
+				saved.ID = existing.ID
+				saved.CreatedAt = existing.CreatedAt
+			}
+			saved.DomainID = domain.ID
+
+			warnings, err := checkRouteConflicts(tx, saved, p.policy)
+			if err != nil {
+				return err
+			}
+			p.warnings = append(p.warnings, warnings...)
+
+			if err := tx.Omit("Domain", "Upstreams", "HealthCheck", "Plugins").Save(&saved).Error; err != nil {
+				return err
+			}
+			if err := replaceRouteUpstreams(tx, saved.ID, upstreams); err != nil {
+				return err
+			}
+			if err := saveRouteHealthCheck(tx, saved.ID, healthCheck); err != nil {
+				return err
+			}
+			if err := saveRoutePluginSpecs(tx, saved.ID, p.userId, attached, routeEnvs, storedEnvs); err != nil {
+				return err
+			}
+			after, err := loadRouteSnapshot(tx, saved.ID)
+			if err != nil {
+				return err
+			}
+			return p.record(tx, ConfigEntityRoute, configEventAction(exists), saved.ID, p.userId, before, after)
+		})
+	}
+	return nil
+}
+
+// planPrunes plans the deletion of the tenant's routes, domains and plugins that the
+// document does not declare
+func (p *configPlan) planPrunes(state *declarativeState, doc ConfigDocument) error {
+	domains := map[string]bool{}
+	routes := map[string]bool{}
+	for _, domainSpec := range doc.Domains {
+		name, err := normalizeDomainName(domainSpec.Name)
+		if err != nil {
+			return invalidDocument("Domain %s: %v", domainSpec.Name, err)
+		}
+		domains[name] = true
+		for _, routeSpec := range domainSpec.Routes {
+			routes[routeKey(name, routeSpec.Path)] = true
+		}
+	}
+	plugins := map[string]bool{}
+	for _, pluginSpec := range doc.Plugins {
+		plugins[pluginSpec.Name] = true
+	}
+
+	for _, key := range sortedKeys(state.routes) {
+		if routes[key] {
+			continue
+		}
+		route := state.routes[key]
+		change := ConfigChange{Entity: ConfigEntityRoute, Key: key, Action: ConfigChangeDelete}
+		change.Before, _ = routeSpecFor(route, redactedView)
+		p.add(change, func(tx *gorm.DB) error {
+			before, err := loadRouteSnapshot(tx, route.ID)
+			if err != nil {
+				return err
+			}
+			if err := removeRoute(tx, route); err != nil {
+				return err
+			}
+			return p.record(tx, ConfigEntityRoute, ConfigActionDeleted, route.ID, p.userId, before, nil)
+		})
+	}
+
+	for _, name := range sortedKeys(state.domains) {
+		if domains[name] {
+			continue
+		}
+		domain := state.domains[name]
+		change := ConfigChange{
+			Entity: ConfigEntityDomain,
+			Key:    name,
+			Action: ConfigChangeDelete,
+			Before: DomainSpec{Name: domain.Name, AutoTLS: domain.AutoTLS},
+		}
+		p.add(change, func(tx *gorm.DB) error {
+			if err := removeDomain(tx, domain); err != nil {
+				return err
+			}
+			return p.record(tx, ConfigEntityDomain, ConfigActionDeleted, domain.ID, domain.UserId, domain, nil)
+		})
+	}
+
+	for _, name := range sortedKeys(state.plugins) {
+		if plugins[name] {
+			continue
+		}
+		plugin := state.plugins[name]
+		change := ConfigChange{Entity: ConfigEntityPlugin, Key: name, Action: ConfigChangeDelete}
+		change.Before, _ = pluginSpecFor(plugin, redactedView)
+		p.add(change, func(tx *gorm.DB) error {
+			if err := removePlugin(tx, plugin); err != nil {
+				return err
+			}
+			return p.record(tx, ConfigEntityPlugin, ConfigActionDeleted, plugin.ID, plugin.UserId, plugin, nil)
+		})
+	}
+	return nil
+}
+
+// buildRouteFromSpec validates a route spec and returns the route with its upstream
+// targets and health check
+func buildRouteFromSpec(spec RouteSpec) (Route, []RouteUpstream, RouteHealthCheck, error) {
+	upstreams, err := buildRouteUpstreams(spec.Upstream, spec.Upstreams)
+	if err != nil {
+		return Route{}, nil, RouteHealthCheck{}, err
+	}
+
+	var healthCheck RouteHealthCheck
+	if spec.HealthCheck != nil {
+		if healthCheck, err = buildRouteHealthCheck(*spec.HealthCheck); err != nil {
+			return Route{}, nil, RouteHealthCheck{}, err
+		}
+	}
+
+	loadBalancing := spec.LoadBalancing
+	if loadBalancing == "" {
+		loadBalancing = LoadBalancingRoundRobin
+	}
+
+	route := Route{
+		Path:            spec.Path,
+		Upstream:        upstreams[0].Target,
+		LoadBalancing:   loadBalancing,
+		HashHeader:      spec.HashHeader,
+		UsePathAsPrefix: spec.UsePathAsPrefix,
+	}
+	return route, upstreams, healthCheck, nil
+}
+
+// saveRoutePluginSpecs attaches the named plugins of userId to a route in order, with
+// their per-route envs sealed
+func saveRoutePluginSpecs(tx *gorm.DB, routeID uint, userId string, names []string, envs, stored map[string]string) error {
+	plugins, err := resolvePluginNames(tx.Where("user_id = ?", userId), names)
+	if err != nil {
+		return invalidDocument("%v", err)
+	}
+	if err := replaceRoutePlugins(tx, routeID, plugins); err != nil {
+		return err
+	}
+
+	for _, plugin := range plugins {
+		secret, err := storedSecretFields(tx, plugin.PluginSvcName)
+		if err != nil {
+			return err
+		}
+		sealed, err := sealSecrets(envs[plugin.NamePlugin], stored[plugin.NamePlugin], secret)
+		if err != nil {
+			return invalidDocument("Plugin %s envs: %v", plugin.NamePlugin, err)
+		}
+		err = tx.Model(&RoutePlugin{}).Where("route_id = ? AND plugin_id = ?", routeID, plugin.ID).Update("envs", sealed).Error
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkNotVerifiedByOthers rejects domain names another tenant has already verified
+func checkNotVerifiedByOthers(tx *gorm.DB, names []string, userId string) error {
+	if len(names) == 0 {
+		return nil
+	}
+
+	taken, err := domainNamesVerifiedByOthers(tx, names, userId)
+	if err != nil {
+		return err
+	}
+	if len(taken) > 0 {
+		sort.Strings(taken)
+		return &declarativeError{status: http.StatusConflict, message: "Domain " + strings.Join(taken, ", ") + " is already verified by another user"}
+	}
+	return nil
+}
+
+// storedBefore returns the stored entity as the audit "before" of a change, or nil for creates
+func storedBefore(exists bool, stored interface{}) interface{} {
+	if !exists {
+		return nil
+	}
+	return stored
+}
+
+func configEventAction(existed bool) string {
+	if existed {
+		return ConfigActionUpdated
+	}
+	return ConfigActionCreated
+}
+
+// documentFormat returns "yaml" or "json" from the format query parameter, falling back to
+// the given header (Accept or Content-Type)
+func documentFormat(c *gin.Context, header string) string {
+	format := strings.ToLower(c.Query("format"))
+	if format == "" && strings.Contains(strings.ToLower(c.GetHeader(header)), "yaml") {
+		format = "yaml"
+	}
+	if format == "yaml" || format == "yml" {
+		return "yaml"
+	}
+	return "json"
+}
+
+// readConfigDocument decodes and validates a JSON or YAML document from the request body
+func readConfigDocument(c *gin.Context) (ConfigDocument, error) {
+	var doc ConfigDocument
+
+	body, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, maxConfigDocumentSize))
+	if err != nil {
+		return doc, fmt.Errorf("failed to read document: %v", err)
+	}
+
+	if documentFormat(c, "Content-Type") == "yaml" {
+		var value interface{}
+		if err := yaml.Unmarshal(body, &value); err != nil {
+			return doc, fmt.Errorf("invalid YAML: %v", err)
+		}
+		if body, err = json.Marshal(value); err != nil {
+			return doc, fmt.Errorf("invalid YAML: %v", err)
+		}
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&doc); err != nil {
+		return doc, fmt.Errorf("invalid document: %v", err)
+	}
+
+	if err := binding.Validator.ValidateStruct(&doc); err != nil {
+		return doc, errors.New(formatValidationError(err))
+	}
+	return doc, nil
+}
+
+// writeConfigDocument renders a document as JSON, or as YAML when requested
+func writeConfigDocument(c *gin.Context, doc ConfigDocument) {
+	if documentFormat(c, "Accept") != "yaml" {
+		c.JSON(http.StatusOK, doc)
+		return
+	}
+
+	// Go through JSON so YAML uses the same field names, then drop the JSON flow style
+	encoded, err := json.Marshal(doc)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	var node yaml.Node
+	if err := yaml.Unmarshal(encoded, &node); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	clearYAMLStyle(&node)
+
+	var rendered bytes.Buffer
+	encoder := yaml.NewEncoder(&rendered)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(&node); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.Data(http.StatusOK, "application/yaml; charset=utf-8", rendered.Bytes())
+}
+
+func clearYAMLStyle(node *yaml.Node) {
+	node.Style = 0
+	for _, child := range node.Content {
+		clearYAMLStyle(child)
+	}
+}
+
+// documentUserId returns the tenant an export or import applies to: the caller, or the
+// ?user_id= of an admin
+func documentUserId(c *gin.Context) (string, bool) {
+	userId, ok := ownerUserId(c, c.Query("user_id"))
+	if !ok {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only admins can manage the configuration of other users"})
+	}
+	return userId, ok
+}
+
+// ExportConfig returns the caller's domains, routes and plugins, and every plugin service,
+// as a declarative JSON or YAML document. Secrets are always redacted; they are only
+// decrypted in the /config feed.
+func ExportConfig(c *gin.Context) {
+	userId, ok := documentUserId(c)
+	if !ok {
+		return
+	}
+
+	doc, err := exportConfigDocument(DB, userId)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": formatDatabaseError(err)})
+		return
+	}
+
+	writeConfigDocument(c, doc)
+}
+
+// ImportConfig applies a declarative document in a single transaction, creating or updating
+// the entities it declares. Entities missing from the document are kept.
+func ImportConfig(c *gin.Context) {
+	plan, ok := runConfigDocument(c, false, false, "")
+	if !ok {
+		return
+	}
+
+	plan.publish()
+
+	c.JSON(http.StatusOK, planResponse(plan))
+}
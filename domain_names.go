@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"golang.org/x/net/idna"
+)
+
+// wildcardDomainPrefix marks a domain that matches any single label in its place
+const wildcardDomainPrefix = "*."
+
+// internalTopLevelDomains are special-use and commonly used private suffixes that never name
+// a public domain
+var internalTopLevelDomains = map[string]bool{
+	"arpa": true, "corp": true, "home": true, "internal": true, "intranet": true, "invalid": true,
+	"lan": true, "local": true, "localdomain": true, "localhost": true, "onion": true, "test": true,
+}
+
+// normalizeDomainName validates a domain name and returns it in canonical form: lowercase
+// ASCII (punycode for IDNs) without a trailing dot. Only public names are accepted: at
+// least two labels under a top-level domain that is neither numeric, as in IP addresses,
+// nor internal. A leading "*." label makes it a wildcard.
+func normalizeDomainName(raw string) (string, error) {
+	name := strings.TrimSuffix(strings.TrimSpace(raw), ".")
+
+	wildcard := strings.HasPrefix(name, wildcardDomainPrefix)
+	name = strings.TrimPrefix(name, wildcardDomainPrefix)
+	if strings.Contains(name, "*") {
+		return "", fmt.Errorf("only a single leading * label is allowed in domain names")
+	}
+
+	ascii, err := idna.Lookup.ToASCII(name)
+	if err != nil {
+		return "", fmt.Errorf("domain name %q is not valid: %v", raw, err)
+	}
+	ascii = strings.ToLower(ascii)
+
+	if len(ascii) > 253 {
+		return "", fmt.Errorf("domain name is longer than 253 characters")
+	}
+	labels := strings.Split(ascii, ".")
+	for _, label := range labels {
+		if !isValidDomainLabel(label) {
+			return "", fmt.Errorf("domain name %q is not valid", raw)
+		}
+	}
+
+	if wildcard && len(labels) < 2 {
+		return "", fmt.Errorf("wildcard domains need at least two labels after *.")
+	}
+	tld := labels[len(labels)-1]
+	if len(labels) < 2 || internalTopLevelDomains[tld] || strings.Trim(tld, "0123456789") == "" {
+		return "", fmt.Errorf("domain name %q is not a public domain name", raw)
+	}
+
+	if wildcard {
+		return wildcardDomainPrefix + ascii, nil
+	}
+	return ascii, nil
+}
+
+// isValidDomainLabel reports whether label is a valid LDH hostname label
+func isValidDomainLabel(label string) bool {
+	if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+		return false
+	}
+	for _, r := range label {
+		if !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+// isWildcardDomain reports whether name is a wildcard domain
+func isWildcardDomain(name string) bool {
+	return strings.HasPrefix(name, wildcardDomainPrefix)
+}
+
+// domainBaseName returns the name without its wildcard label
+func domainBaseName(name string) string {
+	return strings.TrimPrefix(name, wildcardDomainPrefix)
+}
+
+// domainMatchOrder sorts domain names in the order the gateway must try them: exact
+// names first, then wildcards from most to least specific. Ties are broken by name.
+func domainMatchOrder(names []string) []string {
+	ordered := append([]string(nil), names...)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		a, b := ordered[i], ordered[j]
+		if isWildcardDomain(a) != isWildcardDomain(b) {
+			return !isWildcardDomain(a)
+		}
+		if labelsA, labelsB := strings.Count(a, "."), strings.Count(b, "."); labelsA != labelsB {
+			return labelsA > labelsB
+		}
+		return a < b
+	})
+	return ordered
+}
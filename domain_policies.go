@@ -0,0 +1,255 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Kinds of domain policy patterns
+const (
+	DomainPolicyExact  = "exact"
+	DomainPolicySuffix = "suffix"
+	DomainPolicyRegex  = "regex"
+)
+
+// Actions of domain policies
+const (
+	DomainPolicyDeny  = "deny"
+	DomainPolicyAllow = "allow"
+)
+
+// defaultDomainPolicies are the reserved names seeded when the policy table is created
+var defaultDomainPolicies = []DomainPolicy{
+	{Pattern: "sidra.id", Kind: DomainPolicyExact, Action: DomainPolicyDeny, Desc: "Reserved platform domain"},
+	{Pattern: "deployaja.id", Kind: DomainPolicyExact, Action: DomainPolicyDeny, Desc: "Reserved platform domain"},
+}
+
+// normalizeDomainPolicy validates a policy pattern for its kind and returns it in canonical form
+func normalizeDomainPolicy(policy *DomainPolicy) error {
+	switch policy.Kind {
+	case DomainPolicyExact:
+		policy.Pattern = strings.ToLower(strings.TrimSpace(policy.Pattern))
+	case DomainPolicySuffix:
+		policy.Pattern = strings.ToLower(strings.TrimSpace(policy.Pattern))
+		if !strings.HasPrefix(policy.Pattern, "*.") || len(policy.Pattern) < 3 {
+			return fmt.Errorf("suffix patterns must look like *.example.com")
+		}
+	case DomainPolicyRegex:
+		if _, err := compileDomainPolicyRegex(policy.Pattern); err != nil {
+			return fmt.Errorf("invalid regex: %v", err)
+		}
+	default:
+		return fmt.Errorf("unknown policy kind %q", policy.Kind)
+	}
+	return nil
+}
+
+// compileDomainPolicyRegex compiles a regex pattern anchored to the whole domain name
+func compileDomainPolicyRegex(pattern string) (*regexp.Regexp, error) {
+	return regexp.Compile("^(?:" + pattern + ")$")
+}
+
+// matches reports whether the policy applies to a lowercase domain name. Suffix patterns
+// match subdomains at any depth but not the apex itself.
+func (p DomainPolicy) matches(name string) bool {
+	switch p.Kind {
+	case DomainPolicyExact:
+		return name == p.Pattern
+	case DomainPolicySuffix:
+		return strings.HasSuffix(name, strings.TrimPrefix(p.Pattern, "*"))
+	case DomainPolicyRegex:
+		re, err := compileDomainPolicyRegex(p.Pattern)
+		return err == nil && re.MatchString(name)
+	}
+	return false
+}
+
+// domainNameAllowed checks a domain name against the policies. A matching allow rule
+// takes precedence over deny rules; names matching no rule are allowed.
+func domainNameAllowed(name string) (bool, error) {
+	var policies []DomainPolicy
+	if err := DB.Find(&policies).Error; err != nil {
+		return false, err
+	}
+
+	name = strings.ToLower(name)
+	denied := false
+	for _, policy := range policies {
+		if !policy.matches(name) {
+			continue
+		}
+		if policy.Action == DomainPolicyAllow {
+			return true, nil
+		}
+		denied = true
+	}
+	return !denied, nil
+}
+
+// checkDomainName writes an error response and returns false when the name is not allowed
+func checkDomainName(c *gin.Context, name string) bool {
+	allowed, err := domainNameAllowed(name)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": formatDatabaseError(err)})
+		return false
+	}
+	if !allowed {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Domain name is not allowed"})
+		return false
+	}
+	return true
+}
+
+// seedDomainPolicies inserts the default reserved names into a newly created policy table
+func seedDomainPolicies() error {
+	policies := make([]DomainPolicy, len(defaultDomainPolicies))
+	copy(policies, defaultDomainPolicies)
+	return DB.Create(&policies).Error
+}
+
+// GetDomainPolicies returns a page of domain policies
+func GetDomainPolicies(c *gin.Context) {
+	params, err := parseListParams(c, domainPolicySortFields)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var policies []DomainPolicy
+	query := DB.Model(&DomainPolicy{})
+
+	// Filter by action if provided
+	if action := c.Query("action"); action != "" {
+		query = query.Where("action = ?", action)
+	}
+
+	total, err := paginate(query, params, &policies)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": formatDatabaseError(err)})
+		return
+	}
+
+	respondList(c, params, policies, total)
+}
+
+// CreateDomainPolicy creates a new domain policy
+func CreateDomainPolicy(c *gin.Context) {
+	var req CreateDomainPolicyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": formatValidationError(err)})
+		return
+	}
+
+	policy := DomainPolicy{
+		Pattern: req.Pattern,
+		Kind:    req.Kind,
+		Action:  req.Action,
+		Desc:    req.Desc,
+	}
+	if policy.Action == "" {
+		policy.Action = DomainPolicyDeny
+	}
+	if err := normalizeDomainPolicy(&policy); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&policy).Error; err != nil {
+			return err
+		}
+		return recordAudit(tx, currentPrincipal(c), AuditEntityDomainPolicy, ConfigActionCreated, policy.ID, "", nil, policy)
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": formatDatabaseError(err)})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"data": policy})
+}
+
+// UpdateDomainPolicy updates an existing domain policy
+func UpdateDomainPolicy(c *gin.Context) {
+	id := c.Param("id")
+	var policy DomainPolicy
+
+	if err := DB.First(&policy, id).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Domain policy not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": formatDatabaseError(err)})
+		return
+	}
+
+	var req UpdateDomainPolicyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": formatValidationError(err)})
+		return
+	}
+	before := policy
+
+	// Update fields if provided
+	if req.Pattern != "" {
+		policy.Pattern = req.Pattern
+	}
+	if req.Kind != "" {
+		policy.Kind = req.Kind
+	}
+	if req.Action != "" {
+		policy.Action = req.Action
+	}
+	if req.Desc != nil {
+		policy.Desc = *req.Desc
+	}
+	if err := normalizeDomainPolicy(&policy); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Save(&policy).Error; err != nil {
+			return err
+		}
+		return recordAudit(tx, currentPrincipal(c), AuditEntityDomainPolicy, ConfigActionUpdated, policy.ID, "", before, policy)
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": formatDatabaseError(err)})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": policy})
+}
+
+// DeleteDomainPolicy deletes a domain policy
+func DeleteDomainPolicy(c *gin.Context) {
+	id := c.Param("id")
+	var policy DomainPolicy
+
+	if err := DB.First(&policy, id).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Domain policy not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": formatDatabaseError(err)})
+		return
+	}
+
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Delete(&policy).Error; err != nil {
+			return err
+		}
+		return recordAudit(tx, currentPrincipal(c), AuditEntityDomainPolicy, ConfigActionDeleted, policy.ID, "", policy, nil)
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": formatDatabaseError(err)})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Domain policy deleted successfully"})
+}
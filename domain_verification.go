@@ -0,0 +1,336 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Verification states of a domain
+const (
+	DomainStatusPending  = "pending"
+	DomainStatusVerified = "verified"
+)
+
+// Methods a domain owner can use to prove ownership
+const (
+	VerificationMethodDNS  = "dns"
+	VerificationMethodHTTP = "http"
+
+	// VerificationMethodManual lets admins mark a domain verified without a check
+	VerificationMethodManual = "manual"
+)
+
+const (
+	// domainVerificationRecordPrefix is prepended to the domain name for the DNS TXT record
+	domainVerificationRecordPrefix = "_pepes-challenge."
+
+	// domainVerificationPath is the well-known HTTP path serving the verification token
+	domainVerificationPath = "/.well-known/pepes-verification.txt"
+
+	// domainVerificationTimeout bounds a single verification attempt
+	domainVerificationTimeout = 10 * time.Second
+)
+
+// DomainVerifier checks that the owner of a domain published its verification token
+type DomainVerifier interface {
+	Verify(ctx context.Context, domain Domain) error
+}
+
+// TXTResolver looks up DNS TXT records; *net.Resolver satisfies it
+type TXTResolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+// dnsDomainVerifier expects the token in a TXT record at _pepes-challenge.<domain>.
+// Wildcard domains are verified on their base name.
+type dnsDomainVerifier struct {
+	resolver TXTResolver
+}
+
+func (v *dnsDomainVerifier) Verify(ctx context.Context, domain Domain) error {
+	name := domainVerificationRecordPrefix + domainBaseName(domain.Name)
+	records, err := v.resolver.LookupTXT(ctx, name)
+	if err != nil {
+		return fmt.Errorf("could not look up TXT records for %s: %v", name, err)
+	}
+	for _, record := range records {
+		if strings.TrimSpace(record) == domain.VerificationToken {
+			return nil
+		}
+	}
+	return fmt.Errorf("no TXT record for %s contains the verification token", name)
+}
+
+// httpDomainVerifier expects the token as the body of http://<domain>/.well-known/pepes-verification.txt.
+// Wildcard domains are verified on their base name.
+type httpDomainVerifier struct {
+	client *http.Client
+}
+
+func (v *httpDomainVerifier) Verify(ctx context.Context, domain Domain) error {
+	url := "http://" + domainBaseName(domain.Name) + domainVerificationPath
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("could not fetch %s: %v", url, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned status %d", url, resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if err != nil {
+		return fmt.Errorf("could not read %s: %v", url, err)
+	}
+	if strings.TrimSpace(string(body)) != domain.VerificationToken {
+		return fmt.Errorf("%s does not contain the verification token", url)
+	}
+	return nil
+}
+
+// errDomainVerifiedByOthers is returned when verifying a name another user verified first
+var errDomainVerifiedByOthers = errors.New("Domain is already verified by another user")
+
+// errNonPublicAddress is returned when a domain being verified resolves to a non-public address
+var errNonPublicAddress = errors.New("refusing to connect to a non-public address")
+
+// newDomainVerificationClient returns the client fetching HTTP verification tokens. Tenants
+// choose the host it connects to, so it only connects to public addresses: every address
+// is checked as it is dialed, after resolution, so DNS rebinding cannot get around it.
+// Proxies and redirects are not followed.
+func newDomainVerificationClient() *http.Client {
+	dialer := &net.Dialer{
+		Timeout: domainVerificationTimeout,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if isPrivateUpstreamHost(host) {
+				return errNonPublicAddress
+			}
+			return nil
+		},
+	}
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext:           dialer.DialContext,
+			TLSHandshakeTimeout:   domainVerificationTimeout,
+			ResponseHeaderTimeout: domainVerificationTimeout,
+			DisableKeepAlives:     true,
+		},
+		Timeout: domainVerificationTimeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// domainVerifiers holds the verifier for each method; tests can replace entries with fakes
+var domainVerifiers = map[string]DomainVerifier{
+	VerificationMethodDNS:  &dnsDomainVerifier{resolver: net.DefaultResolver},
+	VerificationMethodHTTP: &httpDomainVerifier{client: newDomainVerificationClient()},
+}
+
+// generateVerificationToken returns a new random domain verification token
+func generateVerificationToken() (string, error) {
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return "", err
+	}
+	return "pepes-verification=" + hex.EncodeToString(token), nil
+}
+
+// resetDomainVerification marks a domain pending with a fresh verification token
+func resetDomainVerification(domain *Domain) error {
+	token, err := generateVerificationToken()
+	if err != nil {
+		return err
+	}
+	domain.Status = DomainStatusPending
+	domain.VerificationToken = token
+	domain.VerifiedAt = nil
+	return nil
+}
+
+// migrateDomainVerification gives existing domains a verification token. When
+// grandfather is set (the status column was just added) they are also marked verified,
+// so domains created before verification existed keep being served.
+func migrateDomainVerification(grandfather bool) error {
+	if grandfather {
+		if err := DB.Model(&Domain{}).Unscoped().Where("1 = 1").UpdateColumns(map[string]interface{}{
+			"status":      DomainStatusVerified,
+			"verified_at": time.Now(),
+		}).Error; err != nil {
+			return err
+		}
+	}
+
+	var domains []Domain
+	if err := DB.Unscoped().Where("verification_token IS NULL OR verification_token = ''").Find(&domains).Error; err != nil {
+		return err
+	}
+	for _, domain := range domains {
+		token, err := generateVerificationToken()
+		if err != nil {
+			return err
+		}
+		if err := DB.Model(&domain).Unscoped().UpdateColumn("verification_token", token).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// domainNamesVerifiedByOthers returns those of names that another user has verified. Pending
+// claims do not hold a name: it goes to whoever verifies it first.
+func domainNamesVerifiedByOthers(tx *gorm.DB, names []string, userId string) ([]string, error) {
+	var taken []string
+	err := tx.Model(&Domain{}).
+		Where("name IN ? AND user_id <> ? AND status = ?", names, userId, DomainStatusVerified).
+		Pluck("name", &taken).Error
+	return taken, err
+}
+
+// checkDomainNameAvailable writes an error response and returns false when another user
+// has already verified the name
+func checkDomainNameAvailable(c *gin.Context, name, userId string) bool {
+	taken, err := domainNamesVerifiedByOthers(DB, []string{name}, userId)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": formatDatabaseError(err)})
+		return false
+	}
+	if len(taken) > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": errDomainVerifiedByOthers.Error()})
+		return false
+	}
+	return true
+}
+
+// releasePendingDomainClaims deletes the pending claims of other users on the name of a
+// domain that was just verified, so nobody can hold a name they cannot prove they own
+func releasePendingDomainClaims(tx *gorm.DB, principal *Principal, domain Domain) ([]Domain, error) {
+	var claims []Domain
+	err := tx.Where("name = ? AND user_id <> ? AND status = ?", domain.Name, domain.UserId, DomainStatusPending).
+		Find(&claims).Error
+	if err != nil {
+		return nil, err
+	}
+	for _, claim := range claims {
+		if err := removeDomain(tx, claim); err != nil {
+			return nil, err
+		}
+		if err := recordAudit(tx, principal, ConfigEntityDomain, ConfigActionDeleted, claim.ID, claim.UserId, claim, nil); err != nil {
+			return nil, err
+		}
+	}
+	return claims, nil
+}
+
+// VerifyDomain checks ownership of a domain using the method from the request body
+// and marks it verified so it is published in the gateway config. Pending claims of other
+// users on the same name are released.
+func VerifyDomain(c *gin.Context) {
+	id := c.Param("id")
+	var domain Domain
+
+	if err := scopeDomains(c, DB).First(&domain, id).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Domain not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": formatDatabaseError(err)})
+		return
+	}
+
+	var req VerifyDomainRequest
+	if err := c.ShouldBindJSON(&req); err != nil && err != io.EOF {
+		c.JSON(http.StatusBadRequest, gin.H{"error": formatValidationError(err)})
+		return
+	}
+	if req.Method == "" {
+		req.Method = VerificationMethodDNS
+	}
+
+	if domain.Status == DomainStatusVerified {
+		c.JSON(http.StatusOK, gin.H{"data": domain})
+		return
+	}
+
+	if req.Method == VerificationMethodManual {
+		if !currentPrincipal(c).IsAdmin() {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Only admins can verify domains manually"})
+			return
+		}
+	} else {
+		ctx, cancel := context.WithTimeout(c.Request.Context(), domainVerificationTimeout)
+		defer cancel()
+
+		if err := domainVerifiers[req.Method].Verify(ctx, domain); err != nil {
+			// The cause stays in the log: for HTTP it would tell tenants what the API host can reach
+			log.Printf("Verification of domain %s with %s failed: %v", domain.Name, req.Method, err)
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error":              "Domain verification failed: verification token not found",
+				"verification_token": domain.VerificationToken,
+			})
+			return
+		}
+	}
+
+	before := domain
+	now := time.Now()
+	domain.Status = DomainStatusVerified
+	domain.VerifiedAt = &now
+	var released []Domain
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		taken, err := domainNamesVerifiedByOthers(tx, []string{domain.Name}, domain.UserId)
+		if err != nil {
+			return err
+		}
+		if len(taken) > 0 {
+			return errDomainVerifiedByOthers
+		}
+		if err := tx.Save(&domain).Error; err != nil {
+			return err
+		}
+		if err := recordAudit(tx, currentPrincipal(c), ConfigEntityDomain, ConfigActionUpdated, domain.ID, domain.UserId, before, domain); err != nil {
+			return err
+		}
+		released, err = releasePendingDomainClaims(tx, currentPrincipal(c), domain)
+		return err
+	})
+	if err == errDomainVerifiedByOthers {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": formatDatabaseError(err)})
+		return
+	}
+
+	publishConfigChange(ConfigEntityDomain, ConfigActionUpdated, domain.ID, domain.UserId, domain)
+	for _, claim := range released {
+		publishConfigChange(ConfigEntityDomain, ConfigActionDeleted, claim.ID, claim.UserId, claim)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": domain})
+}
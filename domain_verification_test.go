@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// fakeTXTResolver serves TXT records from a map instead of DNS
+type fakeTXTResolver map[string][]string
+
+func (r fakeTXTResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	records, ok := r[name]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	return records, nil
+}
+
+// useDomainVerifier replaces the verifier of method for the duration of the test
+func useDomainVerifier(t *testing.T, method string, verifier DomainVerifier) {
+	t.Helper()
+	previous := domainVerifiers[method]
+	domainVerifiers[method] = verifier
+	t.Cleanup(func() { domainVerifiers[method] = previous })
+}
+
+func TestDNSDomainVerifier(t *testing.T) {
+	const token = "pepes-verification=abc123"
+	resolver := fakeTXTResolver{
+		"_pepes-challenge.example.com": {"v=spf1 -all", " " + token + " "},
+		"_pepes-challenge.other.com":   {"pepes-verification=someone-else"},
+	}
+	verifier := &dnsDomainVerifier{resolver: resolver}
+
+	for _, tc := range []struct {
+		domain string
+		ok     bool
+	}{
+		{"example.com", true},
+		{"*.example.com", true},
+		{"other.com", false},
+		{"missing.com", false},
+	} {
+		err := verifier.Verify(context.Background(), Domain{Name: tc.domain, VerificationToken: token})
+		if (err == nil) != tc.ok {
+			t.Errorf("Verify(%s) = %v, want ok %v", tc.domain, err, tc.ok)
+		}
+	}
+}
+
+func TestHTTPDomainVerifier(t *testing.T) {
+	const token = "pepes-verification=abc123"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != domainVerificationPath {
+			http.NotFound(w, r)
+			return
+		}
+		switch r.Host {
+		case "example.com":
+			fmt.Fprintln(w, token)
+		case "redirect.com":
+			http.Redirect(w, r, "http://example.com"+domainVerificationPath, http.StatusFound)
+		default:
+			fmt.Fprint(w, "pepes-verification=someone-else")
+		}
+	}))
+	defer server.Close()
+
+	// Send every request to the test server whatever the host
+	transport := &http.Transport{DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return (&net.Dialer{}).DialContext(ctx, network, server.Listener.Addr().String())
+	}}
+	client := &http.Client{
+		Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	verifier := &httpDomainVerifier{client: client}
+
+	for _, tc := range []struct {
+		domain string
+		ok     bool
+	}{
+		{"example.com", true},
+		{"*.example.com", true},
+		{"other.com", false},
+		{"redirect.com", false},
+	} {
+		err := verifier.Verify(context.Background(), Domain{Name: tc.domain, VerificationToken: token})
+		if (err == nil) != tc.ok {
+			t.Errorf("Verify(%s) = %v, want ok %v", tc.domain, err, tc.ok)
+		}
+	}
+}
+
+func TestDomainVerificationClientRefusesNonPublicAddresses(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "pepes-verification=abc123")
+	}))
+	defer server.Close()
+
+	_, err := newDomainVerificationClient().Get(server.URL + domainVerificationPath)
+	if !errors.Is(err, errNonPublicAddress) {
+		t.Errorf("fetching from %s = %v, want %v", server.URL, err, errNonPublicAddress)
+	}
+}
+
+func TestNormalizeDomainNameRequiresPublicNames(t *testing.T) {
+	for _, name := range []string{"localhost", "metadata", "*.localhost", "db.internal", "printer.local", "10.0.0.1", "169.254.169.254"} {
+		if normalized, err := normalizeDomainName(name); err == nil {
+			t.Errorf("normalizeDomainName(%s) = %s, want an error", name, normalized)
+		}
+	}
+	for _, name := range []string{"example.com", "*.example.com", "api.example.co.uk"} {
+		if _, err := normalizeDomainName(name); err != nil {
+			t.Errorf("normalizeDomainName(%s): %v", name, err)
+		}
+	}
+}
+
+func TestVerifyDomainPublishesVerifiedDomains(t *testing.T) {
+	openTestDatabase(t)
+
+	resolver := fakeTXTResolver{}
+	useDomainVerifier(t, VerificationMethodDNS, &dnsDomainVerifier{resolver: resolver})
+
+	domain := Domain{Name: "shop.example.com", UserId: "alice"}
+	if err := resetDomainVerification(&domain); err != nil {
+		t.Fatal(err)
+	}
+	mustCreate(t, &domain)
+	mustCreate(t, &Route{DomainID: domain.ID, Path: "/", Upstream: "http://10.0.0.1:8080", LoadBalancing: LoadBalancingRoundRobin})
+
+	alice := &Principal{UserId: "alice", Role: RoleUser}
+	path := fmt.Sprintf("/domains/%d/verify", domain.ID)
+	verify := func() (int, string) {
+		w := serveAs(t, alice, VerifyDomain, http.MethodPost, "/domains/:id/verify", path, `{"method":"dns"}`)
+		return w.Code, w.Body.String()
+	}
+	published := func() bool {
+		config, err := buildConfig("alice", false)
+		if err != nil {
+			t.Fatalf("buildConfig: %v", err)
+		}
+		_, ok := config.Domains[domain.Name]
+		return ok
+	}
+
+	if code, body := verify(); code != http.StatusBadRequest || !strings.Contains(body, domain.VerificationToken) {
+		t.Fatalf("verify without a TXT record = %d %s, want 400 with the token", code, body)
+	} else if strings.Contains(body, "no such host") {
+		t.Errorf("verify leaked the lookup error: %s", body)
+	}
+	if published() {
+		t.Fatal("pending domains must not be published")
+	}
+
+	resolver["_pepes-challenge.shop.example.com"] = []string{domain.VerificationToken}
+	if code, body := verify(); code != http.StatusOK {
+		t.Fatalf("verify with the TXT record = %d %s, want 200", code, body)
+	}
+
+	var stored Domain
+	if err := DB.First(&stored, domain.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if stored.Status != DomainStatusVerified || stored.VerifiedAt == nil {
+		t.Errorf("domain status = %s, verified at %v", stored.Status, stored.VerifiedAt)
+	}
+	if !published() {
+		t.Error("verified domains must be published")
+	}
+}
+
+func TestVerifyDomainManualRequiresAdmin(t *testing.T) {
+	openTestDatabase(t)
+
+	domain := Domain{Name: "manual.example.com", UserId: "alice"}
+	if err := resetDomainVerification(&domain); err != nil {
+		t.Fatal(err)
+	}
+	mustCreate(t, &domain)
+	path := fmt.Sprintf("/domains/%d/verify", domain.ID)
+
+	w := serveAs(t, &Principal{UserId: "alice", Role: RoleUser}, VerifyDomain, http.MethodPost, "/domains/:id/verify", path, `{"method":"manual"}`)
+	expectStatus(t, w, http.StatusForbidden)
+
+	w = serveAs(t, &Principal{UserId: "root", Role: RoleAdmin}, VerifyDomain, http.MethodPost, "/domains/:id/verify", path, `{"method":"manual"}`)
+	expectStatus(t, w, http.StatusOK)
+}
+
+func TestVerifyDomainReleasesPendingClaims(t *testing.T) {
+	openTestDatabase(t)
+
+	resolver := fakeTXTResolver{}
+	useDomainVerifier(t, VerificationMethodDNS, &dnsDomainVerifier{resolver: resolver})
+
+	// Both users claim the name; only bob can publish the token
+	var claims []Domain
+	for _, userId := range []string{"alice", "bob"} {
+		domain := Domain{Name: "contested.example.com", UserId: userId}
+		if err := resetDomainVerification(&domain); err != nil {
+			t.Fatal(err)
+		}
+		mustCreate(t, &domain)
+		claims = append(claims, domain)
+	}
+	alice, bob := claims[0], claims[1]
+	resolver["_pepes-challenge.contested.example.com"] = []string{bob.VerificationToken}
+
+	w := serveAs(t, &Principal{UserId: "bob", Role: RoleUser}, VerifyDomain, http.MethodPost, "/domains/:id/verify",
+		fmt.Sprintf("/domains/%d/verify", bob.ID), `{"method":"dns"}`)
+	expectStatus(t, w, http.StatusOK)
+
+	if err := DB.First(&Domain{}, alice.ID).Error; err == nil {
+		t.Error("alice's pending claim survived bob's verification")
+	}
+
+	// The name is now taken for alice
+	w = serveAs(t, &Principal{UserId: "alice", Role: RoleUser}, CreateDomain, http.MethodPost, "/domains", "/domains",
+		`{"name":"contested.example.com"}`)
+	expectStatus(t, w, http.StatusConflict)
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-contrib/sse"
+	"github.com/gin-gonic/gin"
+)
+
+// Entities and actions reported in configuration change events
+const (
+	ConfigEntityDomain        = "domain"
+	ConfigEntityRoute         = "route"
+	ConfigEntityPlugin        = "plugin"
+	ConfigEntityPluginService = "plugin_service"
+	ConfigEntityCertificate   = "certificate"
+
+	ConfigActionCreated = "created"
+	ConfigActionUpdated = "updated"
+	ConfigActionDeleted = "deleted"
+
+	// configActionResync tells subscribers to reload the full config because
+	// the revision moved without a local event (e.g. a change on another replica)
+	configActionResync = "resync"
+)
+
+const (
+	// configStreamBuffer is the number of events buffered per subscriber before it is dropped
+	configStreamBuffer = 64
+
+	// configStreamKeepAlive is the interval between keep-alive comments on idle streams
+	configStreamKeepAlive = 15 * time.Second
+)
+
+// ConfigChangeEvent describes a single change to the gateway configuration
+type ConfigChangeEvent struct {
+	Revision uint64      `json:"revision"`
+	Entity   string      `json:"entity"`
+	Action   string      `json:"action"`
+	ID       uint        `json:"id"`
+	Data     interface{} `json:"data,omitempty"`
+
+	// owner is the user owning the changed entity; "" means visible to everyone
+	owner string
+}
+
+// configEventHub fans out configuration change events to stream subscribers
+type configEventHub struct {
+	mu           sync.Mutex
+	subscribers  map[chan ConfigChangeEvent]struct{}
+	lastRevision uint64
+}
+
+var configEvents = &configEventHub{subscribers: make(map[chan ConfigChangeEvent]struct{})}
+
+// subscribe registers a new subscriber and returns its channel and an unsubscribe func
+func (h *configEventHub) subscribe() (<-chan ConfigChangeEvent, func()) {
+	ch := make(chan ConfigChangeEvent, configStreamBuffer)
+
+	h.mu.Lock()
+	h.subscribers[ch] = struct{}{}
+	h.mu.Unlock()
+
+	return ch, func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		if _, ok := h.subscribers[ch]; ok {
+			delete(h.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// broadcast delivers an event to all subscribers, dropping those that fall behind
+func (h *configEventHub) broadcast(event ConfigChangeEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if event.Revision > h.lastRevision {
+		h.lastRevision = event.Revision
+	}
+
+	for ch := range h.subscribers {
+		select {
+		case ch <- event:
+		default:
+			// Slow subscriber: disconnect it so it reconnects and gets a fresh snapshot
+			delete(h.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// catchUp asks subscribers to resync when the revision moved past the last broadcast event
+func (h *configEventHub) catchUp(revision uint64) {
+	h.mu.Lock()
+	behind := revision > h.lastRevision
+	h.mu.Unlock()
+
+	if behind {
+		h.broadcast(ConfigChangeEvent{Revision: revision, Action: configActionResync})
+	}
+}
+
+// publishConfigChange bumps the config revision and notifies stream subscribers.
+// owner is the user owning the entity, so events are only streamed to that tenant and admins.
+func publishConfigChange(entity, action string, id uint, owner string, data interface{}) {
+	revision, ok := bumpConfigRevision()
+	if !ok {
+		return
+	}
+
+	configEvents.broadcast(ConfigChangeEvent{
+		Revision: revision,
+		Entity:   entity,
+		Action:   action,
+		ID:       id,
+		Data:     data,
+		owner:    owner,
+	})
+}
+
+// StreamConfig streams the configuration as Server-Sent Events: a full "config" event
+// on connect followed by "<entity>.<action>" events for every change visible to the caller
+func StreamConfig(c *gin.Context) {
+	userId := scopeUserId(c)
+	reveal := canRevealSecrets(c)
+
+	events, unsubscribe := configEvents.subscribe()
+	defer unsubscribe()
+
+	revision, err := currentConfigRevision()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": formatDatabaseError(err)})
+		return
+	}
+
+	config, err := buildConfig(userId, reveal)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": formatDatabaseError(err)})
+		return
+	}
+
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no")
+	c.Header("X-Config-Version", strconv.FormatUint(revision, 10))
+	c.Render(-1, sse.Event{
+		Id:    strconv.FormatUint(revision, 10),
+		Event: "config",
+		Data:  config,
+	})
+	c.Writer.Flush()
+
+	keepAlive := time.NewTicker(configStreamKeepAlive)
+	defer keepAlive.Stop()
+
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case <-c.Request.Context().Done():
+			return false
+
+		case <-keepAlive.C:
+			_, err := io.WriteString(w, ": keep-alive\n\n")
+			return err == nil
+
+		case event, ok := <-events:
+			if !ok {
+				return false
+			}
+			// Skip events already reflected in what the client has seen
+			if event.Revision <= revision {
+				return true
+			}
+			revision = event.Revision
+
+			if event.Action == configActionResync {
+				config, err := buildConfig(userId, reveal)
+				if err != nil {
+					log.Printf("Failed to build config for stream: %v", err)
+					return false
+				}
+				c.Render(-1, sse.Event{
+					Id:    strconv.FormatUint(revision, 10),
+					Event: "config",
+					Data:  config,
+				})
+				return true
+			}
+
+			// Only stream changes to entities owned by the caller (or shared ones)
+			if userId != "" && event.owner != "" && event.owner != userId {
+				return true
+			}
+
+			c.Render(-1, sse.Event{
+				Id:    strconv.FormatUint(revision, 10),
+				Event: event.Entity + "." + event.Action,
+				Data:  event,
+			})
+			return true
+		}
+	})
+}
@@ -1,12 +1,14 @@
 package main
 
 import (
+	"errors"
+	"fmt"
 	"net/http"
 	"strconv"
 	"strings"
-	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
 	"github.com/go-playground/validator/v10"
 	"gorm.io/gorm"
 )
@@ -36,6 +38,21 @@ func formatValidationError(err error) string {
 				messages = append(messages, field+" must contain only letters")
 			case "alphanum":
 				messages = append(messages, field+" must contain only letters and numbers")
+			case "upstream":
+				messages = append(messages, field+" must be an http, https or h2c URL with a host and optional port and path (e.g. http://svc:8080)")
+			case "upstream_policy":
+				messages = append(messages, field+" must not point to a private or loopback address")
+			case "required_if":
+				condition := strings.Fields(fieldError.Param())
+				if len(condition) == 2 {
+					messages = append(messages, field+" is required when "+getFieldDisplayName(condition[0])+" is "+condition[1])
+				} else {
+					messages = append(messages, field+" is required")
+				}
+			case "startswith":
+				messages = append(messages, field+" must start with "+fieldError.Param())
+			case "oneof":
+				messages = append(messages, field+" must be one of: "+strings.ReplaceAll(fieldError.Param(), " ", ", "))
 			default:
 				messages = append(messages, field+" failed validation: "+tag)
 			}
@@ -47,6 +64,18 @@ func formatValidationError(err error) string {
 	return err.Error()
 }
 
+// registerValidators registers the custom binding tags used by the request structs
+func registerValidators() error {
+	v, ok := binding.Validator.Engine().(*validator.Validate)
+	if !ok {
+		return fmt.Errorf("unexpected validator engine %T", binding.Validator.Engine())
+	}
+	if err := v.RegisterValidation("upstream", validateUpstreamTag); err != nil {
+		return err
+	}
+	return v.RegisterValidation("upstream_policy", validateUpstreamPolicyTag)
+}
+
 // formatDatabaseError converts database errors to human-readable messages
 func formatDatabaseError(err error) string {
 	if err == gorm.ErrRecordNotFound {
@@ -79,16 +108,37 @@ func formatDatabaseError(err error) string {
 // getFieldDisplayName converts struct field names to user-friendly display names
 func getFieldDisplayName(field string) string {
 	fieldMap := map[string]string{
-		"Path":          "Path",
-		"Upstream":      "Upstream URL",
-		"Plugin":        "Plugin",
-		"DomainID":      "Domain ID",
-		"Name":          "Name",
-		"NamePlugin":    "Plugin Name",
-		"PluginSvcName": "Plugin Service Name",
-		"Envs":          "Environment Variables",
-		"Desc":          "Description",
-		"BaseConfig":    "Base Configuration",
+		"Path":               "Path",
+		"Upstream":           "Upstream URL",
+		"Upstreams":          "Upstreams",
+		"Target":             "Upstream target",
+		"Weight":             "Weight",
+		"LoadBalancing":      "Load balancing",
+		"HashHeader":         "Hash header",
+		"HealthCheck":        "Health check",
+		"IntervalSeconds":    "Health check interval",
+		"TimeoutSeconds":     "Health check timeout",
+		"HealthyThreshold":   "Healthy threshold",
+		"UnhealthyThreshold": "Unhealthy threshold",
+		"EjectionSeconds":    "Ejection duration",
+		"Plugin":             "Plugin",
+		"Plugins":            "Plugins",
+		"PluginID":           "Plugin ID",
+		"Position":           "Position",
+		"DomainID":           "Domain ID",
+		"Name":               "Name",
+		"NamePlugin":         "Plugin Name",
+		"PluginSvcName":      "Plugin Service Name",
+		"Envs":               "Environment Variables",
+		"Desc":               "Description",
+		"BaseConfig":         "Base Configuration",
+		"UserId":             "User ID",
+		"Pattern":            "Pattern",
+		"Certificate":        "Certificate",
+		"PrivateKey":         "Private key",
+		"Kind":               "Kind",
+		"Action":             "Action",
+		"ExpiresInDays":      "Expires In Days",
 	}
 
 	if displayName, exists := fieldMap[field]; exists {
@@ -99,10 +149,21 @@ func getFieldDisplayName(field string) string {
 	return strings.Title(strings.ToLower(field))
 }
 
-// GetRoutes returns all routes with optional filtering
+// preloadRouteDetails preloads a route's plugins, upstream targets and health check
+func preloadRouteDetails(db *gorm.DB) *gorm.DB {
+	return preloadRouteUpstreams(preloadRoutePlugins(db)).Preload("HealthCheck")
+}
+
+// GetRoutes returns a page of routes with optional filtering and sorting
 func GetRoutes(c *gin.Context) {
+	params, err := parseListParams(c, routeSortFields)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
 	var routes []Route
-	query := DB.Preload("Domain")
+	query := scopeRoutes(c, DB.Model(&Route{}))
 
 	// Filter by domain if provided
 	if domainID := c.Query("domain_id"); domainID != "" {
@@ -116,15 +177,15 @@ func GetRoutes(c *gin.Context) {
 		query = query.Where("path LIKE ?", "%"+path+"%")
 	}
 
-	if err := query.Find(&routes).Error; err != nil {
+	total, err := paginate(query, params, &routes, func(db *gorm.DB) *gorm.DB {
+		return preloadRouteDetails(db.Preload("Domain"))
+	})
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": formatDatabaseError(err)})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{
-		"data":  routes,
-		"count": len(routes),
-	})
+	respondList(c, params, routes, total)
 }
 
 // GetRoute returns a single route by ID
@@ -132,7 +193,7 @@ func GetRoute(c *gin.Context) {
 	id := c.Param("id")
 	var route Route
 
-	if err := DB.Preload("Domain").First(&route, id).Error; err != nil {
+	if err := scopeRoutes(c, preloadRouteDetails(DB.Preload("Domain"))).First(&route, id).Error; err != nil {
 		if err == gorm.ErrRecordNotFound {
 			c.JSON(http.StatusNotFound, gin.H{"error": "Route not found"})
 			return
@@ -152,41 +213,39 @@ func CreateRoute(c *gin.Context) {
 		return
 	}
 
-	// Check if domain exists
-	var domain Domain
-	if err := DB.First(&domain, req.DomainID).Error; err != nil {
-		if err == gorm.ErrRecordNotFound {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Domain not found"})
-			return
-		}
-		c.JSON(http.StatusInternalServerError, gin.H{"error": formatDatabaseError(err)})
+	write, err := prepareRouteCreate(c, DB, req)
+	if err != nil {
+		respondRouteWriteError(c, err)
 		return
 	}
 
-	route := Route{
-		Path:            req.Path,
-		Upstream:        req.Upstream,
-		Plugin:          req.Plugin,
-		DomainID:        req.DomainID,
-		UsePathAsPrefix: req.UsePathAsPrefix,
-	}
-
-	if err := DB.Create(&route).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": formatDatabaseError(err)})
+	policy := shadowPolicy(c)
+	var warnings []RouteConflict
+	var route Route
+	err = DB.Transaction(func(tx *gorm.DB) error {
+		var err error
+		if warnings, err = write.save(tx, policy); err != nil {
+			return err
+		}
+		route, err = auditRoute(tx, currentPrincipal(c), ConfigActionCreated, write.route.ID, nil)
+		return err
+	})
+	if err != nil {
+		respondRouteWriteError(c, err)
 		return
 	}
 
-	// Load the domain relationship
-	DB.Preload("Domain").First(&route, route.ID)
+	publishConfigChange(ConfigEntityRoute, ConfigActionCreated, route.ID, route.Domain.UserId, route)
 
-	c.JSON(http.StatusCreated, gin.H{"data": route})
+	c.JSON(http.StatusCreated, routeWriteResponse(route, warnings))
 }
 
-func UpdateRoutePlugin(c *gin.Context) {
+// UpdateRoute updates an existing route
+func UpdateRoute(c *gin.Context) {
 	id := c.Param("id")
 	var route Route
 
-	if err := DB.First(&route, id).Error; err != nil {
+	if err := scopeRoutes(c, DB).First(&route, id).Error; err != nil {
 		if err == gorm.ErrRecordNotFound {
 			c.JSON(http.StatusNotFound, gin.H{"error": "Route not found"})
 			return
@@ -195,78 +254,206 @@ func UpdateRoutePlugin(c *gin.Context) {
 		return
 	}
 
-	var req UpdateRoutePluginRequest
+	var req UpdateRouteRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": formatValidationError(err)})
 		return
 	}
 
-	if req.Plugins != nil {
-		route.Plugin = *req.Plugins
+	write, err := prepareRouteUpdate(c, DB, route, req)
+	if err != nil {
+		respondRouteWriteError(c, err)
+		return
 	}
 
-	if err := DB.Save(&route).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": formatDatabaseError(err)})
+	policy := shadowPolicy(c)
+	var warnings []RouteConflict
+	err = DB.Transaction(func(tx *gorm.DB) error {
+		before, err := loadRouteSnapshot(tx, route.ID)
+		if err != nil {
+			return err
+		}
+		if warnings, err = write.save(tx, policy); err != nil {
+			return err
+		}
+		route, err = auditRoute(tx, currentPrincipal(c), ConfigActionUpdated, route.ID, before)
+		return err
+	})
+	if err != nil {
+		respondRouteWriteError(c, err)
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"data": route})
+	publishConfigChange(ConfigEntityRoute, ConfigActionUpdated, route.ID, route.Domain.UserId, route)
+
+	c.JSON(http.StatusOK, routeWriteResponse(route, warnings))
 }
 
-// UpdateRoute updates an existing route
-func UpdateRoute(c *gin.Context) {
-	id := c.Param("id")
-	var route Route
+// routeWrite is a validated route create or update, ready to be saved
+type routeWrite struct {
+	route Route
 
-	if err := DB.First(&route, id).Error; err != nil {
+	// nil keeps what is stored; creates always set all three
+	upstreams   []RouteUpstream
+	healthCheck *RouteHealthCheck
+	plugins     *[]Plugin
+}
+
+// prepareRouteCreate validates a create request against the caller's domains and plugins in db
+func prepareRouteCreate(c *gin.Context, db *gorm.DB, req CreateRouteRequest) (*routeWrite, error) {
+	// Check if domain exists and belongs to the caller
+	var domain Domain
+	if err := scopeDomains(c, db).First(&domain, req.DomainID).Error; err != nil {
 		if err == gorm.ErrRecordNotFound {
-			c.JSON(http.StatusNotFound, gin.H{"error": "Route not found"})
-			return
+			return nil, &routeRequestError{status: http.StatusBadRequest, message: "Domain not found"}
 		}
-		c.JSON(http.StatusInternalServerError, gin.H{"error": formatDatabaseError(err)})
-		return
+		return nil, err
 	}
 
-	var req UpdateRouteRequest
-	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": formatValidationError(err)})
-		return
+	names, err := legacyRoutePlugins(req.Plugin, &req.Plugins)
+	if err != nil {
+		return nil, err
+	}
+	plugins, err := resolvePluginNames(ownedPlugins(db, domain.UserId), *names)
+	if err != nil {
+		return nil, err
+	}
+
+	upstreams, err := buildRouteUpstreams(req.Upstream, req.Upstreams)
+	if err != nil {
+		return nil, &routeRequestError{status: http.StatusBadRequest, message: err.Error()}
+	}
+
+	loadBalancing := req.LoadBalancing
+	if loadBalancing == "" {
+		loadBalancing = LoadBalancingRoundRobin
 	}
 
+	var healthCheck RouteHealthCheck
+	if req.HealthCheck != nil {
+		if healthCheck, err = buildRouteHealthCheck(*req.HealthCheck); err != nil {
+			return nil, &routeRequestError{status: http.StatusBadRequest, message: err.Error()}
+		}
+	}
+
+	return &routeWrite{
+		route: Route{
+			Path:            req.Path,
+			Upstream:        upstreams[0].Target,
+			LoadBalancing:   loadBalancing,
+			HashHeader:      req.HashHeader,
+			DomainID:        req.DomainID,
+			UsePathAsPrefix: req.UsePathAsPrefix,
+		},
+		upstreams:   upstreams,
+		healthCheck: &healthCheck,
+		plugins:     &plugins,
+	}, nil
+}
+
+// prepareRouteUpdate applies an update request to a stored route, checking the caller's
+// domains and plugins in db
+func prepareRouteUpdate(c *gin.Context, db *gorm.DB, route Route, req UpdateRouteRequest) (*routeWrite, error) {
+	write := &routeWrite{}
+
 	// Update fields if provided
 	if req.Path != "" {
 		route.Path = req.Path
 	}
-	if req.Upstream != "" {
-		route.Upstream = req.Upstream
+	// Upstream targets are replaced when either upstream or upstreams is provided
+	if req.Upstream != "" || req.Upstreams != nil {
+		var targets []UpstreamTargetRequest
+		if req.Upstreams != nil {
+			targets = *req.Upstreams
+		}
+		upstreams, err := buildRouteUpstreams(req.Upstream, targets)
+		if err != nil {
+			return nil, &routeRequestError{status: http.StatusBadRequest, message: err.Error()}
+		}
+		route.Upstream = upstreams[0].Target
+		write.upstreams = upstreams
+	}
+	if req.LoadBalancing != "" {
+		route.LoadBalancing = req.LoadBalancing
+	}
+	if req.HashHeader != nil {
+		route.HashHeader = *req.HashHeader
+	}
+	if route.LoadBalancing == LoadBalancingConsistentHash && route.HashHeader == "" {
+		return nil, &routeRequestError{status: http.StatusBadRequest, message: "Hash header is required when Load balancing is consistent_hash"}
 	}
-	// For plugin field, update if provided (allows clearing by setting to empty string)
-	if req.Plugin != nil {
-		route.Plugin = *req.Plugin
+	// The health check is replaced as a whole when provided
+	if req.HealthCheck != nil {
+		healthCheck, err := buildRouteHealthCheck(*req.HealthCheck)
+		if err != nil {
+			return nil, &routeRequestError{status: http.StatusBadRequest, message: err.Error()}
+		}
+		write.healthCheck = &healthCheck
 	}
 	if req.DomainID != 0 {
-		// Check if new domain exists
+		// Check if new domain exists and belongs to the caller
 		var domain Domain
-		if err := DB.First(&domain, req.DomainID).Error; err != nil {
+		if err := scopeDomains(c, db).First(&domain, req.DomainID).Error; err != nil {
 			if err == gorm.ErrRecordNotFound {
-				c.JSON(http.StatusBadRequest, gin.H{"error": "Domain not found"})
-				return
+				return nil, &routeRequestError{status: http.StatusBadRequest, message: "Domain not found"}
 			}
-			c.JSON(http.StatusInternalServerError, gin.H{"error": formatDatabaseError(err)})
-			return
+			return nil, err
 		}
 		route.DomainID = req.DomainID
 	}
-
-	if err := DB.Save(&route).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": formatDatabaseError(err)})
-		return
+	// For plugins, replace the attached list if provided (allows clearing with an empty list)
+	names, err := legacyRoutePlugins(req.Plugin, req.Plugins)
+	if err != nil {
+		return nil, err
+	}
+	if names != nil {
+		// Plugins belong to the owner of the route's domain
+		var owner string
+		if err := db.Model(&Domain{}).Where("id = ?", route.DomainID).Pluck("user_id", &owner).Error; err != nil {
+			return nil, err
+		}
+		plugins, err := resolvePluginNames(ownedPlugins(db, owner), *names)
+		if err != nil {
+			return nil, err
+		}
+		write.plugins = &plugins
 	}
 
-	// Load the domain relationship
-	DB.Preload("Domain").First(&route, route.ID)
+	write.route = route
+	return write, nil
+}
 
-	c.JSON(http.StatusOK, gin.H{"data": route})
+// save checks the route for conflicts and writes it with its upstream targets, health check
+// and plugins, returning shadowing warnings
+func (w *routeWrite) save(tx *gorm.DB, policy string) ([]RouteConflict, error) {
+	warnings, err := checkRouteConflicts(tx, w.route, policy)
+	if err != nil {
+		return nil, err
+	}
+	if w.route.ID == 0 {
+		err = tx.Create(&w.route).Error
+	} else {
+		err = tx.Save(&w.route).Error
+	}
+	if err != nil {
+		return nil, err
+	}
+	if w.upstreams != nil {
+		if err := replaceRouteUpstreams(tx, w.route.ID, w.upstreams); err != nil {
+			return nil, err
+		}
+	}
+	if w.healthCheck != nil {
+		if err := saveRouteHealthCheck(tx, w.route.ID, *w.healthCheck); err != nil {
+			return nil, err
+		}
+	}
+	if w.plugins != nil {
+		if err := replaceRoutePlugins(tx, w.route.ID, *w.plugins); err != nil {
+			return nil, err
+		}
+	}
+	return warnings, nil
 }
 
 // DeleteRoute deletes a route
@@ -274,7 +461,7 @@ func DeleteRoute(c *gin.Context) {
 	id := c.Param("id")
 	var route Route
 
-	if err := DB.First(&route, id).Error; err != nil {
+	if err := scopeRoutes(c, DB.Preload("Domain")).First(&route, id).Error; err != nil {
 		if err == gorm.ErrRecordNotFound {
 			c.JSON(http.StatusNotFound, gin.H{"error": "Route not found"})
 			return
@@ -283,33 +470,65 @@ func DeleteRoute(c *gin.Context) {
 		return
 	}
 
-	if err := DB.Delete(&route).Error; err != nil {
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		before, err := loadRouteSnapshot(tx, route.ID)
+		if err != nil {
+			return err
+		}
+		if err := removeRoute(tx, route); err != nil {
+			return err
+		}
+		return recordAudit(tx, currentPrincipal(c), ConfigEntityRoute, ConfigActionDeleted, route.ID, route.Domain.UserId, before, nil)
+	})
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": formatDatabaseError(err)})
 		return
 	}
 
+	publishConfigChange(ConfigEntityRoute, ConfigActionDeleted, route.ID, route.Domain.UserId, route)
+
 	c.JSON(http.StatusOK, gin.H{"message": "Route deleted successfully"})
 }
 
-// GetDomains returns all domains
+// removeRoute deletes a route with its plugin attachments, upstream targets and health check
+func removeRoute(tx *gorm.DB, route Route) error {
+	if err := tx.Where("route_id = ?", route.ID).Delete(&RoutePlugin{}).Error; err != nil {
+		return err
+	}
+	if err := tx.Where("route_id = ?", route.ID).Delete(&RouteUpstream{}).Error; err != nil {
+		return err
+	}
+	if err := tx.Where("route_id = ?", route.ID).Delete(&RouteHealthCheck{}).Error; err != nil {
+		return err
+	}
+	return tx.Delete(&route).Error
+}
+
+// GetDomains returns a page of domains with optional filtering and sorting
 func GetDomains(c *gin.Context) {
+	params, err := parseListParams(c, domainSortFields)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
 	var domains []Domain
-	query := DB.Preload("Routes")
+	query := scopeDomains(c, DB.Model(&Domain{}))
 
 	// Filter by name if provided
 	if name := c.Query("name"); name != "" {
 		query = query.Where("name LIKE ?", "%"+name+"%")
 	}
 
-	if err := query.Find(&domains).Error; err != nil {
+	total, err := paginate(query, params, &domains, func(db *gorm.DB) *gorm.DB {
+		return db.Preload("Routes")
+	})
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": formatDatabaseError(err)})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{
-		"data":  domains,
-		"count": len(domains),
-	})
+	respondList(c, params, domains, total)
 }
 
 // GetDomain returns a single domain by ID
@@ -317,7 +536,7 @@ func GetDomain(c *gin.Context) {
 	id := c.Param("id")
 	var domain Domain
 
-	if err := DB.Preload("Routes").First(&domain, id).Error; err != nil {
+	if err := scopeDomains(c, DB.Preload("Routes")).First(&domain, id).Error; err != nil {
 		if err == gorm.ErrRecordNotFound {
 			c.JSON(http.StatusNotFound, gin.H{"error": "Domain not found"})
 			return
@@ -337,22 +556,49 @@ func CreateDomain(c *gin.Context) {
 		return
 	}
 
-	// Check if domain name is forbidden
-	if req.Name == "sidra.id" || req.Name == "deployaja.id" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Domain name is not allowed"})
+	name, err := normalizeDomainName(req.Name)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Check if domain name is forbidden by the domain policies
+	if !checkDomainName(c, name) {
+		return
+	}
+
+	userId, ok := ownerUserId(c, req.UserId)
+	if !ok {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only admins can create domains for other users"})
+		return
+	}
+	if !checkDomainNameAvailable(c, name, userId) {
 		return
 	}
 
 	domain := Domain{
-		Name:   req.Name,
-		UserId: req.UserId,
+		Name:    name,
+		UserId:  userId,
+		AutoTLS: req.AutoTLS,
+	}
+	if err := resetDomainVerification(&domain); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate verification token"})
+		return
 	}
 
-	if err := DB.Create(&domain).Error; err != nil {
+	err = DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&domain).Error; err != nil {
+			return err
+		}
+		return recordAudit(tx, currentPrincipal(c), ConfigEntityDomain, ConfigActionCreated, domain.ID, domain.UserId, nil, domain)
+	})
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": formatDatabaseError(err)})
 		return
 	}
 
+	publishConfigChange(ConfigEntityDomain, ConfigActionCreated, domain.ID, domain.UserId, domain)
+
 	c.JSON(http.StatusCreated, gin.H{"data": domain})
 }
 
@@ -361,7 +607,7 @@ func UpdateDomain(c *gin.Context) {
 	id := c.Param("id")
 	var domain Domain
 
-	if err := DB.First(&domain, id).Error; err != nil {
+	if err := scopeDomains(c, DB).First(&domain, id).Error; err != nil {
 		if err == gorm.ErrRecordNotFound {
 			c.JSON(http.StatusNotFound, gin.H{"error": "Domain not found"})
 			return
@@ -375,16 +621,43 @@ func UpdateDomain(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": formatValidationError(err)})
 		return
 	}
+	before := domain
 
+	// A renamed domain has to be verified again
 	if req.Name != "" {
-		domain.Name = req.Name
+		name, err := normalizeDomainName(req.Name)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if name != domain.Name {
+			if !checkDomainName(c, name) || !checkDomainNameAvailable(c, name, domain.UserId) {
+				return
+			}
+			domain.Name = name
+			if err := resetDomainVerification(&domain); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate verification token"})
+				return
+			}
+		}
+	}
+	if req.AutoTLS != nil {
+		domain.AutoTLS = *req.AutoTLS
 	}
 
-	if err := DB.Save(&domain).Error; err != nil {
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Save(&domain).Error; err != nil {
+			return err
+		}
+		return recordAudit(tx, currentPrincipal(c), ConfigEntityDomain, ConfigActionUpdated, domain.ID, domain.UserId, before, domain)
+	})
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": formatDatabaseError(err)})
 		return
 	}
 
+	publishConfigChange(ConfigEntityDomain, ConfigActionUpdated, domain.ID, domain.UserId, domain)
+
 	c.JSON(http.StatusOK, gin.H{"data": domain})
 }
 
@@ -393,7 +666,7 @@ func DeleteDomain(c *gin.Context) {
 	id := c.Param("id")
 	var domain Domain
 
-	if err := DB.Preload("Routes").First(&domain, id).Error; err != nil {
+	if err := scopeDomains(c, DB.Preload("Routes")).First(&domain, id).Error; err != nil {
 		if err == gorm.ErrRecordNotFound {
 			c.JSON(http.StatusNotFound, gin.H{"error": "Domain not found"})
 			return
@@ -402,26 +675,63 @@ func DeleteDomain(c *gin.Context) {
 		return
 	}
 
-	// Delete associated routes first
-	if len(domain.Routes) > 0 {
-		if err := DB.Delete(&domain.Routes).Error; err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": formatDatabaseError(err)})
-			return
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		if err := removeDomain(tx, domain); err != nil {
+			return err
 		}
-	}
-
-	if err := DB.Delete(&domain).Error; err != nil {
+		return recordAudit(tx, currentPrincipal(c), ConfigEntityDomain, ConfigActionDeleted, domain.ID, domain.UserId, domain, nil)
+	})
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": formatDatabaseError(err)})
 		return
 	}
 
+	publishConfigChange(ConfigEntityDomain, ConfigActionDeleted, domain.ID, domain.UserId, domain)
+
 	c.JSON(http.StatusOK, gin.H{"message": "Domain and associated routes deleted successfully"})
 }
 
-// GetPlugins returns all plugins with optional filtering
+// removeDomain deletes a domain with its certificate and its routes, along with their
+// plugin attachments, upstream targets and health checks
+func removeDomain(tx *gorm.DB, domain Domain) error {
+	var routes []Route
+	if err := tx.Where("domain_id = ?", domain.ID).Find(&routes).Error; err != nil {
+		return err
+	}
+	if len(routes) > 0 {
+		routeIDs := make([]uint, 0, len(routes))
+		for _, route := range routes {
+			routeIDs = append(routeIDs, route.ID)
+		}
+		if err := tx.Where("route_id IN ?", routeIDs).Delete(&RoutePlugin{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("route_id IN ?", routeIDs).Delete(&RouteUpstream{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("route_id IN ?", routeIDs).Delete(&RouteHealthCheck{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Delete(&routes).Error; err != nil {
+			return err
+		}
+	}
+	if err := tx.Where("domain_id = ?", domain.ID).Delete(&Certificate{}).Error; err != nil {
+		return err
+	}
+	return tx.Delete(&domain).Error
+}
+
+// GetPlugins returns a page of plugins with optional filtering and sorting
 func GetPlugins(c *gin.Context) {
+	params, err := parseListParams(c, pluginSortFields)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
 	var plugins []Plugin
-	query := DB
+	query := scopePlugins(c, DB.Model(&Plugin{}))
 
 	// Filter by name_plugin if provided
 	if namePlugin := c.Query("name_plugin"); namePlugin != "" {
@@ -433,15 +743,13 @@ func GetPlugins(c *gin.Context) {
 		query = query.Where("plugin_svc_name LIKE ?", "%"+pluginSvcName+"%")
 	}
 
-	if err := query.Find(&plugins).Error; err != nil {
+	total, err := paginate(query, params, &plugins)
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": formatDatabaseError(err)})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{
-		"data":  plugins,
-		"count": len(plugins),
-	})
+	respondList(c, params, plugins, total)
 }
 
 // GetPlugin returns a single plugin by ID
@@ -449,7 +757,7 @@ func GetPlugin(c *gin.Context) {
 	id := c.Param("id")
 	var plugin Plugin
 
-	if err := DB.First(&plugin, id).Error; err != nil {
+	if err := scopePlugins(c, DB).First(&plugin, id).Error; err != nil {
 		if err == gorm.ErrRecordNotFound {
 			c.JSON(http.StatusNotFound, gin.H{"error": "Plugin not found"})
 			return
@@ -469,19 +777,44 @@ func CreatePlugin(c *gin.Context) {
 		return
 	}
 
+	userId, ok := ownerUserId(c, req.UserId)
+	if !ok {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only admins can create plugins for other users"})
+		return
+	}
+
+	pluginService, ok := checkPluginEnvs(c, req.PluginSvcName, req.Envs)
+	if !ok {
+		return
+	}
+
+	envs, err := sealSecrets(req.Envs, "", pluginServiceSecretFields(pluginService.Schema))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Environment Variables: " + err.Error()})
+		return
+	}
+
 	plugin := Plugin{
 		NamePlugin:    req.NamePlugin,
 		PluginSvcName: req.PluginSvcName,
-		Envs:          req.Envs,
+		Envs:          envs,
 		Desc:          req.Desc,
-		UserId:        req.UserId,
+		UserId:        userId,
 	}
 
-	if err := DB.Create(&plugin).Error; err != nil {
+	err = DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&plugin).Error; err != nil {
+			return err
+		}
+		return recordAudit(tx, currentPrincipal(c), ConfigEntityPlugin, ConfigActionCreated, plugin.ID, plugin.UserId, nil, plugin)
+	})
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": formatDatabaseError(err)})
 		return
 	}
 
+	publishConfigChange(ConfigEntityPlugin, ConfigActionCreated, plugin.ID, plugin.UserId, plugin)
+
 	c.JSON(http.StatusCreated, gin.H{"data": plugin})
 }
 
@@ -490,7 +823,7 @@ func UpdatePlugin(c *gin.Context) {
 	id := c.Param("id")
 	var plugin Plugin
 
-	if err := DB.First(&plugin, id).Error; err != nil {
+	if err := scopePlugins(c, DB).First(&plugin, id).Error; err != nil {
 		if err == gorm.ErrRecordNotFound {
 			c.JSON(http.StatusNotFound, gin.H{"error": "Plugin not found"})
 			return
@@ -504,6 +837,23 @@ func UpdatePlugin(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": formatValidationError(err)})
 		return
 	}
+	before := plugin
+
+	// Validate the resulting envs whenever the envs or the service they target change
+	var pluginService PluginService
+	if req.PluginSvcName != "" || req.Envs != "" {
+		pluginSvcName, envs := plugin.PluginSvcName, configForValidation(plugin.Envs)
+		if req.PluginSvcName != "" {
+			pluginSvcName = req.PluginSvcName
+		}
+		if req.Envs != "" {
+			envs = req.Envs
+		}
+		var ok bool
+		if pluginService, ok = checkPluginEnvs(c, pluginSvcName, envs); !ok {
+			return
+		}
+	}
 
 	// Update fields if provided
 	if req.NamePlugin != "" {
@@ -512,18 +862,36 @@ func UpdatePlugin(c *gin.Context) {
 	if req.PluginSvcName != "" {
 		plugin.PluginSvcName = req.PluginSvcName
 	}
-	if req.Envs != "" {
-		plugin.Envs = req.Envs
+	// Re-seal stored envs too, since the new service may declare other fields writeOnly
+	if req.PluginSvcName != "" || req.Envs != "" {
+		envs := req.Envs
+		if envs == "" {
+			envs = plugin.Envs
+		}
+		sealed, err := sealSecrets(envs, plugin.Envs, pluginServiceSecretFields(pluginService.Schema))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Environment Variables: " + err.Error()})
+			return
+		}
+		plugin.Envs = sealed
 	}
 	if req.Desc != "" {
 		plugin.Desc = req.Desc
 	}
 
-	if err := DB.Save(&plugin).Error; err != nil {
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Save(&plugin).Error; err != nil {
+			return err
+		}
+		return recordAudit(tx, currentPrincipal(c), ConfigEntityPlugin, ConfigActionUpdated, plugin.ID, plugin.UserId, before, plugin)
+	})
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": formatDatabaseError(err)})
 		return
 	}
 
+	publishConfigChange(ConfigEntityPlugin, ConfigActionUpdated, plugin.ID, plugin.UserId, plugin)
+
 	c.JSON(http.StatusOK, gin.H{"data": plugin})
 }
 
@@ -532,7 +900,7 @@ func DeletePlugin(c *gin.Context) {
 	id := c.Param("id")
 	var plugin Plugin
 
-	if err := DB.First(&plugin, id).Error; err != nil {
+	if err := scopePlugins(c, DB).First(&plugin, id).Error; err != nil {
 		if err == gorm.ErrRecordNotFound {
 			c.JSON(http.StatusNotFound, gin.H{"error": "Plugin not found"})
 			return
@@ -541,112 +909,105 @@ func DeletePlugin(c *gin.Context) {
 		return
 	}
 
-	if err := DB.Delete(&plugin).Error; err != nil {
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		if err := removePlugin(tx, plugin); err != nil {
+			return err
+		}
+		return recordAudit(tx, currentPrincipal(c), ConfigEntityPlugin, ConfigActionDeleted, plugin.ID, plugin.UserId, plugin, nil)
+	})
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": formatDatabaseError(err)})
 		return
 	}
 
+	publishConfigChange(ConfigEntityPlugin, ConfigActionDeleted, plugin.ID, plugin.UserId, plugin)
+
 	c.JSON(http.StatusOK, gin.H{"message": "Plugin deleted successfully"})
 }
 
-// GetConfig returns the configuration in the format expected by the original response.go
-func GetConfig(c *gin.Context) {
-	var domains []Domain
-	if err := DB.Preload("Routes").Find(&domains).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": formatDatabaseError(err)})
-		return
+// removePlugin deletes a plugin after detaching it from every route using it
+func removePlugin(tx *gorm.DB, plugin Plugin) error {
+	if err := tx.Where("plugin_id = ?", plugin.ID).Delete(&RoutePlugin{}).Error; err != nil {
+		return err
 	}
+	return tx.Delete(&plugin).Error
+}
 
-	// Convert to the expected format
-	config := ConfigResponse{
-		Domains: make(map[string]DomainConfig),
+// GetConfig returns the configuration in the format expected by the original response.go.
+// The config revision is exposed as ETag and X-Config-Version; clients may send If-None-Match
+// to get a 304, or wait=30s&since=<rev> to long-poll until the revision moves past since.
+// The revision is global, so a tenant's long-poll also returns on other tenants' changes,
+// and a 304 only means that nothing changed for anyone. The response depends on the
+// credentials, so shared caches must not store it.
+func GetConfig(c *gin.Context) {
+	wait, err := parseConfigWait(c.Query("wait"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
 	}
 
-	for _, domain := range domains {
-		domainConfig := DomainConfig{
-			Routes: []RouteConfig{}, // Initialize as empty slice
+	known, hasKnown := parseConfigETag(c.GetHeader("If-None-Match"))
+	if since := c.Query("since"); since != "" {
+		known, err = strconv.ParseUint(since, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "since must be a config revision number"})
+			return
 		}
+		hasKnown = true
+	}
 
-		// Filter out soft-deleted routes and collect valid ones
-		var validRoutes []RouteConfig
-		for _, route := range domain.Routes {
-			// Skip soft-deleted routes
-			if route.DeletedAt.Valid {
-				continue
-			}
+	revision, err := currentConfigRevision()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": formatDatabaseError(err)})
+		return
+	}
 
-			var filteredPlugins []PluginData
-			if route.Plugin != "" {
-				var listPlugins []Plugin
-				if err := DB.Find(&listPlugins).Error; err != nil {
-					c.JSON(http.StatusInternalServerError, gin.H{"error": formatDatabaseError(err)})
-					return
-				}
+	if hasKnown && wait > 0 && revision == known {
+		revision = waitForConfigChange(c.Request.Context(), known, wait)
+	}
 
-				for _, plugin := range listPlugins {
-					// Skip soft-deleted plugins
-					if plugin.DeletedAt.Valid {
-						continue
-					}
-					if strings.Contains(route.Plugin, plugin.NamePlugin) {
-						// Convert Plugin to PluginData
-						var deletedAt *string
-						if plugin.DeletedAt.Valid {
-							deletedAtStr := plugin.DeletedAt.Time.Format(time.RFC3339)
-							deletedAt = &deletedAtStr
-						}
-
-						pluginData := PluginData{
-							ID:            int(plugin.ID),
-							NamePlugin:    plugin.NamePlugin,
-							PluginSvcName: plugin.PluginSvcName,
-							Envs:          plugin.Envs,
-							Desc:          plugin.Desc,
-							CreatedAt:     plugin.CreatedAt.Format(time.RFC3339),
-							UpdatedAt:     plugin.UpdatedAt.Format(time.RFC3339),
-							DeletedAt:     deletedAt,
-						}
-						filteredPlugins = append(filteredPlugins, pluginData)
-					}
-				}
-			}
+	c.Header("ETag", formatConfigETag(revision))
+	c.Header("X-Config-Version", strconv.FormatUint(revision, 10))
+	c.Header("Vary", "Authorization, X-API-Key")
+	c.Header("Cache-Control", "private")
 
-			routeConfig := RouteConfig{
-				Path:            route.Path,
-				Upstream:        route.Upstream,
-				Plugin:          route.Plugin,
-				UsePathAsPrefix: route.UsePathAsPrefix,
-				PluginsData:     filteredPlugins,
-			}
-			validRoutes = append(validRoutes, routeConfig)
-		}
+	if hasKnown && revision == known {
+		c.Status(http.StatusNotModified)
+		return
+	}
 
-		domainConfig.Routes = validRoutes
-		config.Domains[domain.Name] = domainConfig
+	config, err := buildConfig(scopeUserId(c), canRevealSecrets(c))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": formatDatabaseError(err)})
+		return
 	}
 
 	c.JSON(http.StatusOK, config)
 }
 
-// GetPluginServices returns all plugin services with optional filtering
+// GetPluginServices returns a page of plugin services with optional filtering and sorting
 func GetPluginServices(c *gin.Context) {
+	params, err := parseListParams(c, pluginServiceSortFields)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
 	var pluginServices []PluginService
-	query := DB
+	query := DB.Model(&PluginService{})
 
 	// Filter by name if provided
 	if name := c.Query("name"); name != "" {
 		query = query.Where("name LIKE ?", "%"+name+"%")
 	}
 
-	if err := query.Find(&pluginServices).Error; err != nil {
+	total, err := paginate(query, params, &pluginServices)
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": formatDatabaseError(err)})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{
-		"data":  pluginServices,
-		"count": len(pluginServices),
-	})
+	respondList(c, params, pluginServices, total)
 }
 
 // GetPluginService returns a single plugin service by ID
@@ -674,20 +1035,58 @@ func CreatePluginService(c *gin.Context) {
 		return
 	}
 
+	if !checkPluginServiceConfig(c, req.Schema, req.BaseConfig) {
+		return
+	}
+
+	baseConfig, err := sealSecrets(req.BaseConfig, "", pluginServiceSecretFields(req.Schema))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Base Configuration: " + err.Error()})
+		return
+	}
+
 	pluginService := PluginService{
 		Name:       req.Name,
-		BaseConfig: req.BaseConfig,
+		BaseConfig: baseConfig,
+		Schema:     req.Schema,
 	}
 
-	if err := DB.Create(&pluginService).Error; err != nil {
+	err = DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&pluginService).Error; err != nil {
+			return err
+		}
+		return recordAudit(tx, currentPrincipal(c), ConfigEntityPluginService, ConfigActionCreated, pluginService.ID, "", nil, pluginService)
+	})
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": formatDatabaseError(err)})
 		return
 	}
+	cacheSecretFields(pluginService)
+
+	publishConfigChange(ConfigEntityPluginService, ConfigActionCreated, pluginService.ID, "", pluginService)
 
 	c.JSON(http.StatusCreated, gin.H{"data": pluginService})
 }
 
-// UpdatePluginService updates an existing plugin service
+// errPluginServiceInUse is returned when deleting or renaming a plugin service that plugins
+// still reference by name
+var errPluginServiceInUse = errors.New("Plugin service is used by plugins")
+
+// checkPluginServiceUnused returns errPluginServiceInUse while any plugin references the
+// plugin service named name
+func checkPluginServiceUnused(tx *gorm.DB, name string) error {
+	var count int64
+	if err := tx.Model(&Plugin{}).Where("plugin_svc_name = ?", name).Count(&count).Error; err != nil {
+		return err
+	}
+	if count > 0 {
+		return errPluginServiceInUse
+	}
+	return nil
+}
+
+// UpdatePluginService updates an existing plugin service. It cannot be renamed while plugins
+// use it.
 func UpdatePluginService(c *gin.Context) {
 	id := c.Param("id")
 	var pluginService PluginService
@@ -706,24 +1105,80 @@ func UpdatePluginService(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": formatValidationError(err)})
 		return
 	}
+	before := pluginService
+
+	if req.Schema != "" || req.BaseConfig != "" {
+		schema, baseConfig := pluginService.Schema, configForValidation(pluginService.BaseConfig)
+		if req.Schema != "" {
+			schema = req.Schema
+		}
+		if req.BaseConfig != "" {
+			baseConfig = req.BaseConfig
+		}
+		if !checkPluginServiceConfig(c, schema, baseConfig) {
+			return
+		}
+	}
 
 	// Update fields if provided
 	if req.Name != "" {
 		pluginService.Name = req.Name
 	}
-	if req.BaseConfig != "" {
-		pluginService.BaseConfig = req.BaseConfig
+	if req.Schema != "" {
+		pluginService.Schema = req.Schema
+	}
+	// Re-seal the stored base config too, since the new schema may declare other fields writeOnly
+	if req.Schema != "" || req.BaseConfig != "" {
+		baseConfig := req.BaseConfig
+		if baseConfig == "" {
+			baseConfig = pluginService.BaseConfig
+		}
+		sealed, err := sealSecrets(baseConfig, pluginService.BaseConfig, pluginServiceSecretFields(pluginService.Schema))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Base Configuration: " + err.Error()})
+			return
+		}
+		pluginService.BaseConfig = sealed
 	}
 
-	if err := DB.Save(&pluginService).Error; err != nil {
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		if pluginService.Name != before.Name {
+			if err := checkPluginServiceUnused(tx, before.Name); err != nil {
+				return err
+			}
+		}
+		if err := tx.Save(&pluginService).Error; err != nil {
+			return err
+		}
+		// Reject changes that would invalidate the envs of plugins using the service
+		if req.Schema != "" || req.BaseConfig != "" {
+			if err := revalidateServicePlugins(tx, pluginService); err != nil {
+				return err
+			}
+		}
+		return recordAudit(tx, currentPrincipal(c), ConfigEntityPluginService, ConfigActionUpdated, pluginService.ID, "", before, pluginService)
+	})
+	if err == errPluginServiceInUse {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	if validationErr, ok := err.(*configValidationError); ok {
+		respondConfigValidationError(c, validationErr)
+		return
+	}
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": formatDatabaseError(err)})
 		return
 	}
+	secretFieldsCache.Delete(before.Name)
+	cacheSecretFields(pluginService)
+
+	publishConfigChange(ConfigEntityPluginService, ConfigActionUpdated, pluginService.ID, "", pluginService)
 
 	c.JSON(http.StatusOK, gin.H{"data": pluginService})
 }
 
-// DeletePluginService deletes a plugin service
+// DeletePluginService deletes a plugin service that no plugin uses
 func DeletePluginService(c *gin.Context) {
 	id := c.Param("id")
 	var pluginService PluginService
@@ -737,10 +1192,25 @@ func DeletePluginService(c *gin.Context) {
 		return
 	}
 
-	if err := DB.Delete(&pluginService).Error; err != nil {
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		if err := checkPluginServiceUnused(tx, pluginService.Name); err != nil {
+			return err
+		}
+		if err := tx.Delete(&pluginService).Error; err != nil {
+			return err
+		}
+		return recordAudit(tx, currentPrincipal(c), ConfigEntityPluginService, ConfigActionDeleted, pluginService.ID, "", pluginService, nil)
+	})
+	if err == errPluginServiceInUse {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": formatDatabaseError(err)})
 		return
 	}
 
+	publishConfigChange(ConfigEntityPluginService, ConfigActionDeleted, pluginService.ID, "", pluginService)
+
 	c.JSON(http.StatusOK, gin.H{"message": "Plugin service deleted successfully"})
 }
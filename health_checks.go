@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+
+	"gorm.io/gorm"
+)
+
+// Defaults applied to health check settings left empty in a request
+const (
+	defaultHealthCheckPath               = "/"
+	defaultHealthCheckIntervalSeconds    = 10
+	defaultHealthCheckTimeoutSeconds     = 2
+	defaultHealthCheckHealthyThreshold   = 2
+	defaultHealthCheckUnhealthyThreshold = 3
+	defaultPassiveUnhealthyThreshold     = 5
+	defaultPassiveEjectionSeconds        = 30
+)
+
+// buildRouteHealthCheck validates a health check request and fills in defaults
+func buildRouteHealthCheck(req HealthCheckRequest) (RouteHealthCheck, error) {
+	var check RouteHealthCheck
+
+	if active := req.Active; active != nil {
+		check.Active = ActiveHealthCheck{
+			Enabled:            active.Enabled,
+			Path:               active.Path,
+			IntervalSeconds:    active.IntervalSeconds,
+			TimeoutSeconds:     active.TimeoutSeconds,
+			HealthyThreshold:   active.HealthyThreshold,
+			UnhealthyThreshold: active.UnhealthyThreshold,
+		}
+	}
+	if check.Active.Path == "" {
+		check.Active.Path = defaultHealthCheckPath
+	}
+	if check.Active.IntervalSeconds == 0 {
+		check.Active.IntervalSeconds = defaultHealthCheckIntervalSeconds
+	}
+	if check.Active.TimeoutSeconds == 0 {
+		check.Active.TimeoutSeconds = defaultHealthCheckTimeoutSeconds
+	}
+	if check.Active.HealthyThreshold == 0 {
+		check.Active.HealthyThreshold = defaultHealthCheckHealthyThreshold
+	}
+	if check.Active.UnhealthyThreshold == 0 {
+		check.Active.UnhealthyThreshold = defaultHealthCheckUnhealthyThreshold
+	}
+	// A disabled active check is never run, so its timings do not matter
+	if check.Active.Enabled && check.Active.TimeoutSeconds >= check.Active.IntervalSeconds {
+		return check, fmt.Errorf("health check timeout must be shorter than its interval")
+	}
+
+	if passive := req.Passive; passive != nil {
+		check.Passive = PassiveHealthCheck{
+			Enabled:            passive.Enabled,
+			UnhealthyThreshold: passive.UnhealthyThreshold,
+			EjectionSeconds:    passive.EjectionSeconds,
+		}
+	}
+	if check.Passive.UnhealthyThreshold == 0 {
+		check.Passive.UnhealthyThreshold = defaultPassiveUnhealthyThreshold
+	}
+	if check.Passive.EjectionSeconds == 0 {
+		check.Passive.EjectionSeconds = defaultPassiveEjectionSeconds
+	}
+
+	return check, nil
+}
+
+// saveRouteHealthCheck replaces the health check of a route. A check with neither
+// active nor passive checking enabled removes it.
+func saveRouteHealthCheck(tx *gorm.DB, routeID uint, check RouteHealthCheck) error {
+	if err := tx.Where("route_id = ?", routeID).Delete(&RouteHealthCheck{}).Error; err != nil {
+		return err
+	}
+	if !check.Active.Enabled && !check.Passive.Enabled {
+		return nil
+	}
+
+	check.ID = 0
+	check.RouteID = routeID
+	return tx.Create(&check).Error
+}
+
+// newHealthCheckConfig converts a route health check to the config emitted for the
+// gateway, leaving out disabled parts
+func newHealthCheckConfig(check RouteHealthCheck) *HealthCheckConfig {
+	config := &HealthCheckConfig{}
+	if check.Active.Enabled {
+		active := check.Active
+		config.Active = &active
+	}
+	if check.Passive.Enabled {
+		passive := check.Passive
+		config.Passive = &passive
+	}
+	if config.Active == nil && config.Passive == nil {
+		return nil
+	}
+	return config
+}
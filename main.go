@@ -1,9 +1,11 @@
 package main
 
 import (
+	"context"
 	"log"
 	"net/http"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/gin-contrib/cors"
@@ -16,6 +18,21 @@ func Run() {
 		log.Fatalf("Database initialization failed: %v", err)
 	}
 
+	if !secretsEncryptionConfigured() {
+		log.Println("Warning: PEPES_ENCRYPTION_KEY is not set, plugin secrets are stored in plaintext")
+	}
+
+	// Keep the config revision in sync with changes made by other replicas
+	go watchConfigRevision(context.Background())
+
+	// Delete audit events past AUDIT_RETENTION_DAYS
+	go runAuditRetention(context.Background())
+
+	// Order and renew certificates for auto_tls domains
+	if acmeEnabled() {
+		go runACMERenewals(context.Background())
+	}
+
 	// Set Gin mode
 	mode := os.Getenv("GIN_MODE")
 	if mode == "" {
@@ -23,67 +40,138 @@ func Run() {
 	}
 	gin.SetMode(mode)
 
+	if err := registerValidators(); err != nil {
+		log.Fatalf("Failed to register validators: %v", err)
+	}
+
 	r := gin.Default()
 
-	// Configure CORS
+	// Configure CORS. Credentials are only allowed for an explicit list of origins.
 	corsConfig := cors.Config{
-		AllowOrigins:     []string{"*"}, // Allow all origins - you can restrict this to specific domains
-		AllowMethods:     []string{"GET", "POST", "PUT", "PATCH", "DELETE", "HEAD", "OPTIONS"},
-		AllowHeaders:     []string{"Origin", "Content-Length", "Content-Type", "Authorization", "Accept", "X-Requested-With"},
-		ExposeHeaders:    []string{"Content-Length"},
-		AllowCredentials: true,
-		MaxAge:           12 * time.Hour,
+		AllowMethods:  []string{"GET", "POST", "PUT", "PATCH", "DELETE", "HEAD", "OPTIONS"},
+		AllowHeaders:  []string{"Origin", "Content-Length", "Content-Type", "Authorization", "Accept", "X-Requested-With", "If-None-Match", "X-API-Key"},
+		ExposeHeaders: []string{"Content-Length", "ETag", "X-Config-Version", "Link", "X-Total-Count"},
+		MaxAge:        12 * time.Hour,
+	}
+	if origins := getEnv("CORS_ALLOWED_ORIGINS", ""); origins != "" {
+		for _, origin := range strings.Split(origins, ",") {
+			corsConfig.AllowOrigins = append(corsConfig.AllowOrigins, strings.TrimSpace(origin))
+		}
+		corsConfig.AllowCredentials = true
+	} else {
+		corsConfig.AllowAllOrigins = true
 	}
 	r.Use(cors.New(corsConfig))
 
+	if len(adminTokens()) == 0 {
+		log.Println("Warning: ADMIN_TOKENS is not set; only API keys can authenticate")
+	}
+
+	// Health check (unauthenticated)
+	r.GET("/healthz", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"status": "ok"})
+	})
+
+	// ACME HTTP-01 challenges, proxied here by the gateway for every domain
+	r.GET("/.well-known/acme-challenge/:token", ServeACMEChallenge)
+
+	// Everything else requires authentication
+	api := r.Group("", AuthMiddleware())
+
 	// Routes for domains
-	domains := r.Group("/domains")
+	domains := api.Group("/domains")
 	{
 		domains.GET("", GetDomains)
 		domains.POST("", CreateDomain)
 		domains.GET(":id", GetDomain)
 		domains.PUT(":id", UpdateDomain)
 		domains.DELETE(":id", DeleteDomain)
+		domains.GET(":id/route-conflicts", GetDomainRouteConflicts)
+		domains.POST(":id/verify", VerifyDomain)
+		domains.GET(":id/certificate", GetDomainCertificate)
+		domains.PUT(":id/certificate", PutDomainCertificate)
+		domains.DELETE(":id/certificate", DeleteDomainCertificate)
+		domains.POST(":id/certificate/acme", IssueDomainCertificate)
 	}
 
 	// Routes for routes
-	routes := r.Group("/routes")
+	routes := api.Group("/routes")
 	{
 		routes.GET("", GetRoutes)
 		routes.POST("", CreateRoute)
+		routes.POST("bulk", BulkRoutes)
 		routes.GET(":id", GetRoute)
 		routes.PUT(":id", UpdateRoute)
 		routes.DELETE(":id", DeleteRoute)
-		routes.PUT(":id/plugins", UpdateRoutePlugin)
+		routes.GET(":id/plugins", GetRoutePlugins)
+		routes.POST(":id/plugins", AttachRoutePlugin)
+		routes.PUT(":id/plugins", ReorderRoutePlugins)
+		routes.PUT(":id/plugins/:plugin_id", UpdateRoutePlugin)
+		routes.DELETE(":id/plugins/:plugin_id", DetachRoutePlugin)
 	}
 
 	// Routes for plugins
-	plugins := r.Group("/plugins")
+	plugins := api.Group("/plugins")
 	{
 		plugins.GET("", GetPlugins)
 		plugins.POST("", CreatePlugin)
 		plugins.GET(":id", GetPlugin)
+		plugins.GET(":id/effective-config", GetPluginEffectiveConfig)
 		plugins.PUT(":id", UpdatePlugin)
 		plugins.DELETE(":id", DeletePlugin)
 	}
 
 	// Routes for plugin services
-	pluginServices := r.Group("/plugin-services")
+	pluginServices := api.Group("/plugin-services")
 	{
 		pluginServices.GET("", GetPluginServices)
-		pluginServices.POST("", CreatePluginService)
 		pluginServices.GET(":id", GetPluginService)
-		pluginServices.PUT(":id", UpdatePluginService)
-		pluginServices.DELETE(":id", DeletePluginService)
+
+		// Plugin services are shared by every tenant, so only admins can change them
+		pluginServices.POST("", RequireAdmin(), CreatePluginService)
+		pluginServices.PUT(":id", RequireAdmin(), UpdatePluginService)
+		pluginServices.DELETE(":id", RequireAdmin(), DeletePluginService)
 	}
 
-	// Config endpoint (GET)
-	r.GET("/config", GetConfig)
+	// Routes for certificates
+	certificates := api.Group("/certificates")
+	{
+		certificates.GET("", GetCertificates)
+		certificates.GET("expiring", GetExpiringCertificates)
 
-	// Health check
-	r.GET("/healthz", func(c *gin.Context) {
-		c.JSON(http.StatusOK, gin.H{"status": "ok"})
-	})
+		// Private keys are only handed out to the gateway's admin credentials
+		certificates.GET(":id/bundle", RequireAdmin(), GetCertificateBundle)
+	}
+
+	// Routes for domain policies, which apply to every tenant
+	domainPolicies := api.Group("/domain-policies", RequireAdmin())
+	{
+		domainPolicies.GET("", GetDomainPolicies)
+		domainPolicies.POST("", CreateDomainPolicy)
+		domainPolicies.PUT(":id", UpdateDomainPolicy)
+		domainPolicies.DELETE(":id", DeleteDomainPolicy)
+	}
+
+	// Routes for API keys
+	apiKeys := api.Group("/api-keys")
+	{
+		apiKeys.GET("", GetAPIKeys)
+		apiKeys.POST("", CreateAPIKey)
+		apiKeys.DELETE(":id", RevokeAPIKey)
+	}
+
+	// Audit log of configuration changes
+	api.GET("/audit", GetAuditEvents)
+
+	// Config endpoints (GET)
+	api.GET("/config", GetConfig)
+	api.GET("/config/stream", StreamConfig)
+
+	// Declarative configuration, matched by natural keys instead of IDs
+	api.GET("/export", ExportConfig)
+	api.POST("/import", ImportConfig)
+	api.POST("/plan", PlanConfig)
+	api.POST("/apply", ApplyConfig)
 
 	// Start server
 	port := os.Getenv("API_PORT")
@@ -97,5 +185,27 @@ func Run() {
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		runCommand(os.Args[1])
+		return
+	}
 	Run()
 }
+
+// runCommand runs a maintenance command instead of the API server
+func runCommand(name string) {
+	switch name {
+	case "rotate-keys":
+		if err := InitDatabase(); err != nil {
+			log.Fatalf("Database initialization failed: %v", err)
+		}
+		if err := RotateEncryptionKeys(); err != nil {
+			log.Fatalf("Key rotation failed: %v", err)
+		}
+		log.Println("Secrets re-encrypted with the current PEPES_ENCRYPTION_KEY")
+	case "serve":
+		Run()
+	default:
+		log.Fatalf("Unknown command %q (available: serve, rotate-keys)", name)
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/json"
 	"time"
 
 	"gorm.io/gorm"
@@ -11,7 +12,11 @@ type Route struct {
 	ID        uint           `json:"id" gorm:"primaryKey"`
 	Path      string         `json:"path" gorm:"not null"`
 	Upstream  string         `json:"upstream" gorm:"not null"`
-	Plugin    string         `json:"plugin"`
+	Upstreams []RouteUpstream `json:"upstreams" gorm:"foreignKey:RouteID"`
+	LoadBalancing string     `json:"load_balancing" gorm:"not null;default:round_robin"`
+	HashHeader string        `json:"hash_header,omitempty"`
+	HealthCheck *RouteHealthCheck `json:"health_check,omitempty" gorm:"foreignKey:RouteID"`
+	Plugins   []RoutePlugin  `json:"plugins" gorm:"foreignKey:RouteID"`
 	DomainID  uint           `json:"domain_id" gorm:"not null"`
 	Domain    Domain         `json:"domain" gorm:"foreignKey:DomainID"`
 	UsePathAsPrefix bool `json:"usePathAsPrefix"`
@@ -20,35 +25,172 @@ type Route struct {
 	DeletedAt gorm.DeletedAt `json:"deleted_at,omitempty" gorm:"index"`
 }
 
+// RoutePlugin attaches a plugin to a route at a given position, with optional per-route envs
+type RoutePlugin struct {
+	ID        uint      `json:"id" gorm:"primaryKey"`
+	RouteID   uint      `json:"route_id" gorm:"not null;uniqueIndex:idx_route_plugins_route_plugin"`
+	PluginID  uint      `json:"plugin_id" gorm:"not null;uniqueIndex:idx_route_plugins_route_plugin;index"`
+	Plugin    Plugin    `json:"plugin" gorm:"foreignKey:PluginID"`
+	Position  int       `json:"position" gorm:"not null;default:0"`
+	Envs      string    `json:"envs" gorm:"type:text"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// RouteUpstream is one weighted upstream target of a route. The target at position 0
+// is the route's primary upstream and is mirrored in Route.Upstream.
+type RouteUpstream struct {
+	ID        uint      `json:"id" gorm:"primaryKey"`
+	RouteID   uint      `json:"route_id" gorm:"not null;index"`
+	Target    string    `json:"target" gorm:"not null"`
+	Weight    int       `json:"weight" gorm:"not null;default:1"`
+	Position  int       `json:"position" gorm:"not null;default:0"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// RouteHealthCheck configures how the gateway detects unhealthy upstream targets of a route
+type RouteHealthCheck struct {
+	ID        uint               `json:"id" gorm:"primaryKey"`
+	RouteID   uint               `json:"route_id" gorm:"not null;uniqueIndex"`
+	Active    ActiveHealthCheck  `json:"active" gorm:"embedded;embeddedPrefix:active_"`
+	Passive   PassiveHealthCheck `json:"passive" gorm:"embedded;embeddedPrefix:passive_"`
+	CreatedAt time.Time          `json:"created_at"`
+	UpdatedAt time.Time          `json:"updated_at"`
+}
+
+// ActiveHealthCheck probes each upstream target periodically with an HTTP request
+type ActiveHealthCheck struct {
+	Enabled            bool   `json:"enabled"`
+	Path               string `json:"path"`
+	IntervalSeconds    int    `json:"interval_seconds"`
+	TimeoutSeconds     int    `json:"timeout_seconds"`
+	HealthyThreshold   int    `json:"healthy_threshold"`
+	UnhealthyThreshold int    `json:"unhealthy_threshold"`
+}
+
+// PassiveHealthCheck ejects an upstream target after consecutive 5xx responses
+type PassiveHealthCheck struct {
+	Enabled            bool `json:"enabled"`
+	UnhealthyThreshold int  `json:"unhealthy_threshold"`
+	EjectionSeconds    int  `json:"ejection_seconds"`
+}
+
 // Domain represents configuration for a single domain in the database
 type Domain struct {
 	ID        uint           `json:"id" gorm:"primaryKey"`
-	Name      string         `json:"name" gorm:"not null;uniqueIndex"`
-	UserId    string         `json:"user_id" gorm:"not null"`
+	Name      string         `json:"name" gorm:"not null;uniqueIndex:idx_domains_user_name,priority:2"`
+	UserId    string         `json:"user_id" gorm:"not null;uniqueIndex:idx_domains_user_name,priority:1"`
+	Status    string         `json:"status" gorm:"not null;default:pending;index"`
+	VerificationToken string `json:"verification_token"`
+	VerifiedAt *time.Time    `json:"verified_at"`
+	AutoTLS   bool           `json:"auto_tls" gorm:"not null;default:false"`
 	Routes    []Route        `json:"routes" gorm:"foreignKey:DomainID"`
 	CreatedAt time.Time      `json:"created_at"`
 	UpdatedAt time.Time      `json:"updated_at"`
 	DeletedAt gorm.DeletedAt `json:"deleted_at,omitempty" gorm:"index"`
 }
 
+// Certificate is the TLS certificate served for a domain. The private key is encrypted at rest.
+type Certificate struct {
+	ID          uint      `json:"id" gorm:"primaryKey"`
+	DomainID    uint      `json:"domain_id" gorm:"not null;uniqueIndex"`
+	Certificate string    `json:"certificate" gorm:"type:text;not null"`
+	PrivateKey  string    `json:"-" gorm:"type:text;not null"`
+	DNSNames    []string  `json:"dns_names" gorm:"type:text;serializer:json"`
+	Issuer      string    `json:"issuer"`
+	Fingerprint string    `json:"fingerprint"`
+	Source      string    `json:"source" gorm:"not null;default:upload"`
+	NotBefore   time.Time `json:"not_before"`
+	NotAfter    time.Time `json:"not_after" gorm:"index"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// UploadCertificateRequest represents the request body for uploading a domain certificate
+type UploadCertificateRequest struct {
+	Certificate string `json:"certificate" binding:"required,max=65536"`
+	PrivateKey  string `json:"private_key" binding:"required,max=16384"`
+}
+
+// ACMEAccount is the account registered with an ACME directory. The key is encrypted at rest.
+type ACMEAccount struct {
+	ID           uint      `json:"id" gorm:"primaryKey"`
+	DirectoryURL string    `json:"directory_url" gorm:"not null;uniqueIndex"`
+	URI          string    `json:"uri"`
+	KeyPEM       string    `json:"-" gorm:"type:text;not null"`
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+// ACMEChallenge is a pending HTTP-01 challenge, stored so any replica can answer it
+type ACMEChallenge struct {
+	ID               uint      `json:"id" gorm:"primaryKey"`
+	Token            string    `json:"token" gorm:"not null;uniqueIndex"`
+	KeyAuthorization string    `json:"-" gorm:"not null"`
+	Domain           string    `json:"domain" gorm:"not null"`
+	ExpiresAt        time.Time `json:"expires_at" gorm:"index"`
+	CreatedAt        time.Time `json:"created_at"`
+}
+
+// DomainPolicy allows or denies domain names matching a pattern
+type DomainPolicy struct {
+	ID        uint      `json:"id" gorm:"primaryKey"`
+	Pattern   string    `json:"pattern" gorm:"not null;uniqueIndex:idx_domain_policies_pattern_kind"`
+	Kind      string    `json:"kind" gorm:"not null;uniqueIndex:idx_domain_policies_pattern_kind"`
+	Action    string    `json:"action" gorm:"not null;default:deny"`
+	Desc      string    `json:"desc"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// CreateDomainPolicyRequest represents the request body for creating a domain policy
+type CreateDomainPolicyRequest struct {
+	Pattern string `json:"pattern" binding:"required,min=1,max=255"`
+	Kind    string `json:"kind" binding:"required,oneof=exact suffix regex"`
+	Action  string `json:"action" binding:"omitempty,oneof=deny allow"`
+	Desc    string `json:"desc" binding:"max=1000"`
+}
+
+// UpdateDomainPolicyRequest represents the request body for updating a domain policy
+type UpdateDomainPolicyRequest struct {
+	Pattern string  `json:"pattern" binding:"omitempty,min=1,max=255"`
+	Kind    string  `json:"kind" binding:"omitempty,oneof=exact suffix regex"`
+	Action  string  `json:"action" binding:"omitempty,oneof=deny allow"`
+	Desc    *string `json:"desc" binding:"omitempty,max=1000"`
+}
+
 // Plugin represents a plugin configuration in the database
 type Plugin struct {
 	ID            uint           `json:"id" gorm:"primaryKey"`
-	NamePlugin    string         `json:"name_plugin" gorm:"not null;uniqueIndex"`
+	NamePlugin    string         `json:"name_plugin" gorm:"not null;uniqueIndex:idx_plugins_user_name_plugin,priority:2"`
 	PluginSvcName string         `json:"plugin_svc_name" gorm:"not null"`
 	Envs          string         `json:"envs" gorm:"type:text"`
 	Desc          string         `json:"desc" gorm:"type:text"`
-	UserId        string         `json:"user_id" gorm:"not null"`
+	UserId        string         `json:"user_id" gorm:"not null;uniqueIndex:idx_plugins_user_name_plugin,priority:1"`
 	CreatedAt     time.Time      `json:"created_at"`
 	UpdatedAt     time.Time      `json:"updated_at"`
 	DeletedAt     gorm.DeletedAt `json:"deleted_at,omitempty" gorm:"index"`
 }
 
+// ConfigRevision holds the monotonically increasing revision of the gateway configuration
+type ConfigRevision struct {
+	ID        uint      `json:"id" gorm:"primaryKey"`
+	Revision  uint64    `json:"revision" gorm:"not null;default:0"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
 // CreateRouteRequest represents the request body for creating a route
 type CreateRouteRequest struct {
 	Path     string `json:"path" binding:"required,min=1,max=255" default:"/"`
-	Upstream string `json:"upstream" binding:"required,min=1,max=500"`
-	Plugin   string `json:"plugin" binding:"max=255"`
+	Upstream string `json:"upstream" binding:"omitempty,max=500,upstream,upstream_policy"`
+	Upstreams []UpstreamTargetRequest `json:"upstreams" binding:"omitempty,max=50,dive"`
+	LoadBalancing string `json:"load_balancing" binding:"omitempty,oneof=round_robin weighted least_conn consistent_hash"`
+	HashHeader string `json:"hash_header" binding:"required_if=LoadBalancing consistent_hash,omitempty,max=255"`
+	HealthCheck *HealthCheckRequest `json:"health_check"`
+	Plugins  []string `json:"plugins" binding:"omitempty,max=50,dive,min=1,max=255"`
+	// Deprecated: comma-separated plugin names, translated to Plugins
+	Plugin   *string `json:"plugin" binding:"omitempty,max=255"`
 	DomainID uint   `json:"domain_id" binding:"required,min=1"`
 	UsePathAsPrefix bool `json:"usePathAsPrefix" binding:"omitempty,boolean"`
 }
@@ -56,25 +198,95 @@ type CreateRouteRequest struct {
 // UpdateRouteRequest represents the request body for updating a route
 type UpdateRouteRequest struct {
 	Path     string  `json:"path" binding:"omitempty,min=1,max=255"`
-	Upstream string  `json:"upstream" binding:"omitempty,min=1,max=500"`
+	Upstream string  `json:"upstream" binding:"omitempty,min=1,max=500,upstream,upstream_policy"`
+	Upstreams *[]UpstreamTargetRequest `json:"upstreams" binding:"omitempty,max=50,dive"`
+	LoadBalancing string `json:"load_balancing" binding:"omitempty,oneof=round_robin weighted least_conn consistent_hash"`
+	HashHeader *string `json:"hash_header" binding:"omitempty,max=255"`
+	HealthCheck *HealthCheckRequest `json:"health_check"`
+	Plugins  *[]string `json:"plugins" binding:"omitempty,max=50,dive,min=1,max=255"`
+	// Deprecated: comma-separated plugin names, translated to Plugins
 	Plugin   *string `json:"plugin" binding:"omitempty,max=255"`
 	DomainID uint    `json:"domain_id" binding:"omitempty,min=1"`
 }
 
-// UpdateRoutePluginRequest represents the request body for updating a route plugin
+// BulkRoutesRequest represents the request body for creating, updating and deleting routes
+// in a single transaction
+type BulkRoutesRequest struct {
+	Creates []CreateRouteRequest     `json:"creates"`
+	Updates []BulkUpdateRouteRequest `json:"updates"`
+	Deletes []uint                   `json:"deletes"`
+}
+
+// BulkUpdateRouteRequest represents one update in a bulk route request
+type BulkUpdateRouteRequest struct {
+	ID uint `json:"id" binding:"required,min=1"`
+	UpdateRouteRequest
+}
+
+// UpstreamTargetRequest represents one weighted upstream target in a route request
+type UpstreamTargetRequest struct {
+	Target string `json:"target" binding:"required,max=500,upstream,upstream_policy"`
+	Weight *int   `json:"weight" binding:"omitempty,min=0,max=1000"`
+}
+
+// HealthCheckRequest represents the health check settings in a route request
+type HealthCheckRequest struct {
+	Active  *ActiveHealthCheckRequest  `json:"active"`
+	Passive *PassiveHealthCheckRequest `json:"passive"`
+}
+
+// ActiveHealthCheckRequest represents the active health check settings in a route request
+type ActiveHealthCheckRequest struct {
+	Enabled            bool   `json:"enabled"`
+	Path               string `json:"path" binding:"omitempty,startswith=/,max=255"`
+	IntervalSeconds    int    `json:"interval_seconds" binding:"omitempty,min=1,max=3600"`
+	TimeoutSeconds     int    `json:"timeout_seconds" binding:"omitempty,min=1,max=300"`
+	HealthyThreshold   int    `json:"healthy_threshold" binding:"omitempty,min=1,max=100"`
+	UnhealthyThreshold int    `json:"unhealthy_threshold" binding:"omitempty,min=1,max=100"`
+}
+
+// PassiveHealthCheckRequest represents the passive health check settings in a route request
+type PassiveHealthCheckRequest struct {
+	Enabled            bool `json:"enabled"`
+	UnhealthyThreshold int  `json:"unhealthy_threshold" binding:"omitempty,min=1,max=100"`
+	EjectionSeconds    int  `json:"ejection_seconds" binding:"omitempty,min=1,max=3600"`
+}
+
+// AttachRoutePluginRequest represents the request body for attaching a plugin to a route
+type AttachRoutePluginRequest struct {
+	Plugin   string `json:"plugin" binding:"omitempty,max=255"`
+	PluginID uint   `json:"plugin_id" binding:"omitempty,min=1"`
+	Position *int   `json:"position" binding:"omitempty,min=0"`
+	Envs     string `json:"envs" binding:"max=1000"`
+}
+
+// ReorderRoutePluginsRequest represents the request body for reordering a route's plugins
+type ReorderRoutePluginsRequest struct {
+	Plugins []string `json:"plugins" binding:"required,dive,min=1,max=255"`
+}
+
+// UpdateRoutePluginRequest represents the request body for updating an attached plugin
 type UpdateRoutePluginRequest struct {
-	Plugins *string `json:"plugins" binding:"omitempty,max=255"`
+	Position *int    `json:"position" binding:"omitempty,min=0"`
+	Envs     *string `json:"envs" binding:"omitempty,max=1000"`
 }
 
 // CreateDomainRequest represents the request body for creating a domain
 type CreateDomainRequest struct {
 	Name    string `json:"name" binding:"required,min=1,max=255"`
-	UserId  string `json:"user_id" binding:"required,min=1,max=255"`	
+	UserId  string `json:"user_id" binding:"omitempty,min=1,max=255"`
+	AutoTLS bool   `json:"auto_tls"`
+}
+
+// VerifyDomainRequest represents the request body for verifying a domain
+type VerifyDomainRequest struct {
+	Method string `json:"method" binding:"omitempty,oneof=dns http manual"`
 }
 
 // UpdateDomainRequest represents the request body for updating a domain
 type UpdateDomainRequest struct {
-	Name string `json:"name" binding:"omitempty,min=1,max=255"`
+	Name    string `json:"name" binding:"omitempty,min=1,max=255"`
+	AutoTLS *bool  `json:"auto_tls"`
 }
 
 // CreatePluginRequest represents the request body for creating a plugin
@@ -83,7 +295,7 @@ type CreatePluginRequest struct {
 	PluginSvcName string `json:"plugin_svc_name" binding:"required,min=1,max=255"`
 	Envs          string `json:"envs" binding:"max=1000"`
 	Desc          string `json:"desc" binding:"max=1000"`
-	UserId        string `json:"user_id" binding:"required,min=1,max=255"`
+	UserId        string `json:"user_id" binding:"omitempty,min=1,max=255"`
 }
 
 // UpdatePluginRequest represents the request body for updating a plugin
@@ -99,6 +311,7 @@ type PluginService struct {
 	ID         uint           `json:"id" gorm:"primaryKey"`
 	Name       string         `json:"name" gorm:"not null;uniqueIndex"`
 	BaseConfig string         `json:"baseconfig" gorm:"type:json"`
+	Schema     string         `json:"schema" gorm:"type:text"`
 	CreatedAt  time.Time      `json:"created_at"`
 	UpdatedAt  time.Time      `json:"updated_at"`
 	DeletedAt  gorm.DeletedAt `json:"deleted_at,omitempty" gorm:"index"`
@@ -108,10 +321,51 @@ type PluginService struct {
 type CreatePluginServiceRequest struct {
 	Name       string `json:"name" binding:"required,min=1,max=255"`
 	BaseConfig string `json:"baseconfig" binding:"max=5000"`
+	Schema     string `json:"schema" binding:"max=20000"`
 }
 
 // UpdatePluginServiceRequest represents the request body for updating a plugin service
 type UpdatePluginServiceRequest struct {
 	Name       string `json:"name" binding:"omitempty,min=1,max=255"`
 	BaseConfig string `json:"baseconfig" binding:"omitempty,max=5000"`
+	Schema     string `json:"schema" binding:"omitempty,max=20000"`
+}
+
+// APIKey represents a hashed per-user API key for the management API
+type APIKey struct {
+	ID         uint       `json:"id" gorm:"primaryKey"`
+	Name       string     `json:"name"`
+	UserId     string     `json:"user_id" gorm:"not null;index"`
+	Role       string     `json:"role" gorm:"not null;default:user"`
+	Prefix     string     `json:"prefix" gorm:"not null;uniqueIndex"`
+	KeyHash    string     `json:"-" gorm:"not null"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	RevokedAt  *time.Time `json:"revoked_at"`
+	CreatedAt  time.Time  `json:"created_at"`
+	UpdatedAt  time.Time  `json:"updated_at"`
+}
+
+// AuditEvent records who made a change to the configuration, with the entity as it was
+// before and after the change
+type AuditEvent struct {
+	ID         uint            `json:"id" gorm:"primaryKey"`
+	Actor      string          `json:"actor" gorm:"not null;index"`
+	ActorRole  string          `json:"actor_role"`
+	APIKeyID   uint            `json:"api_key_id,omitempty"`
+	Action     string          `json:"action" gorm:"not null"`
+	EntityType string          `json:"entity_type" gorm:"not null;index:idx_audit_events_entity"`
+	EntityID   uint            `json:"entity_id" gorm:"index:idx_audit_events_entity"`
+	Owner      string          `json:"owner" gorm:"index"`
+	Before     json.RawMessage `json:"before,omitempty" gorm:"type:text;serializer:json"`
+	After      json.RawMessage `json:"after,omitempty" gorm:"type:text;serializer:json"`
+	CreatedAt  time.Time       `json:"created_at" gorm:"index"`
+}
+
+// CreateAPIKeyRequest represents the request body for issuing an API key
+type CreateAPIKeyRequest struct {
+	Name          string `json:"name" binding:"required,min=1,max=255"`
+	UserId        string `json:"user_id" binding:"omitempty,min=1,max=255"`
+	Role          string `json:"role" binding:"omitempty,oneof=admin user"`
+	ExpiresInDays int    `json:"expires_in_days" binding:"omitempty,min=1,max=3650"`
 }
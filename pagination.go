@@ -0,0 +1,264 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const (
+	// defaultPageLimit is the page size used when no limit is given
+	defaultPageLimit = 100
+
+	// maxPageLimit is the largest page size a client may request
+	maxPageLimit = 1000
+)
+
+// Sortable fields of each list endpoint, mapped to their columns
+var (
+	routeSortFields = map[string]string{
+		"id": "routes.id", "path": "routes.path", "domain_id": "routes.domain_id",
+		"created_at": "routes.created_at", "updated_at": "routes.updated_at",
+	}
+	domainSortFields = map[string]string{
+		"id": "domains.id", "name": "domains.name",
+		"created_at": "domains.created_at", "updated_at": "domains.updated_at",
+	}
+	pluginSortFields = map[string]string{
+		"id": "plugins.id", "name_plugin": "plugins.name_plugin", "plugin_svc_name": "plugins.plugin_svc_name",
+		"created_at": "plugins.created_at", "updated_at": "plugins.updated_at",
+	}
+	domainPolicySortFields = map[string]string{
+		"id": "domain_policies.id", "pattern": "domain_policies.pattern", "kind": "domain_policies.kind",
+		"action": "domain_policies.action", "created_at": "domain_policies.created_at",
+	}
+	certificateSortFields = map[string]string{
+		"id": "certificates.id", "domain_id": "certificates.domain_id", "not_after": "certificates.not_after",
+		"created_at": "certificates.created_at", "updated_at": "certificates.updated_at",
+	}
+	pluginServiceSortFields = map[string]string{
+		"id": "plugin_services.id", "name": "plugin_services.name",
+		"created_at": "plugin_services.created_at", "updated_at": "plugin_services.updated_at",
+	}
+	auditEventSortFields = map[string]string{
+		"id": "audit_events.id", "created_at": "audit_events.created_at",
+		"entity_type": "audit_events.entity_type", "actor": "audit_events.actor",
+	}
+)
+
+// listParams holds the pagination and sorting options of a list request
+type listParams struct {
+	Limit  int
+	Offset int
+
+	// Cursor pagination: only rows after CursorID in id order are returned
+	HasCursor  bool
+	CursorID   uint
+	Descending bool
+
+	idColumn string
+	orders   []string
+}
+
+// parseListParams reads limit, offset, cursor and sort from the query string.
+// sortFields whitelists the fields that can be sorted on and must contain "id".
+func parseListParams(c *gin.Context, sortFields map[string]string) (listParams, error) {
+	params := listParams{Limit: defaultPageLimit, idColumn: sortFields["id"]}
+
+	if value := c.Query("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 1 {
+			return params, fmt.Errorf("limit must be a positive number")
+		}
+		if limit > maxPageLimit {
+			limit = maxPageLimit
+		}
+		params.Limit = limit
+	}
+
+	if value := c.Query("offset"); value != "" {
+		offset, err := strconv.Atoi(value)
+		if err != nil || offset < 0 {
+			return params, fmt.Errorf("offset must be a non-negative number")
+		}
+		params.Offset = offset
+	}
+
+	sortedByIDOnly := true
+	if value := c.Query("sort"); value != "" {
+		for _, field := range strings.Split(value, ",") {
+			field = strings.TrimSpace(field)
+			direction := "ASC"
+			if strings.HasPrefix(field, "-") {
+				direction = "DESC"
+				field = strings.TrimPrefix(field, "-")
+			}
+
+			column, ok := sortFields[field]
+			if !ok {
+				return params, fmt.Errorf("cannot sort by %q", field)
+			}
+			if field != "id" {
+				sortedByIDOnly = false
+			} else {
+				params.Descending = direction == "DESC"
+			}
+			params.orders = append(params.orders, column+" "+direction)
+		}
+	}
+
+	if value := c.Query("cursor"); value != "" {
+		if !sortedByIDOnly {
+			return params, fmt.Errorf("cursor pagination is only supported when sorting by id")
+		}
+		if params.Offset != 0 {
+			return params, fmt.Errorf("cursor and offset cannot be combined")
+		}
+		id, err := decodeCursor(value)
+		if err != nil {
+			return params, fmt.Errorf("cursor is invalid")
+		}
+		params.HasCursor = true
+		params.CursorID = id
+	}
+
+	// Always break ties on id so pages are stable
+	if !sortedByIDOnly || len(params.orders) == 0 {
+		params.orders = append(params.orders, params.idColumn+" ASC")
+	}
+
+	return params, nil
+}
+
+// paginate counts the rows matched by query, then loads the requested page into dest.
+// scopes (such as preloads) are only applied when loading the page.
+func paginate(query *gorm.DB, params listParams, dest interface{}, scopes ...func(*gorm.DB) *gorm.DB) (int64, error) {
+	var total int64
+	if err := query.Session(&gorm.Session{}).Count(&total).Error; err != nil {
+		return 0, err
+	}
+
+	page := query.Session(&gorm.Session{}).Scopes(scopes...)
+	if params.HasCursor {
+		if params.Descending {
+			page = page.Where(params.idColumn+" < ?", params.CursorID)
+		} else {
+			page = page.Where(params.idColumn+" > ?", params.CursorID)
+		}
+	}
+	for _, order := range params.orders {
+		page = page.Order(order)
+	}
+
+	if err := page.Limit(params.Limit).Offset(params.Offset).Find(dest).Error; err != nil {
+		return 0, err
+	}
+	return total, nil
+}
+
+// respondList writes a paginated list response with a Link header
+func respondList(c *gin.Context, params listParams, data interface{}, total int64) {
+	count := reflect.ValueOf(data).Len()
+	response := gin.H{
+		"data":   data,
+		"count":  count,
+		"total":  total,
+		"limit":  params.Limit,
+		"offset": params.Offset,
+	}
+
+	// Cursors are available whenever the list is ordered by id
+	nextCursor := ""
+	if isSortedByID(params) && count == params.Limit {
+		nextCursor = encodeCursor(lastID(data))
+		response["next_cursor"] = nextCursor
+	}
+
+	links := map[string]url.Values{}
+	if params.HasCursor {
+		if nextCursor != "" {
+			links["next"] = url.Values{"cursor": {nextCursor}}
+		}
+	} else {
+		if int64(params.Offset+count) < total {
+			links["next"] = url.Values{"offset": {strconv.Itoa(params.Offset + params.Limit)}}
+		}
+		if params.Offset > 0 {
+			prev := params.Offset - params.Limit
+			if prev < 0 {
+				prev = 0
+			}
+			links["prev"] = url.Values{"offset": {strconv.Itoa(prev)}}
+		}
+		links["first"] = url.Values{"offset": {"0"}}
+		if total > 0 {
+			last := (int(total) - 1) / params.Limit * params.Limit
+			links["last"] = url.Values{"offset": {strconv.Itoa(last)}}
+		}
+	}
+
+	if header := linkHeader(c, links); header != "" {
+		c.Header("Link", header)
+	}
+	c.Header("X-Total-Count", strconv.FormatInt(total, 10))
+	c.JSON(http.StatusOK, response)
+}
+
+// isSortedByID reports whether the only sort key is id
+func isSortedByID(params listParams) bool {
+	return len(params.orders) == 1 && strings.HasPrefix(params.orders[0], params.idColumn+" ")
+}
+
+// linkHeader renders RFC 8288 links relative to the current request URL
+func linkHeader(c *gin.Context, links map[string]url.Values) string {
+	var parts []string
+	for _, rel := range []string{"first", "prev", "next", "last"} {
+		values, ok := links[rel]
+		if !ok {
+			continue
+		}
+
+		query := c.Request.URL.Query()
+		query.Del("offset")
+		query.Del("cursor")
+		for key, value := range values {
+			query[key] = value
+		}
+
+		link := url.URL{Path: c.Request.URL.Path, RawQuery: query.Encode()}
+		parts = append(parts, fmt.Sprintf("<%s>; rel=\"%s\"", link.String(), rel))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// lastID returns the ID field of the last element of a slice of models
+func lastID(data interface{}) uint {
+	rows := reflect.ValueOf(data)
+	if rows.Len() == 0 {
+		return 0
+	}
+	return uint(rows.Index(rows.Len() - 1).FieldByName("ID").Uint())
+}
+
+func encodeCursor(id uint) string {
+	return base64.RawURLEncoding.EncodeToString([]byte("id:" + strconv.FormatUint(uint64(id), 10)))
+}
+
+func decodeCursor(cursor string) (uint, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, err
+	}
+	id, err := strconv.ParseUint(strings.TrimPrefix(string(raw), "id:"), 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return uint(id), nil
+}
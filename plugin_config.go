@@ -0,0 +1,167 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Layers of a plugin's effective config, from lowest to highest precedence
+const (
+	ConfigLayerService = "service"
+	ConfigLayerPlugin  = "plugin"
+	ConfigLayerRoute   = "route"
+)
+
+// EffectivePluginConfig is a plugin's merged config along with the layers it was built from
+type EffectivePluginConfig struct {
+	PluginID      uint                   `json:"plugin_id"`
+	NamePlugin    string                 `json:"name_plugin"`
+	PluginSvcName string                 `json:"plugin_svc_name"`
+	RouteID       uint                   `json:"route_id,omitempty"`
+	Config        map[string]interface{} `json:"config"`
+	Sources       map[string]string      `json:"sources"`
+	Layers        map[string]interface{} `json:"layers"`
+}
+
+// configLayer parses one layer of a plugin config. Empty values and values that are not
+// JSON objects (such as envs written before validation existed) contribute nothing.
+func configLayer(value string) map[string]interface{} {
+	fields, ok := parseConfigObject(value)
+	if !ok {
+		return map[string]interface{}{}
+	}
+	return fields
+}
+
+// mergeConfig deep merges override into base and returns the result without modifying
+// either. Nested objects are merged key by key, any other value replaces the inherited
+// one, and null removes the inherited setting.
+func mergeConfig(base, override map[string]interface{}) map[string]interface{} {
+	merged := make(map[string]interface{}, len(base)+len(override))
+	for key, value := range base {
+		merged[key] = copyConfigValue(value)
+	}
+
+	for key, value := range override {
+		if value == nil {
+			delete(merged, key)
+			continue
+		}
+		overrideObject, ok := value.(map[string]interface{})
+		if baseObject, isObject := merged[key].(map[string]interface{}); ok && isObject {
+			merged[key] = mergeConfig(baseObject, overrideObject)
+			continue
+		}
+		merged[key] = copyConfigValue(value)
+	}
+	return merged
+}
+
+// copyConfigValue copies nested objects and arrays so merged configs never share them
+func copyConfigValue(value interface{}) interface{} {
+	switch typed := value.(type) {
+	case map[string]interface{}:
+		return mergeConfig(typed, nil)
+	case []interface{}:
+		items := make([]interface{}, len(typed))
+		for i, item := range typed {
+			items[i] = copyConfigValue(item)
+		}
+		return items
+	default:
+		return value
+	}
+}
+
+// configSources maps each top-level setting of the effective config to the layer it came from
+func configSources(layers ...map[string]interface{}) map[string]string {
+	names := []string{ConfigLayerService, ConfigLayerPlugin, ConfigLayerRoute}
+	sources := make(map[string]string)
+	for i, layer := range layers {
+		for key, value := range layer {
+			if value == nil {
+				delete(sources, key)
+				continue
+			}
+			sources[key] = names[i]
+		}
+	}
+	return sources
+}
+
+// GetPluginEffectiveConfig returns the config the gateway uses for a plugin: the service's
+// base config merged with the plugin envs and, with ?route_id=, the envs of that route's
+// attachment. Secrets are redacted.
+func GetPluginEffectiveConfig(c *gin.Context) {
+	id := c.Param("id")
+	var plugin Plugin
+
+	if err := scopePlugins(c, DB).First(&plugin, id).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Plugin not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": formatDatabaseError(err)})
+		return
+	}
+
+	var pluginService PluginService
+	if err := DB.Where("name = ?", plugin.PluginSvcName).First(&pluginService).Error; err != nil && err != gorm.ErrRecordNotFound {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": formatDatabaseError(err)})
+		return
+	}
+
+	var routePlugin RoutePlugin
+	if value := c.Query("route_id"); value != "" {
+		routeID, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "route_id must be a route ID"})
+			return
+		}
+
+		var route Route
+		if err := scopeRoutes(c, DB).First(&route, routeID).Error; err != nil {
+			if err == gorm.ErrRecordNotFound {
+				c.JSON(http.StatusNotFound, gin.H{"error": "Route not found"})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": formatDatabaseError(err)})
+			return
+		}
+
+		if err := DB.Where("route_id = ? AND plugin_id = ?", route.ID, plugin.ID).First(&routePlugin).Error; err != nil {
+			if err == gorm.ErrRecordNotFound {
+				c.JSON(http.StatusNotFound, gin.H{"error": "Plugin is not attached to this route"})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": formatDatabaseError(err)})
+			return
+		}
+	}
+
+	plugins := []Plugin{plugin}
+	routePlugins := []RoutePlugin{routePlugin}
+	pluginServices := []PluginService{pluginService}
+	redactSecretView(routePlugins, plugins, pluginServices)
+
+	service := configLayer(pluginServices[0].BaseConfig)
+	envs := configLayer(plugins[0].Envs)
+	routeEnvs := configLayer(routePlugins[0].Envs)
+
+	c.JSON(http.StatusOK, gin.H{"data": EffectivePluginConfig{
+		PluginID:      plugin.ID,
+		NamePlugin:    plugin.NamePlugin,
+		PluginSvcName: plugin.PluginSvcName,
+		RouteID:       routePlugin.RouteID,
+		Config:        mergeConfig(mergeConfig(service, envs), routeEnvs),
+		Sources:       configSources(service, envs, routeEnvs),
+		Layers: map[string]interface{}{
+			ConfigLayerService: service,
+			ConfigLayerPlugin:  envs,
+			ConfigLayerRoute:   routeEnvs,
+		},
+	}})
+}
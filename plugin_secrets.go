@@ -0,0 +1,376 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// redactedSecret replaces secret values in API responses. Sending it back in an update
+// keeps the stored value.
+const redactedSecret = "******"
+
+// secretFieldsTTL is how long the secret fields of a plugin service are cached for redaction
+const secretFieldsTTL = time.Minute
+
+// secretFieldHints are substrings marking a config field as secret when there is no schema
+var secretFieldHints = []string{"secret", "pass", "token", "key", "credential", "private"}
+
+// secretFields reports whether a top-level config field holds a secret
+type secretFields func(field string) bool
+
+// schemaSecretFields returns the secret fields of configs described by schema: the
+// properties declared writeOnly. Without a schema, field names are used as a hint.
+func schemaSecretFields(schema *configSchema) secretFields {
+	if schema == nil {
+		return isSecretField
+	}
+	return func(field string) bool {
+		property, ok := schema.Properties[field]
+		return ok && property.WriteOnly
+	}
+}
+
+// pluginServiceSecretFields returns the secret fields declared by a raw plugin service schema
+func pluginServiceSecretFields(rawSchema string) secretFields {
+	schema, err := parseConfigSchema(rawSchema)
+	if err != nil {
+		return isSecretField
+	}
+	return schemaSecretFields(schema)
+}
+
+// storedSecretFields loads the schema of the named plugin service from db and returns its
+// secret fields, for sealing configs of that service
+func storedSecretFields(db *gorm.DB, name string) (secretFields, error) {
+	var pluginService PluginService
+	if err := db.Select("name", "schema").Where("name = ?", name).First(&pluginService).Error; err != nil {
+		return nil, err
+	}
+	return pluginServiceSecretFields(pluginService.Schema), nil
+}
+
+type cachedSecretFields struct {
+	fields  secretFields
+	expires time.Time
+}
+
+// secretFieldsCache holds the secret fields of plugin services by name, so configs can be
+// redacted when marshaled without a query per value
+var secretFieldsCache sync.Map
+
+// cacheSecretFields stores the secret fields of a committed plugin service
+func cacheSecretFields(pluginService PluginService) {
+	storeSecretFields(pluginService.Name, pluginServiceSecretFields(pluginService.Schema))
+}
+
+func storeSecretFields(name string, fields secretFields) {
+	secretFieldsCache.Store(name, cachedSecretFields{fields: fields, expires: time.Now().Add(secretFieldsTTL)})
+}
+
+// serviceSecretFields returns the secret fields of the named plugin service for redaction.
+// Entries expire so schema changes made by other replicas are picked up. When the service
+// cannot be loaded every field is treated as secret.
+func serviceSecretFields(name string) secretFields {
+	if cached, ok := secretFieldsCache.Load(name); ok && time.Now().Before(cached.(cachedSecretFields).expires) {
+		return cached.(cachedSecretFields).fields
+	}
+	if DB == nil {
+		return allSecretFields
+	}
+	fields, err := storedSecretFields(DB, name)
+	if err != nil {
+		return allSecretFields
+	}
+	storeSecretFields(name, fields)
+	return fields
+}
+
+func allSecretFields(string) bool {
+	return true
+}
+
+// isSecretField reports whether a config field holds a secret, judging by its name
+func isSecretField(name string) bool {
+	name = strings.ToLower(name)
+	for _, hint := range secretFieldHints {
+		if strings.Contains(name, hint) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseConfigObject decodes a JSON object config, preserving numbers as written
+func parseConfigObject(value string) (map[string]interface{}, bool) {
+	if strings.TrimSpace(value) == "" {
+		return nil, false
+	}
+	decoder := json.NewDecoder(strings.NewReader(value))
+	decoder.UseNumber()
+
+	var fields map[string]interface{}
+	if err := decoder.Decode(&fields); err != nil || fields == nil {
+		return nil, false
+	}
+	return fields, true
+}
+
+// transformConfigStrings applies fn to every top-level string field of a JSON object config.
+// Values that are not JSON objects are returned unchanged.
+func transformConfigStrings(value string, fn func(field, secret string) (string, error)) (string, error) {
+	fields, ok := parseConfigObject(value)
+	if !ok {
+		return value, nil
+	}
+
+	changed := false
+	for field, raw := range fields {
+		secret, ok := raw.(string)
+		if !ok {
+			continue
+		}
+		transformed, err := fn(field, secret)
+		if err != nil {
+			return "", fmt.Errorf("%s: %v", field, err)
+		}
+		if transformed != secret {
+			fields[field] = transformed
+			changed = true
+		}
+	}
+	if !changed {
+		return value, nil
+	}
+
+	var out bytes.Buffer
+	encoder := json.NewEncoder(&out)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(fields); err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(out.String(), "\n"), nil
+}
+
+// secretsEncryptionConfigured reports whether PEPES_ENCRYPTION_KEY is set
+func secretsEncryptionConfigured() bool {
+	return getEnv("PEPES_ENCRYPTION_KEY", "") != ""
+}
+
+// sealSecrets prepares a config for storage: secret fields are encrypted, and fields sent
+// back as the redaction placeholder keep their value from previous. Values that look
+// encrypted are only accepted when they are the value stored in previous, so a client
+// cannot store a value the config feed fails to decrypt. Without an encryption key secrets
+// are stored as given.
+func sealSecrets(value, previous string, secret secretFields) (string, error) {
+	previousFields, _ := parseConfigObject(previous)
+
+	return transformConfigStrings(value, func(field, text string) (string, error) {
+		stored, hasStored := previousFields[field].(string)
+		if text == redactedSecret && (secret(field) || isEncryptedSecret(stored)) {
+			if hasStored {
+				return stored, nil
+			}
+			return "", fmt.Errorf("%s: no stored value to keep", field)
+		}
+		if isEncryptedSecret(text) {
+			if hasStored && stored == text {
+				return text, nil
+			}
+			return "", fmt.Errorf("%s: values starting with %q are reserved for encrypted secrets", field, encryptedSecretPrefix)
+		}
+		if text == "" || !secret(field) || !secretsEncryptionConfigured() {
+			return text, nil
+		}
+		return encryptSecret(text)
+	})
+}
+
+// redactSecrets replaces every non-empty secret field and every encrypted value of a config
+// with the placeholder
+func redactSecrets(value string, secret secretFields) string {
+	redacted, err := transformConfigStrings(value, func(field, text string) (string, error) {
+		if text == "" || !secret(field) && !isEncryptedSecret(text) {
+			return text, nil
+		}
+		return redactedSecret, nil
+	})
+	if err != nil {
+		return ""
+	}
+	return redacted
+}
+
+// revealSecrets decrypts every encrypted value of a config
+func revealSecrets(value string) (string, error) {
+	return transformConfigStrings(value, func(field, text string) (string, error) {
+		plaintext, err := decryptSecret(text)
+		if err != nil {
+			return "", fmt.Errorf("%s: %v", field, err)
+		}
+		return plaintext, nil
+	})
+}
+
+// rotateSecrets re-encrypts every encrypted value of a config with the current key,
+// encrypting secret fields still stored in plaintext
+func rotateSecrets(value string, secret secretFields) (string, error) {
+	return transformConfigStrings(value, func(field, text string) (string, error) {
+		if text == "" || !secret(field) && !isEncryptedSecret(text) {
+			return text, nil
+		}
+		plaintext, err := decryptSecret(text)
+		if err != nil {
+			return "", fmt.Errorf("%s: %v", field, err)
+		}
+		return encryptSecret(plaintext)
+	})
+}
+
+// routePluginSecretFields returns the secret fields of an attachment's envs, treating every
+// field as secret when its plugin is not loaded
+func routePluginSecretFields(rp RoutePlugin) secretFields {
+	if rp.Plugin.PluginSvcName == "" {
+		return allSecretFields
+	}
+	return serviceSecretFields(rp.Plugin.PluginSvcName)
+}
+
+// MarshalJSON redacts secret envs in API responses and events
+func (p Plugin) MarshalJSON() ([]byte, error) {
+	type plugin Plugin
+	redacted := plugin(p)
+	redacted.Envs = redactSecrets(p.Envs, serviceSecretFields(p.PluginSvcName))
+	return json.Marshal(redacted)
+}
+
+// MarshalJSON redacts secret envs in API responses and events
+func (rp RoutePlugin) MarshalJSON() ([]byte, error) {
+	type routePlugin RoutePlugin
+	redacted := routePlugin(rp)
+	redacted.Envs = redactSecrets(rp.Envs, routePluginSecretFields(rp))
+	return json.Marshal(redacted)
+}
+
+// MarshalJSON redacts secret base config fields in API responses and events
+func (ps PluginService) MarshalJSON() ([]byte, error) {
+	type pluginService PluginService
+	redacted := pluginService(ps)
+	redacted.BaseConfig = redactSecrets(ps.BaseConfig, pluginServiceSecretFields(ps.Schema))
+	return json.Marshal(redacted)
+}
+
+// RotateEncryptionKeys re-encrypts every stored secret with the current PEPES_ENCRYPTION_KEY.
+// Values sealed with a key listed in PEPES_PREVIOUS_ENCRYPTION_KEYS are decrypted with it,
+// and secrets still stored in plaintext are encrypted.
+func RotateEncryptionKeys() error {
+	if _, _, err := encryptionKeys(); err != nil {
+		return err
+	}
+
+	return DB.Transaction(func(tx *gorm.DB) error {
+		var pluginServices []PluginService
+		if err := tx.Unscoped().Find(&pluginServices).Error; err != nil {
+			return err
+		}
+		serviceFields := make(map[string]secretFields, len(pluginServices))
+		for _, pluginService := range pluginServices {
+			fields := pluginServiceSecretFields(pluginService.Schema)
+			serviceFields[pluginService.Name] = fields
+			baseConfig, err := rotateSecrets(pluginService.BaseConfig, fields)
+			if err != nil {
+				return fmt.Errorf("plugin service %d: %v", pluginService.ID, err)
+			}
+			if err := tx.Model(&PluginService{}).Unscoped().Where("id = ?", pluginService.ID).UpdateColumn("base_config", baseConfig).Error; err != nil {
+				return err
+			}
+		}
+		fieldsOf := func(pluginSvcName string) secretFields {
+			if fields, ok := serviceFields[pluginSvcName]; ok {
+				return fields
+			}
+			return isSecretField
+		}
+
+		var plugins []Plugin
+		if err := tx.Unscoped().Find(&plugins).Error; err != nil {
+			return err
+		}
+		pluginFields := make(map[uint]secretFields, len(plugins))
+		for _, plugin := range plugins {
+			pluginFields[plugin.ID] = fieldsOf(plugin.PluginSvcName)
+			envs, err := rotateSecrets(plugin.Envs, pluginFields[plugin.ID])
+			if err != nil {
+				return fmt.Errorf("plugin %d: %v", plugin.ID, err)
+			}
+			if err := tx.Model(&Plugin{}).Unscoped().Where("id = ?", plugin.ID).UpdateColumn("envs", envs).Error; err != nil {
+				return err
+			}
+		}
+
+		var routePlugins []RoutePlugin
+		if err := tx.Find(&routePlugins).Error; err != nil {
+			return err
+		}
+		for _, routePlugin := range routePlugins {
+			fields, ok := pluginFields[routePlugin.PluginID]
+			if !ok {
+				fields = isSecretField
+			}
+			envs, err := rotateSecrets(routePlugin.Envs, fields)
+			if err != nil {
+				return fmt.Errorf("route plugin %d: %v", routePlugin.ID, err)
+			}
+			if err := tx.Model(&RoutePlugin{}).Where("id = ?", routePlugin.ID).UpdateColumn("envs", envs).Error; err != nil {
+				return err
+			}
+		}
+
+		var certificates []Certificate
+		if err := tx.Find(&certificates).Error; err != nil {
+			return err
+		}
+		for _, cert := range certificates {
+			key, err := rotateEncryptedValue(cert.PrivateKey)
+			if err != nil {
+				return fmt.Errorf("certificate %d: %v", cert.ID, err)
+			}
+			if err := tx.Model(&Certificate{}).Where("id = ?", cert.ID).UpdateColumn("private_key", key).Error; err != nil {
+				return err
+			}
+		}
+
+		var accounts []ACMEAccount
+		if err := tx.Find(&accounts).Error; err != nil {
+			return err
+		}
+		for _, account := range accounts {
+			key, err := rotateEncryptedValue(account.KeyPEM)
+			if err != nil {
+				return fmt.Errorf("ACME account %d: %v", account.ID, err)
+			}
+			if err := tx.Model(&ACMEAccount{}).Where("id = ?", account.ID).UpdateColumn("key_pem", key).Error; err != nil {
+				return err
+			}
+		}
+
+		log.Printf("Re-encrypted secrets of %d plugins, %d route plugins, %d plugin services, %d certificates and %d ACME accounts",
+			len(plugins), len(routePlugins), len(pluginServices), len(certificates), len(accounts))
+		return nil
+	})
+}
+
+// rotateEncryptedValue re-encrypts a whole encrypted value with the current key
+func rotateEncryptedValue(value string) (string, error) {
+	plaintext, err := decryptSecret(value)
+	if err != nil {
+		return "", err
+	}
+	return encryptSecret(plaintext)
+}
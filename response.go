@@ -1,14 +1,20 @@
 package main
 
+import "time"
+
 type PluginData struct {
 	ID            int     `json:"id"`
 	NamePlugin    string  `json:"name_plugin"`
 	PluginSvcName string  `json:"plugin_svc_name"`
 	Envs          string  `json:"envs"`
+	RouteEnvs     string  `json:"route_envs,omitempty"`
 	Desc          string  `json:"desc"`
 	CreatedAt     string  `json:"created_at"`
 	UpdatedAt     string  `json:"updated_at"`
 	DeletedAt     *string `json:"deleted_at"`
+
+	// Config is the service base config deep merged with Envs and RouteEnvs
+	Config map[string]interface{} `json:"config"`
 }
 
 // RouteConfig represents a single route configuration
@@ -18,14 +24,50 @@ type RouteConfig struct {
 	Plugin          string       `json:"plugin"`
 	UsePathAsPrefix bool         `json:"usePathAsPrefix"`
 	PluginsData     []PluginData `json:"plugins_data"`
+
+	// Upstreams lists every weighted target; Upstream is the primary one
+	Upstreams     []UpstreamConfig `json:"upstreams"`
+	LoadBalancing string           `json:"load_balancing"`
+	HashHeader    string           `json:"hash_header,omitempty"`
+
+	HealthCheck *HealthCheckConfig `json:"health_check,omitempty"`
+}
+
+// HealthCheckConfig represents the enabled health checks of a route
+type HealthCheckConfig struct {
+	Active  *ActiveHealthCheck  `json:"active,omitempty"`
+	Passive *PassiveHealthCheck `json:"passive,omitempty"`
+}
+
+// UpstreamConfig represents one weighted upstream target of a route
+type UpstreamConfig struct {
+	Target string `json:"target"`
+	Weight int    `json:"weight"`
 }
 
 // DomainConfig represents configuration for a single domain
 type DomainConfig struct {
 	Routes []RouteConfig `json:"routes"`
+
+	// Wildcard domains ("*.example.com") match any single label in place of the "*"
+	Wildcard bool `json:"wildcard"`
+
+	Certificate *CertificateRef `json:"certificate,omitempty"`
+}
+
+// CertificateRef identifies the certificate of a domain; the key material is fetched from
+// /certificates/{id}/bundle
+type CertificateRef struct {
+	ID          uint      `json:"id"`
+	Fingerprint string    `json:"fingerprint"`
+	NotAfter    time.Time `json:"not_after"`
 }
 
 // ConfigResponse represents the complete configuration response
 type ConfigResponse struct {
 	Domains map[string]DomainConfig `json:"domains"`
+
+	// MatchOrder lists the domain names in the order a host should be matched against
+	// them: exact names before wildcards, more specific wildcards first
+	MatchOrder []string `json:"match_order"`
 }
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// configRevisionID is the primary key of the single row holding the config revision
+	configRevisionID = 1
+
+	// maxConfigWait caps how long a long-polling client may block on GET /config
+	maxConfigWait = 60 * time.Second
+
+	// configRevisionPollInterval is how often the revision is re-read from the database
+	// so that changes made through other API replicas still wake up local waiters
+	configRevisionPollInterval = 2 * time.Second
+)
+
+// revisionNotifier keeps the last known config revision and wakes up waiters when it changes
+type revisionNotifier struct {
+	mu       sync.Mutex
+	revision uint64
+	changed  chan struct{}
+}
+
+var configNotifier = &revisionNotifier{changed: make(chan struct{})}
+
+// publish records a new revision and wakes up all waiters if it moved forward
+func (n *revisionNotifier) publish(revision uint64) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if revision <= n.revision {
+		return
+	}
+	n.revision = revision
+	close(n.changed)
+	n.changed = make(chan struct{})
+}
+
+// current returns the last known revision and a channel closed on the next change
+func (n *revisionNotifier) current() (uint64, <-chan struct{}) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.revision, n.changed
+}
+
+// initConfigRevision makes sure the revision row exists
+func initConfigRevision() error {
+	return DB.Exec(
+		"INSERT INTO config_revisions (id, revision, updated_at) VALUES (?, 1, ?) ON CONFLICT (id) DO NOTHING",
+		configRevisionID, time.Now(),
+	).Error
+}
+
+// currentConfigRevision reads the current config revision from the database
+func currentConfigRevision() (uint64, error) {
+	var revision ConfigRevision
+	if err := DB.First(&revision, configRevisionID).Error; err != nil {
+		return 0, err
+	}
+	configNotifier.publish(revision.Revision)
+	return revision.Revision, nil
+}
+
+// bumpConfigRevision increments the config revision after a successful mutation
+func bumpConfigRevision() (uint64, bool) {
+	var revision uint64
+	err := DB.Raw(
+		"UPDATE config_revisions SET revision = revision + 1, updated_at = ? WHERE id = ? RETURNING revision",
+		time.Now(), configRevisionID,
+	).Scan(&revision).Error
+	if err != nil {
+		log.Printf("Failed to bump config revision: %v", err)
+		return 0, false
+	}
+	configNotifier.publish(revision)
+	return revision, true
+}
+
+// watchConfigRevision periodically refreshes the revision from the database until ctx is done
+func watchConfigRevision(ctx context.Context) {
+	ticker := time.NewTicker(configRevisionPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			revision, err := currentConfigRevision()
+			if err != nil {
+				log.Printf("Failed to refresh config revision: %v", err)
+				continue
+			}
+			configEvents.catchUp(revision)
+		}
+	}
+}
+
+// waitForConfigChange blocks until the revision differs from since, the timeout expires
+// or ctx is cancelled, and returns the revision known at that point
+func waitForConfigChange(ctx context.Context, since uint64, timeout time.Duration) uint64 {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		revision, changed := configNotifier.current()
+		if revision != since {
+			return revision
+		}
+
+		select {
+		case <-changed:
+		case <-timer.C:
+			return revision
+		case <-ctx.Done():
+			return revision
+		}
+	}
+}
+
+// formatConfigETag renders a revision as a strong ETag
+func formatConfigETag(revision uint64) string {
+	return fmt.Sprintf("\"%d\"", revision)
+}
+
+// parseConfigETag extracts the revision from an If-None-Match header
+func parseConfigETag(header string) (uint64, bool) {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		tag = strings.TrimPrefix(tag, "W/")
+		tag = strings.Trim(tag, "\"")
+		if revision, err := strconv.ParseUint(tag, 10, 64); err == nil {
+			return revision, true
+		}
+	}
+	return 0, false
+}
+
+// parseConfigWait parses the wait query parameter as a duration ("30s") or plain seconds ("30")
+func parseConfigWait(value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+
+	wait, err := time.ParseDuration(value)
+	if err != nil {
+		seconds, convErr := strconv.Atoi(value)
+		if convErr != nil {
+			return 0, fmt.Errorf("wait must be a duration such as 30s")
+		}
+		wait = time.Duration(seconds) * time.Second
+	}
+
+	if wait < 0 {
+		return 0, fmt.Errorf("wait must not be negative")
+	}
+	if wait > maxConfigWait {
+		wait = maxConfigWait
+	}
+	return wait, nil
+}
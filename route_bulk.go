@@ -0,0 +1,290 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"gorm.io/gorm"
+)
+
+// Outcomes of the items of a bulk route request
+const (
+	BulkRouteCreated    = "created"
+	BulkRouteUpdated    = "updated"
+	BulkRouteDeleted    = "deleted"
+	BulkRouteFailed     = "failed"
+	BulkRouteRolledBack = "rolled_back"
+	BulkRouteSkipped    = "skipped"
+)
+
+// maxBulkRouteItems is the largest number of creates, updates and deletes in one request
+const maxBulkRouteItems = 500
+
+// BulkRouteResult is the outcome of one item of a bulk route request. Index is the position
+// of the item in the creates, updates or deletes list of the request.
+type BulkRouteResult struct {
+	Action   string          `json:"action"`
+	Index    int             `json:"index"`
+	ID       uint            `json:"id,omitempty"`
+	Status   string          `json:"status"`
+	Error    string          `json:"error,omitempty"`
+	Conflict *RouteConflict  `json:"conflict,omitempty"`
+	Warnings []RouteConflict `json:"warnings,omitempty"`
+	Data     *Route          `json:"data,omitempty"`
+}
+
+// bulkRouteItem is one operation of a bulk request; run records its outcome in results[index]
+type bulkRouteItem struct {
+	index int
+	run   func(tx *gorm.DB) error
+}
+
+// BulkRoutes creates, updates and deletes routes in a single transaction. Deletes run first,
+// then updates, then creates, so a path freed by one item can be taken by a later one. Every
+// item is validated before anything is written, and any failure rolls back the whole request.
+func BulkRoutes(c *gin.Context) {
+	var req BulkRoutesRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": formatValidationError(err)})
+		return
+	}
+
+	total := len(req.Creates) + len(req.Updates) + len(req.Deletes)
+	if total == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "At least one create, update or delete is required"})
+		return
+	}
+	if total > maxBulkRouteItems {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("At most %d routes can be changed in one request", maxBulkRouteItems)})
+		return
+	}
+
+	// Results are listed in execution order
+	results := make([]BulkRouteResult, 0, total)
+	for i, id := range req.Deletes {
+		results = append(results, BulkRouteResult{Action: ConfigChangeDelete, Index: i, ID: id})
+	}
+	for i, update := range req.Updates {
+		results = append(results, BulkRouteResult{Action: ConfigChangeUpdate, Index: i, ID: update.ID})
+	}
+	for i := range req.Creates {
+		results = append(results, BulkRouteResult{Action: ConfigChangeCreate, Index: i})
+	}
+
+	if !validateBulkRoutes(req, results) {
+		for i := range results {
+			if results[i].Status == "" {
+				results[i].Status = BulkRouteSkipped
+			}
+		}
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Bulk request is invalid, nothing was changed",
+			"data":  results,
+			"count": len(results),
+		})
+		return
+	}
+
+	policy := shadowPolicy(c)
+	principal := currentPrincipal(c)
+	var deleted []Route
+	var items []bulkRouteItem
+
+	for _, id := range req.Deletes {
+		index := len(items)
+		items = append(items, bulkRouteItem{index: index, run: func(tx *gorm.DB) error {
+			var route Route
+			if err := scopeRoutes(c, tx.Preload("Domain")).First(&route, id).Error; err != nil {
+				if err == gorm.ErrRecordNotFound {
+					return &routeRequestError{status: http.StatusNotFound, message: "Route not found"}
+				}
+				return err
+			}
+			before, err := loadRouteSnapshot(tx, route.ID)
+			if err != nil {
+				return err
+			}
+			if err := removeRoute(tx, route); err != nil {
+				return err
+			}
+			if err := recordAudit(tx, principal, ConfigEntityRoute, ConfigActionDeleted, route.ID, route.Domain.UserId, before, nil); err != nil {
+				return err
+			}
+			deleted = append(deleted, route)
+			results[index].Status = BulkRouteDeleted
+			return nil
+		}})
+	}
+
+	for _, update := range req.Updates {
+		index := len(items)
+		items = append(items, bulkRouteItem{index: index, run: func(tx *gorm.DB) error {
+			var route Route
+			if err := scopeRoutes(c, tx).First(&route, update.ID).Error; err != nil {
+				if err == gorm.ErrRecordNotFound {
+					return &routeRequestError{status: http.StatusNotFound, message: "Route not found"}
+				}
+				return err
+			}
+			before, err := loadRouteSnapshot(tx, route.ID)
+			if err != nil {
+				return err
+			}
+			write, err := prepareRouteUpdate(c, tx, route, update.UpdateRouteRequest)
+			if err != nil {
+				return err
+			}
+			if results[index].Warnings, err = write.save(tx, policy); err != nil {
+				return err
+			}
+			saved, err := auditRoute(tx, principal, ConfigActionUpdated, route.ID, before)
+			if err != nil {
+				return err
+			}
+			results[index].Data = &saved
+			results[index].Status = BulkRouteUpdated
+			return nil
+		}})
+	}
+
+	for _, create := range req.Creates {
+		index := len(items)
+		items = append(items, bulkRouteItem{index: index, run: func(tx *gorm.DB) error {
+			write, err := prepareRouteCreate(c, tx, create)
+			if err != nil {
+				return err
+			}
+			if results[index].Warnings, err = write.save(tx, policy); err != nil {
+				return err
+			}
+			saved, err := auditRoute(tx, principal, ConfigActionCreated, write.route.ID, nil)
+			if err != nil {
+				return err
+			}
+			results[index].ID = saved.ID
+			results[index].Data = &saved
+			results[index].Status = BulkRouteCreated
+			return nil
+		}})
+	}
+
+	failed := -1
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		for _, item := range items {
+			if err := item.run(tx); err != nil {
+				failed = item.index
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		respondBulkRoutesError(c, results, failed, err)
+		return
+	}
+
+	for _, route := range deleted {
+		publishConfigChange(ConfigEntityRoute, ConfigActionDeleted, route.ID, route.Domain.UserId, route)
+	}
+	for _, result := range results {
+		if result.Data == nil {
+			continue
+		}
+		action := ConfigActionUpdated
+		if result.Action == ConfigChangeCreate {
+			action = ConfigActionCreated
+		}
+		publishConfigChange(ConfigEntityRoute, action, result.ID, result.Data.Domain.UserId, *result.Data)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"data":  results,
+		"count": len(results),
+	})
+}
+
+// validateBulkRoutes checks every item of a bulk request without touching the database,
+// marking the invalid ones as failed. It reports whether all items are valid.
+func validateBulkRoutes(req BulkRoutesRequest, results []BulkRouteResult) bool {
+	valid := true
+	fail := func(result *BulkRouteResult, message string) {
+		result.Status = BulkRouteFailed
+		result.Error = message
+		valid = false
+	}
+
+	// A route can only be touched once per request
+	seen := make(map[uint]bool, len(req.Deletes)+len(req.Updates))
+	position := 0
+	for _, id := range req.Deletes {
+		result := &results[position]
+		position++
+		switch {
+		case id == 0:
+			fail(result, "ID is required")
+		case seen[id]:
+			fail(result, fmt.Sprintf("Route %d appears more than once", id))
+		}
+		seen[id] = true
+	}
+	for _, update := range req.Updates {
+		result := &results[position]
+		position++
+		if err := binding.Validator.ValidateStruct(update); err != nil {
+			fail(result, formatValidationError(err))
+			continue
+		}
+		if seen[update.ID] {
+			fail(result, fmt.Sprintf("Route %d appears more than once", update.ID))
+		}
+		seen[update.ID] = true
+	}
+	for _, create := range req.Creates {
+		result := &results[position]
+		position++
+		if err := binding.Validator.ValidateStruct(create); err != nil {
+			fail(result, formatValidationError(err))
+		}
+	}
+	return valid
+}
+
+// respondBulkRoutesError reports the item that failed and marks the others as rolled back
+// or skipped
+func respondBulkRoutesError(c *gin.Context, results []BulkRouteResult, failed int, err error) {
+	status, message := routeWriteStatus(err)
+	for i := range results {
+		result := &results[i]
+		switch {
+		case failed < 0 || i < failed:
+			result.Status = BulkRouteRolledBack
+			result.Warnings = nil
+			result.Data = nil
+			if result.Action == ConfigChangeCreate {
+				result.ID = 0
+			}
+		case i == failed:
+			result.Status = BulkRouteFailed
+			result.Error = message
+			result.Warnings = nil
+			var conflictErr *routeConflictError
+			if errors.As(err, &conflictErr) {
+				result.Conflict = &conflictErr.conflict
+			}
+		default:
+			result.Status = BulkRouteSkipped
+		}
+	}
+
+	if failed >= 0 {
+		message = fmt.Sprintf("%s %d failed: %s", results[failed].Action, results[failed].Index, message)
+	}
+	c.JSON(status, gin.H{
+		"error": "Bulk request rolled back, " + message,
+		"data":  results,
+		"count": len(results),
+	})
+}
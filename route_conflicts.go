@@ -0,0 +1,226 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Kinds of route conflicts
+const (
+	RouteConflictDuplicate = "duplicate"
+	RouteConflictShadow    = "shadow"
+)
+
+// Policies for prefix routes shadowing more specific routes
+const (
+	ShadowPolicyWarn   = "warn"
+	ShadowPolicyReject = "reject"
+)
+
+// routeConflictLockClass namespaces the per-domain Postgres advisory locks that serialize
+// route conflict checks with the writes they guard
+const routeConflictLockClass = 0x726f7574
+
+// RouteConflict describes two routes on the same domain that overlap
+type RouteConflict struct {
+	Kind               string `json:"kind"`
+	RouteID            uint   `json:"route_id"`
+	Path               string `json:"path"`
+	ConflictingRouteID uint   `json:"conflicting_route_id"`
+	ConflictingPath    string `json:"conflicting_path"`
+	Message            string `json:"message"`
+}
+
+// normalizeRoutePath returns the canonical form of a route path used for comparisons
+func normalizeRoutePath(routePath string) string {
+	if !strings.HasPrefix(routePath, "/") {
+		routePath = "/" + routePath
+	}
+	return path.Clean(routePath)
+}
+
+// routeShadows reports whether prefix route p matches every request exact route r would.
+// Prefixes match whole path segments, so /api shadows /api/users but not /apiv2.
+func routeShadows(p, r Route) bool {
+	if !p.UsePathAsPrefix || r.UsePathAsPrefix {
+		return false
+	}
+	prefix := normalizeRoutePath(p.Path)
+	target := normalizeRoutePath(r.Path)
+	if prefix == target || !strings.HasPrefix(target, prefix) {
+		return false
+	}
+	return prefix == "/" || target[len(prefix)] == '/'
+}
+
+// routeConflictsWith returns the conflicts between route and the other routes of its domain
+func routeConflictsWith(route Route, others []Route) []RouteConflict {
+	var conflicts []RouteConflict
+	for _, other := range others {
+		if other.ID == route.ID || other.DomainID != route.DomainID {
+			continue
+		}
+
+		switch {
+		case normalizeRoutePath(other.Path) == normalizeRoutePath(route.Path):
+			conflicts = append(conflicts, RouteConflict{
+				Kind:               RouteConflictDuplicate,
+				RouteID:            route.ID,
+				Path:               route.Path,
+				ConflictingRouteID: other.ID,
+				ConflictingPath:    other.Path,
+				Message:            "A route with path " + other.Path + " already exists on this domain",
+			})
+		case routeShadows(other, route):
+			conflicts = append(conflicts, RouteConflict{
+				Kind:               RouteConflictShadow,
+				RouteID:            route.ID,
+				Path:               route.Path,
+				ConflictingRouteID: other.ID,
+				ConflictingPath:    other.Path,
+				Message:            "Route " + route.Path + " is shadowed by prefix route " + other.Path,
+			})
+		case routeShadows(route, other):
+			conflicts = append(conflicts, RouteConflict{
+				Kind:               RouteConflictShadow,
+				RouteID:            route.ID,
+				Path:               route.Path,
+				ConflictingRouteID: other.ID,
+				ConflictingPath:    other.Path,
+				Message:            "Prefix route " + route.Path + " shadows route " + other.Path,
+			})
+		}
+	}
+	return conflicts
+}
+
+// findRouteConflicts returns every conflicting pair among routes, reporting each pair once
+func findRouteConflicts(routes []Route) []RouteConflict {
+	conflicts := []RouteConflict{}
+	for i, route := range routes {
+		conflicts = append(conflicts, routeConflictsWith(route, routes[i+1:])...)
+	}
+	return conflicts
+}
+
+// shadowPolicy returns how shadowing prefix routes are handled for this request:
+// the "shadowing" query parameter overrides the ROUTE_SHADOW_POLICY default
+func shadowPolicy(c *gin.Context) string {
+	policy := c.DefaultQuery("shadowing", getEnv("ROUTE_SHADOW_POLICY", ShadowPolicyWarn))
+	if policy == ShadowPolicyReject {
+		return ShadowPolicyReject
+	}
+	return ShadowPolicyWarn
+}
+
+// routeConflictError blocks a route write because of a conflict
+type routeConflictError struct {
+	conflict RouteConflict
+}
+
+func (e *routeConflictError) Error() string {
+	return e.conflict.Message
+}
+
+// checkRouteConflicts compares route with the other routes of its domain. A duplicate, or a
+// shadow under the reject policy, is returned as a *routeConflictError; other shadowing
+// conflicts are returned as warnings. It locks the domain until tx ends, so concurrent
+// writes to the same domain cannot both pass the check.
+func checkRouteConflicts(tx *gorm.DB, route Route, policy string) ([]RouteConflict, error) {
+	if err := tx.Exec("SELECT pg_advisory_xact_lock(?, ?)", routeConflictLockClass, route.DomainID).Error; err != nil {
+		return nil, err
+	}
+
+	var others []Route
+	if err := tx.Where("domain_id = ? AND id <> ?", route.DomainID, route.ID).Find(&others).Error; err != nil {
+		return nil, err
+	}
+
+	var warnings []RouteConflict
+	for _, conflict := range routeConflictsWith(route, others) {
+		if conflict.Kind == RouteConflictDuplicate || policy == ShadowPolicyReject {
+			return nil, &routeConflictError{conflict: conflict}
+		}
+		warnings = append(warnings, conflict)
+	}
+	return warnings, nil
+}
+
+// routeRequestError rejects a route write before anything is written
+type routeRequestError struct {
+	status  int
+	message string
+}
+
+func (e *routeRequestError) Error() string {
+	return e.message
+}
+
+// routeWriteStatus returns the HTTP status and message for an error preparing or saving a route
+func routeWriteStatus(err error) (int, string) {
+	var requestErr *routeRequestError
+	var pluginsErr *unknownPluginsError
+	var conflictErr *routeConflictError
+	switch {
+	case errors.As(err, &requestErr):
+		return requestErr.status, requestErr.Error()
+	case errors.As(err, &pluginsErr):
+		return http.StatusBadRequest, pluginsErr.Error()
+	case errors.As(err, &conflictErr):
+		return http.StatusConflict, conflictErr.Error()
+	default:
+		return http.StatusInternalServerError, formatDatabaseError(err)
+	}
+}
+
+// respondRouteWriteError writes the response for an error preparing or saving a route
+func respondRouteWriteError(c *gin.Context, err error) {
+	status, message := routeWriteStatus(err)
+	response := gin.H{"error": message}
+	var conflictErr *routeConflictError
+	if errors.As(err, &conflictErr) {
+		response["conflict"] = conflictErr.conflict
+	}
+	c.JSON(status, response)
+}
+
+// routeWriteResponse builds the body of a successful route write, including any warnings
+func routeWriteResponse(route Route, warnings []RouteConflict) gin.H {
+	response := gin.H{"data": route}
+	if len(warnings) > 0 {
+		response["warnings"] = warnings
+	}
+	return response
+}
+
+// GetDomainRouteConflicts reports duplicate and shadowing routes on an existing domain
+func GetDomainRouteConflicts(c *gin.Context) {
+	id := c.Param("id")
+	var domain Domain
+
+	if err := scopeDomains(c, DB).First(&domain, id).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Domain not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": formatDatabaseError(err)})
+		return
+	}
+
+	var routes []Route
+	if err := DB.Where("domain_id = ?", domain.ID).Order("id").Find(&routes).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": formatDatabaseError(err)})
+		return
+	}
+
+	conflicts := findRouteConflicts(routes)
+	c.JSON(http.StatusOK, gin.H{
+		"data":  conflicts,
+		"count": len(conflicts),
+	})
+}
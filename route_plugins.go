@@ -0,0 +1,520 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+var errPluginAlreadyAttached = errors.New("Plugin is already attached to this route")
+
+// unknownPluginsError reports plugin names referenced by a route that do not exist
+type unknownPluginsError struct {
+	names []string
+}
+
+func (e *unknownPluginsError) Error() string {
+	return "Unknown plugin(s): " + strings.Join(e.names, ", ")
+}
+
+// respondRoutePluginsError writes the response for an error returned by resolvePluginNames
+func respondRoutePluginsError(c *gin.Context, err error) {
+	if _, ok := err.(*unknownPluginsError); ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusInternalServerError, gin.H{"error": formatDatabaseError(err)})
+}
+
+// legacyRoutePlugins translates the deprecated comma-separated plugin field of a route request
+// into a plugin list, so older clients keep their plugins attached. It returns plugins when
+// the field is not set and rejects requests that set both.
+func legacyRoutePlugins(plugin *string, plugins *[]string) (*[]string, error) {
+	if plugin == nil {
+		return plugins, nil
+	}
+	if plugins != nil && len(*plugins) > 0 {
+		return nil, &routeRequestError{status: http.StatusBadRequest, message: "Use either plugin or plugins, not both"}
+	}
+	names := parsePluginNames(*plugin)
+	if names == nil {
+		names = []string{}
+	}
+	return &names, nil
+}
+
+// resolvePluginNames looks up plugins by exact name in query and returns them in the given
+// order. Duplicate names are collapsed and unknown names are reported as an unknownPluginsError.
+func resolvePluginNames(query *gorm.DB, names []string) ([]Plugin, error) {
+	names = parsePluginNames(strings.Join(names, ","))
+	if len(names) == 0 {
+		return nil, nil
+	}
+
+	var plugins []Plugin
+	if err := query.Where("name_plugin IN ?", names).Find(&plugins).Error; err != nil {
+		return nil, err
+	}
+
+	byName := make(map[string]Plugin, len(plugins))
+	for _, plugin := range plugins {
+		byName[plugin.NamePlugin] = plugin
+	}
+
+	var resolved []Plugin
+	var unknown []string
+	for _, name := range names {
+		plugin, ok := byName[name]
+		if !ok {
+			unknown = append(unknown, name)
+			continue
+		}
+		resolved = append(resolved, plugin)
+	}
+	if len(unknown) > 0 {
+		return nil, &unknownPluginsError{names: unknown}
+	}
+
+	return resolved, nil
+}
+
+// replaceRoutePlugins replaces the plugins attached to a route with the given ordered list,
+// keeping the per-route envs of plugins that stay attached
+func replaceRoutePlugins(tx *gorm.DB, routeID uint, plugins []Plugin) error {
+	var existing []RoutePlugin
+	if err := tx.Where("route_id = ?", routeID).Find(&existing).Error; err != nil {
+		return err
+	}
+
+	envs := make(map[uint]string, len(existing))
+	for _, routePlugin := range existing {
+		envs[routePlugin.PluginID] = routePlugin.Envs
+	}
+
+	if err := tx.Where("route_id = ?", routeID).Delete(&RoutePlugin{}).Error; err != nil {
+		return err
+	}
+
+	if len(plugins) == 0 {
+		return nil
+	}
+
+	rows := make([]RoutePlugin, 0, len(plugins))
+	for position, plugin := range plugins {
+		rows = append(rows, RoutePlugin{
+			RouteID:  routeID,
+			PluginID: plugin.ID,
+			Position: position,
+			Envs:     envs[plugin.ID],
+		})
+	}
+
+	return tx.Omit("Plugin").Create(&rows).Error
+}
+
+// renumberRoutePlugins rewrites positions of a route's plugins so they are contiguous from 0
+func renumberRoutePlugins(tx *gorm.DB, routeID uint) error {
+	var routePlugins []RoutePlugin
+	if err := tx.Where("route_id = ?", routeID).Order("position, id").Find(&routePlugins).Error; err != nil {
+		return err
+	}
+
+	for position, routePlugin := range routePlugins {
+		if routePlugin.Position == position {
+			continue
+		}
+		if err := tx.Model(&RoutePlugin{}).Where("id = ?", routePlugin.ID).Update("position", position).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// preloadRoutePlugins preloads a route's plugins in execution order
+func preloadRoutePlugins(db *gorm.DB) *gorm.DB {
+	return db.Preload("Plugins", func(db *gorm.DB) *gorm.DB {
+		return db.Order("position")
+	}).Preload("Plugins.Plugin")
+}
+
+// findRouteForPlugins loads the route referenced by the :id path parameter
+func findRouteForPlugins(c *gin.Context) (Route, bool) {
+	var route Route
+	if err := scopeRoutes(c, DB.Preload("Domain")).First(&route, c.Param("id")).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Route not found"})
+			return route, false
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": formatDatabaseError(err)})
+		return route, false
+	}
+	return route, true
+}
+
+// respondRoutePlugins reloads the route's plugins, publishes the change and writes them
+func respondRoutePlugins(c *gin.Context, route Route, status int) {
+	var routePlugins []RoutePlugin
+	if err := DB.Preload("Plugin").Where("route_id = ?", route.ID).Order("position").Find(&routePlugins).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": formatDatabaseError(err)})
+		return
+	}
+
+	route.Plugins = routePlugins
+	publishConfigChange(ConfigEntityRoute, ConfigActionUpdated, route.ID, route.Domain.UserId, route)
+
+	c.JSON(status, gin.H{"data": routePlugins})
+}
+
+// GetRoutePlugins returns the plugins attached to a route in execution order
+func GetRoutePlugins(c *gin.Context) {
+	route, ok := findRouteForPlugins(c)
+	if !ok {
+		return
+	}
+
+	var routePlugins []RoutePlugin
+	if err := DB.Preload("Plugin").Where("route_id = ?", route.ID).Order("position").Find(&routePlugins).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": formatDatabaseError(err)})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"data":  routePlugins,
+		"count": len(routePlugins),
+	})
+}
+
+// AttachRoutePlugin attaches a plugin to a route, at the end or at the given position
+func AttachRoutePlugin(c *gin.Context) {
+	route, ok := findRouteForPlugins(c)
+	if !ok {
+		return
+	}
+
+	var req AttachRoutePluginRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": formatValidationError(err)})
+		return
+	}
+
+	var plugin Plugin
+	query := ownedPlugins(DB, route.Domain.UserId)
+	if req.PluginID != 0 {
+		query = query.Where("id = ?", req.PluginID)
+	} else if req.Plugin != "" {
+		query = query.Where("name_plugin = ?", req.Plugin)
+	} else {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Plugin or Plugin ID is required"})
+		return
+	}
+	if err := query.First(&plugin).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Plugin not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": formatDatabaseError(err)})
+		return
+	}
+
+	pluginService, ok := checkRoutePluginEnvs(c, plugin, req.Envs)
+	if !ok {
+		return
+	}
+	envs, err := sealSecrets(req.Envs, "", pluginServiceSecretFields(pluginService.Schema))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Environment Variables: " + err.Error()})
+		return
+	}
+
+	err = DB.Transaction(auditRouteUpdate(currentPrincipal(c), route.ID, func(tx *gorm.DB) error {
+		var attached []RoutePlugin
+		if err := tx.Where("route_id = ?", route.ID).Order("position").Find(&attached).Error; err != nil {
+			return err
+		}
+		for _, routePlugin := range attached {
+			if routePlugin.PluginID == plugin.ID {
+				return errPluginAlreadyAttached
+			}
+		}
+
+		position := len(attached)
+		if req.Position != nil && *req.Position < position {
+			position = *req.Position
+			// Make room for the new plugin
+			if err := tx.Model(&RoutePlugin{}).
+				Where("route_id = ? AND position >= ?", route.ID, position).
+				Update("position", gorm.Expr("position + 1")).Error; err != nil {
+				return err
+			}
+		}
+
+		routePlugin := RoutePlugin{
+			RouteID:  route.ID,
+			PluginID: plugin.ID,
+			Position: position,
+			Envs:     envs,
+		}
+		return tx.Omit("Plugin").Create(&routePlugin).Error
+	}))
+	if err == errPluginAlreadyAttached {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": formatDatabaseError(err)})
+		return
+	}
+
+	respondRoutePlugins(c, route, http.StatusCreated)
+}
+
+// ReorderRoutePlugins sets the execution order of the plugins attached to a route
+func ReorderRoutePlugins(c *gin.Context) {
+	route, ok := findRouteForPlugins(c)
+	if !ok {
+		return
+	}
+
+	var req ReorderRoutePluginsRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": formatValidationError(err)})
+		return
+	}
+
+	// Plugin names are only unique per user, so resolve them among the route owner's plugins
+	plugins, err := resolvePluginNames(ownedPlugins(DB, route.Domain.UserId), req.Plugins)
+	if err != nil {
+		respondRoutePluginsError(c, err)
+		return
+	}
+
+	var attached []RoutePlugin
+	if err := DB.Where("route_id = ?", route.ID).Find(&attached).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": formatDatabaseError(err)})
+		return
+	}
+
+	// Reordering must name exactly the plugins already attached
+	attachedIDs := make(map[uint]bool, len(attached))
+	for _, routePlugin := range attached {
+		attachedIDs[routePlugin.PluginID] = true
+	}
+	if len(plugins) != len(attached) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Plugins must list every plugin attached to the route exactly once"})
+		return
+	}
+	for _, plugin := range plugins {
+		if !attachedIDs[plugin.ID] {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Plugin " + plugin.NamePlugin + " is not attached to this route"})
+			return
+		}
+	}
+
+	err = DB.Transaction(auditRouteUpdate(currentPrincipal(c), route.ID, func(tx *gorm.DB) error {
+		for position, plugin := range plugins {
+			err := tx.Model(&RoutePlugin{}).
+				Where("route_id = ? AND plugin_id = ?", route.ID, plugin.ID).
+				Update("position", position).Error
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": formatDatabaseError(err)})
+		return
+	}
+
+	respondRoutePlugins(c, route, http.StatusOK)
+}
+
+// UpdateRoutePlugin updates the per-route envs or position of an attached plugin
+func UpdateRoutePlugin(c *gin.Context) {
+	route, ok := findRouteForPlugins(c)
+	if !ok {
+		return
+	}
+
+	var routePlugin RoutePlugin
+	if err := DB.Where("route_id = ? AND plugin_id = ?", route.ID, c.Param("plugin_id")).First(&routePlugin).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Plugin is not attached to this route"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": formatDatabaseError(err)})
+		return
+	}
+
+	var req UpdateRoutePluginRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": formatValidationError(err)})
+		return
+	}
+
+	var envs string
+	if req.Envs != nil {
+		var plugin Plugin
+		if err := DB.First(&plugin, routePlugin.PluginID).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": formatDatabaseError(err)})
+			return
+		}
+		pluginService, ok := checkRoutePluginEnvs(c, plugin, *req.Envs)
+		if !ok {
+			return
+		}
+		var err error
+		if envs, err = sealSecrets(*req.Envs, routePlugin.Envs, pluginServiceSecretFields(pluginService.Schema)); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Environment Variables: " + err.Error()})
+			return
+		}
+	}
+
+	err := DB.Transaction(auditRouteUpdate(currentPrincipal(c), route.ID, func(tx *gorm.DB) error {
+		if req.Envs != nil {
+			if err := tx.Model(&routePlugin).Update("envs", envs).Error; err != nil {
+				return err
+			}
+		}
+		if req.Position != nil && *req.Position != routePlugin.Position {
+			// Move the plugin by shifting the ones in between
+			if *req.Position < routePlugin.Position {
+				if err := tx.Model(&RoutePlugin{}).
+					Where("route_id = ? AND position >= ? AND position < ?", route.ID, *req.Position, routePlugin.Position).
+					Update("position", gorm.Expr("position + 1")).Error; err != nil {
+					return err
+				}
+			} else {
+				if err := tx.Model(&RoutePlugin{}).
+					Where("route_id = ? AND position > ? AND position <= ?", route.ID, routePlugin.Position, *req.Position).
+					Update("position", gorm.Expr("position - 1")).Error; err != nil {
+					return err
+				}
+			}
+			if err := tx.Model(&routePlugin).Update("position", *req.Position).Error; err != nil {
+				return err
+			}
+			return renumberRoutePlugins(tx, route.ID)
+		}
+		return nil
+	}))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": formatDatabaseError(err)})
+		return
+	}
+
+	respondRoutePlugins(c, route, http.StatusOK)
+}
+
+// DetachRoutePlugin removes a plugin from a route
+func DetachRoutePlugin(c *gin.Context) {
+	route, ok := findRouteForPlugins(c)
+	if !ok {
+		return
+	}
+
+	var routePlugin RoutePlugin
+	if err := DB.Where("route_id = ? AND plugin_id = ?", route.ID, c.Param("plugin_id")).First(&routePlugin).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Plugin is not attached to this route"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": formatDatabaseError(err)})
+		return
+	}
+
+	err := DB.Transaction(auditRouteUpdate(currentPrincipal(c), route.ID, func(tx *gorm.DB) error {
+		if err := tx.Delete(&routePlugin).Error; err != nil {
+			return err
+		}
+		return renumberRoutePlugins(tx, route.ID)
+	}))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": formatDatabaseError(err)})
+		return
+	}
+
+	respondRoutePlugins(c, route, http.StatusOK)
+}
+
+// migrateRoutePluginStrings converts the legacy comma-separated routes.plugin column into
+// route_plugins rows. Routes naming a plugin that cannot be resolved keep their value, and the
+// column is only dropped once every route has been converted, so no plugin name is lost.
+func migrateRoutePluginStrings() error {
+	if !DB.Migrator().HasColumn(&Route{}, "plugin") {
+		return nil
+	}
+
+	type legacyRoute struct {
+		ID     uint
+		Plugin string
+		UserId string
+	}
+
+	return DB.Transaction(func(tx *gorm.DB) error {
+		var routes []legacyRoute
+		err := tx.Table("routes").
+			Select("routes.id, routes.plugin, domains.user_id").
+			Joins("LEFT JOIN domains ON domains.id = routes.domain_id").
+			Where("routes.plugin IS NOT NULL AND routes.plugin <> ''").
+			Scan(&routes).Error
+		if err != nil {
+			return err
+		}
+
+		var plugins []Plugin
+		if err := tx.Find(&plugins).Error; err != nil {
+			return err
+		}
+		// Names were unique before plugins were scoped to tenants; a plugin of the route's
+		// owner wins, otherwise the name must match exactly one plugin
+		owned := make(map[[2]string]uint, len(plugins))
+		byName := make(map[string][]uint, len(plugins))
+		for _, plugin := range plugins {
+			owned[[2]string{plugin.UserId, plugin.NamePlugin}] = plugin.ID
+			byName[plugin.NamePlugin] = append(byName[plugin.NamePlugin], plugin.ID)
+		}
+
+		pending := 0
+		for _, route := range routes {
+			var rows []RoutePlugin
+			var unresolved []string
+			for _, name := range parsePluginNames(route.Plugin) {
+				pluginID, ok := owned[[2]string{route.UserId, name}]
+				if !ok && len(byName[name]) == 1 {
+					pluginID, ok = byName[name][0], true
+				}
+				if !ok {
+					unresolved = append(unresolved, name)
+					continue
+				}
+				rows = append(rows, RoutePlugin{RouteID: route.ID, PluginID: pluginID, Position: len(rows)})
+			}
+			if len(unresolved) > 0 {
+				log.Printf("Keeping legacy plugins %q of route %d: cannot resolve %s", route.Plugin, route.ID, strings.Join(unresolved, ", "))
+				pending++
+				continue
+			}
+			// A list of only separators leaves no rows, but the column is cleared all the same
+			if len(rows) > 0 {
+				if err := tx.Omit("Plugin").Create(&rows).Error; err != nil {
+					return err
+				}
+			}
+			if err := tx.Table("routes").Where("id = ?", route.ID).Update("plugin", "").Error; err != nil {
+				return err
+			}
+		}
+
+		log.Printf("Migrated plugins of %d routes to route_plugins", len(routes)-pending)
+		if pending > 0 {
+			log.Printf("Keeping the legacy routes.plugin column until the plugins of %d routes can be resolved", pending)
+			return nil
+		}
+		return tx.Migrator().DropColumn(&Route{}, "plugin")
+	})
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+const (
+	// encryptedSecretPrefix marks values produced by encryptSecret
+	encryptedSecretPrefix = "enc:v1:"
+
+	// encryptionKeySize is the size in bytes of key encryption keys and data keys (AES-256)
+	encryptionKeySize = 32
+)
+
+// encryptionKey is a key encryption key loaded from the environment
+type encryptionKey struct {
+	id  string
+	key []byte
+}
+
+// parseEncryptionKey decodes a base64 encoded 32 byte key
+func parseEncryptionKey(encoded string) (encryptionKey, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return encryptionKey{}, fmt.Errorf("encryption key is not valid base64: %v", err)
+	}
+	if len(key) != encryptionKeySize {
+		return encryptionKey{}, fmt.Errorf("encryption key must be %d bytes, got %d", encryptionKeySize, len(key))
+	}
+	sum := sha256.Sum256(key)
+	return encryptionKey{id: hex.EncodeToString(sum[:4]), key: key}, nil
+}
+
+// encryptionKeys returns the current key from PEPES_ENCRYPTION_KEY and every key able to
+// decrypt, including the retired ones in PEPES_PREVIOUS_ENCRYPTION_KEYS (comma separated)
+func encryptionKeys() (encryptionKey, map[string]encryptionKey, error) {
+	encoded := getEnv("PEPES_ENCRYPTION_KEY", "")
+	if encoded == "" {
+		return encryptionKey{}, nil, fmt.Errorf("PEPES_ENCRYPTION_KEY is not set")
+	}
+	current, err := parseEncryptionKey(encoded)
+	if err != nil {
+		return encryptionKey{}, nil, err
+	}
+
+	keys := map[string]encryptionKey{current.id: current}
+	for _, encoded := range strings.Split(getEnv("PEPES_PREVIOUS_ENCRYPTION_KEYS", ""), ",") {
+		if strings.TrimSpace(encoded) == "" {
+			continue
+		}
+		key, err := parseEncryptionKey(encoded)
+		if err != nil {
+			return encryptionKey{}, nil, err
+		}
+		keys[key.id] = key
+	}
+	return current, keys, nil
+}
+
+// isEncryptedSecret reports whether value was produced by encryptSecret
+func isEncryptedSecret(value string) bool {
+	return strings.HasPrefix(value, encryptedSecretPrefix)
+}
+
+// encryptSecret envelope-encrypts plaintext: it is sealed with a random data key, which is
+// itself sealed with the current encryption key. The result is
+// "enc:v1:<key id>:<sealed data key>:<sealed plaintext>".
+func encryptSecret(plaintext string) (string, error) {
+	current, _, err := encryptionKeys()
+	if err != nil {
+		return "", err
+	}
+
+	dataKey := make([]byte, encryptionKeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return "", err
+	}
+
+	sealedKey, err := sealAESGCM(current.key, dataKey)
+	if err != nil {
+		return "", err
+	}
+	sealedValue, err := sealAESGCM(dataKey, []byte(plaintext))
+	if err != nil {
+		return "", err
+	}
+
+	return encryptedSecretPrefix + current.id + ":" +
+		base64.RawStdEncoding.EncodeToString(sealedKey) + ":" +
+		base64.RawStdEncoding.EncodeToString(sealedValue), nil
+}
+
+// decryptSecret reverses encryptSecret using whichever configured key sealed the value.
+// Values that are not encrypted are returned unchanged.
+func decryptSecret(value string) (string, error) {
+	if !isEncryptedSecret(value) {
+		return value, nil
+	}
+
+	parts := strings.Split(strings.TrimPrefix(value, encryptedSecretPrefix), ":")
+	if len(parts) != 3 {
+		return "", fmt.Errorf("encrypted value is malformed")
+	}
+
+	_, keys, err := encryptionKeys()
+	if err != nil {
+		return "", err
+	}
+	key, ok := keys[parts[0]]
+	if !ok {
+		return "", fmt.Errorf("encryption key %s is not configured", parts[0])
+	}
+
+	sealedKey, err := base64.RawStdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", fmt.Errorf("encrypted value is malformed")
+	}
+	sealedValue, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", fmt.Errorf("encrypted value is malformed")
+	}
+
+	dataKey, err := openAESGCM(key.key, sealedKey)
+	if err != nil {
+		return "", err
+	}
+	plaintext, err := openAESGCM(dataKey, sealedValue)
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
+
+// sealAESGCM encrypts plaintext with AES-GCM, prefixing the random nonce
+func sealAESGCM(key, plaintext []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+// openAESGCM decrypts a value produced by sealAESGCM
+func openAESGCM(key, sealed []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, fmt.Errorf("encrypted value is too short")
+	}
+	plaintext, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not decrypt value: %v", err)
+	}
+	return plaintext, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
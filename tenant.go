@@ -0,0 +1,63 @@
+package main
+
+import (
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// scopeUserId returns the user the request is restricted to, or "" when the caller is an
+// admin who did not ask for a specific user with ?user_id=
+func scopeUserId(c *gin.Context) string {
+	principal := currentPrincipal(c)
+	if principal.IsAdmin() {
+		return c.Query("user_id")
+	}
+	if principal == nil {
+		// Should not happen behind AuthMiddleware; match nothing rather than everything
+		return "\x00"
+	}
+	return principal.UserId
+}
+
+// scopeDomains restricts a domains query to the caller's domains
+func scopeDomains(c *gin.Context, query *gorm.DB) *gorm.DB {
+	if userId := scopeUserId(c); userId != "" {
+		return query.Where("domains.user_id = ?", userId)
+	}
+	return query
+}
+
+// scopeRoutes restricts a routes query to routes on the caller's domains
+func scopeRoutes(c *gin.Context, query *gorm.DB) *gorm.DB {
+	if userId := scopeUserId(c); userId != "" {
+		return query.Where("routes.domain_id IN (?)", DB.Model(&Domain{}).Select("id").Where("user_id = ?", userId))
+	}
+	return query
+}
+
+// scopePlugins restricts a plugins query to the caller's plugins
+func scopePlugins(c *gin.Context, query *gorm.DB) *gorm.DB {
+	if userId := scopeUserId(c); userId != "" {
+		return query.Where("plugins.user_id = ?", userId)
+	}
+	return query
+}
+
+// ownedPlugins restricts a plugins query to the plugins of userId. Plugin names are only
+// unique per user, so names referenced by a route resolve among its domain owner's plugins.
+func ownedPlugins(query *gorm.DB, userId string) *gorm.DB {
+	return query.Where("plugins.user_id = ?", userId)
+}
+
+// ownerUserId returns the user a new record should belong to: the caller, or the
+// user_id from the request body when the caller is an admin
+func ownerUserId(c *gin.Context, requested string) (string, bool) {
+	principal := currentPrincipal(c)
+	if requested == "" || requested == principal.UserId {
+		return principal.UserId, true
+	}
+	if !principal.IsAdmin() {
+		return "", false
+	}
+	return requested, true
+}
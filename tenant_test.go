@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// tenantFixture creates a verified domain with a route and a plugin owned by userId. Every
+// tenant gets a plugin of the same name.
+func tenantFixture(t *testing.T, userId, domainName string) (Domain, Route, Plugin) {
+	t.Helper()
+	domain := Domain{Name: domainName, UserId: userId, Status: DomainStatusVerified}
+	mustCreate(t, &domain)
+	route := Route{DomainID: domain.ID, Path: "/api", Upstream: "http://10.0.0.1:8080", LoadBalancing: LoadBalancingRoundRobin}
+	mustCreate(t, &route)
+	plugin := Plugin{NamePlugin: "logs", PluginSvcName: "logging", UserId: userId}
+	mustCreate(t, &plugin)
+	mustCreate(t, &RoutePlugin{RouteID: route.ID, PluginID: plugin.ID})
+	return domain, route, plugin
+}
+
+func TestCrossTenantAccessReturnsNotFound(t *testing.T) {
+	openTestDatabase(t)
+
+	domain, route, plugin := tenantFixture(t, "alice", "alice.example.com")
+	_, bobRoute, _ := tenantFixture(t, "bob", "bob.example.com")
+	bob := &Principal{UserId: "bob", Role: RoleUser}
+
+	cases := []struct {
+		name    string
+		handler gin.HandlerFunc
+		method  string
+		route   string
+		path    string
+		body    string
+	}{
+		{"get domain", GetDomain, http.MethodGet, "/domains/:id", fmt.Sprintf("/domains/%d", domain.ID), ""},
+		{"update domain", UpdateDomain, http.MethodPut, "/domains/:id", fmt.Sprintf("/domains/%d", domain.ID), `{"name":"taken.example.com"}`},
+		{"verify domain", VerifyDomain, http.MethodPost, "/domains/:id/verify", fmt.Sprintf("/domains/%d/verify", domain.ID), `{"method":"manual"}`},
+		{"delete domain", DeleteDomain, http.MethodDelete, "/domains/:id", fmt.Sprintf("/domains/%d", domain.ID), ""},
+		{"get route", GetRoute, http.MethodGet, "/routes/:id", fmt.Sprintf("/routes/%d", route.ID), ""},
+		{"update route", UpdateRoute, http.MethodPut, "/routes/:id", fmt.Sprintf("/routes/%d", route.ID), `{"upstream":"http://10.0.0.2:8080"}`},
+		{"delete route", DeleteRoute, http.MethodDelete, "/routes/:id", fmt.Sprintf("/routes/%d", route.ID), ""},
+		{"list route plugins", GetRoutePlugins, http.MethodGet, "/routes/:id/plugins", fmt.Sprintf("/routes/%d/plugins", route.ID), ""},
+		{"reorder route plugins", ReorderRoutePlugins, http.MethodPut, "/routes/:id/plugins", fmt.Sprintf("/routes/%d/plugins", route.ID),
+			fmt.Sprintf(`{"plugins":[%q]}`, plugin.NamePlugin)},
+		{"update route plugin", UpdateRoutePlugin, http.MethodPut, "/routes/:id/plugins/:plugin_id", fmt.Sprintf("/routes/%d/plugins/%d", route.ID, plugin.ID), `{"position":0}`},
+		{"detach route plugin", DetachRoutePlugin, http.MethodDelete, "/routes/:id/plugins/:plugin_id", fmt.Sprintf("/routes/%d/plugins/%d", route.ID, plugin.ID), ""},
+		{"get plugin", GetPlugin, http.MethodGet, "/plugins/:id", fmt.Sprintf("/plugins/%d", plugin.ID), ""},
+		{"update plugin", UpdatePlugin, http.MethodPut, "/plugins/:id", fmt.Sprintf("/plugins/%d", plugin.ID), `{"desc":"taken over"}`},
+		{"plugin effective config", GetPluginEffectiveConfig, http.MethodGet, "/plugins/:id/effective-config", fmt.Sprintf("/plugins/%d/effective-config", plugin.ID), ""},
+		{"delete plugin", DeletePlugin, http.MethodDelete, "/plugins/:id", fmt.Sprintf("/plugins/%d", plugin.ID), ""},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			expectStatus(t, serveAs(t, bob, tc.handler, tc.method, tc.route, tc.path, tc.body), http.StatusNotFound)
+		})
+	}
+
+	// Nothing of alice's may have changed
+	var stored Domain
+	if err := DB.Preload("Routes").First(&stored, domain.ID).Error; err != nil {
+		t.Fatalf("alice's domain is gone: %v", err)
+	}
+	if stored.Name != domain.Name || len(stored.Routes) != 1 || stored.Routes[0].Upstream != route.Upstream {
+		t.Errorf("alice's domain was changed by bob: %+v", stored)
+	}
+	var storedPlugin Plugin
+	if err := DB.First(&storedPlugin, plugin.ID).Error; err != nil || storedPlugin.Desc != "" {
+		t.Errorf("alice's plugin was changed by bob: %+v, %v", storedPlugin, err)
+	}
+
+	// Bob cannot attach alice's plugin to his own route, even by ID
+	w := serveAs(t, bob, AttachRoutePlugin, http.MethodPost, "/routes/:id/plugins", fmt.Sprintf("/routes/%d/plugins", bobRoute.ID),
+		fmt.Sprintf(`{"plugin_id":%d}`, plugin.ID))
+	expectStatus(t, w, http.StatusBadRequest)
+
+	// Nor move his route onto her domain
+	w = serveAs(t, bob, UpdateRoute, http.MethodPut, "/routes/:id", fmt.Sprintf("/routes/%d", bobRoute.ID),
+		fmt.Sprintf(`{"domain_id":%d}`, domain.ID))
+	if w.Code < 400 {
+		t.Errorf("moving a route onto another tenant's domain succeeded: %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestTenantListsOnlyOwnRecords(t *testing.T) {
+	openTestDatabase(t)
+
+	tenantFixture(t, "alice", "alice.example.com")
+	tenantFixture(t, "bob", "bob.example.com")
+
+	for _, tc := range []struct {
+		principal *Principal
+		want      int
+	}{
+		{&Principal{UserId: "bob", Role: RoleUser}, 1},
+		{&Principal{UserId: "carol", Role: RoleUser}, 0},
+		{&Principal{UserId: "root", Role: RoleAdmin}, 2},
+	} {
+		for _, list := range []struct {
+			handler gin.HandlerFunc
+			path    string
+		}{
+			{GetDomains, "/domains"},
+			{GetRoutes, "/routes"},
+			{GetPlugins, "/plugins"},
+		} {
+			w := serveAs(t, tc.principal, list.handler, http.MethodGet, list.path, list.path, "")
+			expectStatus(t, w, http.StatusOK)
+
+			var body struct {
+				Data []struct {
+					ID uint `json:"id"`
+				} `json:"data"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatalf("%s: %v", list.path, err)
+			}
+			if len(body.Data) != tc.want {
+				t.Errorf("%s as %s listed %d records, want %d", list.path, tc.principal.UserId, len(body.Data), tc.want)
+			}
+		}
+	}
+}
+
+func TestAdminReordersTenantRoutePlugins(t *testing.T) {
+	openTestDatabase(t)
+
+	_, route, logs := tenantFixture(t, "alice", "alice.example.com")
+	// bob's plugin of the same name must not be picked for alice's route
+	tenantFixture(t, "bob", "bob.example.com")
+	auth := Plugin{NamePlugin: "auth", PluginSvcName: "auth", UserId: "alice"}
+	mustCreate(t, &auth)
+	mustCreate(t, &RoutePlugin{RouteID: route.ID, PluginID: auth.ID, Position: 1})
+
+	admin := &Principal{UserId: "root", Role: RoleAdmin}
+	w := serveAs(t, admin, ReorderRoutePlugins, http.MethodPut, "/routes/:id/plugins", fmt.Sprintf("/routes/%d/plugins", route.ID),
+		`{"plugins":["auth","logs"]}`)
+	expectStatus(t, w, http.StatusOK)
+
+	var attached []RoutePlugin
+	if err := DB.Where("route_id = ?", route.ID).Order("position").Find(&attached).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(attached) != 2 || attached[0].PluginID != auth.ID || attached[1].PluginID != logs.ID {
+		t.Errorf("route plugins after reorder = %+v, want auth then logs", attached)
+	}
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-playground/validator/v10"
+	"gorm.io/gorm"
+)
+
+// Load balancing strategies for routes with several upstream targets
+const (
+	LoadBalancingRoundRobin     = "round_robin"
+	LoadBalancingWeighted       = "weighted"
+	LoadBalancingLeastConn      = "least_conn"
+	LoadBalancingConsistentHash = "consistent_hash"
+)
+
+// defaultUpstreamWeight is the weight of targets created without an explicit weight
+const defaultUpstreamWeight = 1
+
+// allowedUpstreamSchemes lists the schemes the gateway can proxy to
+var allowedUpstreamSchemes = map[string]bool{
+	"http":  true,
+	"https": true,
+	"h2c":   true,
+}
+
+// upstreamLookupTimeout bounds the DNS lookup of an upstream host under the private policy
+const upstreamLookupTimeout = 3 * time.Second
+
+// blockedUpstreamNetworks are non-public ranges not covered by the net.IP predicates
+var blockedUpstreamNetworks = []*net.IPNet{
+	mustParseCIDR("100.64.0.0/10"), // Carrier-grade NAT
+}
+
+// upstreamResolver resolves upstream hostnames for the private policy; tests replace it
+var upstreamResolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+} = net.DefaultResolver
+
+func mustParseCIDR(cidr string) *net.IPNet {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		panic(err)
+	}
+	return network
+}
+
+// normalizeUpstream parses an upstream URL and returns it in canonical form:
+// lowercase scheme and host, optional port and path, no trailing slash
+func normalizeUpstream(raw string) (string, error) {
+	u, err := url.Parse(strings.TrimSpace(raw))
+	if err != nil {
+		return "", fmt.Errorf("upstream is not a valid URL")
+	}
+
+	scheme := strings.ToLower(u.Scheme)
+	if !allowedUpstreamSchemes[scheme] {
+		return "", fmt.Errorf("upstream scheme must be http, https or h2c")
+	}
+	if u.Opaque != "" || u.Host == "" {
+		return "", fmt.Errorf("upstream must include a host")
+	}
+	if u.User != nil {
+		return "", fmt.Errorf("upstream must not include credentials")
+	}
+	if u.RawQuery != "" || u.Fragment != "" {
+		return "", fmt.Errorf("upstream must not include a query or fragment")
+	}
+
+	host := strings.ToLower(u.Hostname())
+	if !isValidUpstreamHost(host) {
+		return "", fmt.Errorf("upstream host %q is not valid", host)
+	}
+
+	if port := u.Port(); port != "" {
+		number, err := strconv.Atoi(port)
+		if err != nil || number < 1 || number > 65535 {
+			return "", fmt.Errorf("upstream port must be between 1 and 65535")
+		}
+		host = net.JoinHostPort(host, port)
+	} else if strings.Contains(host, ":") {
+		// Bare IPv6 addresses need brackets
+		host = "[" + host + "]"
+	}
+
+	path := strings.TrimRight(u.EscapedPath(), "/")
+	return scheme + "://" + host + path, nil
+}
+
+// isValidUpstreamHost reports whether host is an IP address or a syntactically valid hostname
+func isValidUpstreamHost(host string) bool {
+	if host == "" {
+		return false
+	}
+	if net.ParseIP(host) != nil {
+		return true
+	}
+	if len(host) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(host, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, r := range label {
+			if !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// isPrivateUpstreamHost reports whether host is localhost, a non-public IP address, or a
+// hostname resolving to one. Hostnames that cannot be resolved are treated as private.
+// The check runs when the route is saved; the gateway resolves the host again later.
+func isPrivateUpstreamHost(host string) bool {
+	host = strings.ToLower(host)
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return true
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		return isPrivateUpstreamIP(ip)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), upstreamLookupTimeout)
+	defer cancel()
+	addrs, err := upstreamResolver.LookupIPAddr(ctx, host)
+	if err != nil || len(addrs) == 0 {
+		return true
+	}
+	for _, addr := range addrs {
+		if isPrivateUpstreamIP(addr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// isPrivateUpstreamIP reports whether ip is a loopback, private, link-local, unspecified
+// or carrier-grade NAT address
+func isPrivateUpstreamIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsUnspecified() {
+		return true
+	}
+	for _, network := range blockedUpstreamNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// denyPrivateUpstreams reports whether the deployment rejects private upstream targets
+func denyPrivateUpstreams() bool {
+	value, _ := strconv.ParseBool(getEnv("UPSTREAM_DENY_PRIVATE", "false"))
+	return value
+}
+
+// validateUpstreamTag implements the "upstream" binding tag
+func validateUpstreamTag(fl validator.FieldLevel) bool {
+	_, err := normalizeUpstream(fl.Field().String())
+	return err == nil
+}
+
+// validateUpstreamPolicyTag implements the "upstream_policy" binding tag, rejecting
+// private and loopback targets, including hostnames resolving to them, when
+// UPSTREAM_DENY_PRIVATE is set
+func validateUpstreamPolicyTag(fl validator.FieldLevel) bool {
+	if !denyPrivateUpstreams() {
+		return true
+	}
+	u, err := url.Parse(strings.TrimSpace(fl.Field().String()))
+	if err != nil {
+		// Syntax errors are reported by the "upstream" tag
+		return true
+	}
+	return !isPrivateUpstreamHost(u.Hostname())
+}
+
+// buildRouteUpstreams normalizes the upstream targets of a route request. targets takes
+// precedence over upstream; a lone upstream becomes a single target with the default weight.
+func buildRouteUpstreams(upstream string, targets []UpstreamTargetRequest) ([]RouteUpstream, error) {
+	if len(targets) == 0 {
+		if upstream == "" {
+			return nil, fmt.Errorf("upstream or upstreams is required")
+		}
+		targets = []UpstreamTargetRequest{{Target: upstream}}
+	}
+
+	upstreams := make([]RouteUpstream, 0, len(targets))
+	seen := make(map[string]bool, len(targets))
+	totalWeight := 0
+	for position, request := range targets {
+		target, err := normalizeUpstream(request.Target)
+		if err != nil {
+			return nil, err
+		}
+		if seen[target] {
+			return nil, fmt.Errorf("upstream %s is listed more than once", target)
+		}
+		seen[target] = true
+
+		weight := defaultUpstreamWeight
+		if request.Weight != nil {
+			weight = *request.Weight
+		}
+		totalWeight += weight
+
+		upstreams = append(upstreams, RouteUpstream{Target: target, Weight: weight, Position: position})
+	}
+
+	if totalWeight == 0 {
+		return nil, fmt.Errorf("at least one upstream must have a weight above 0")
+	}
+	return upstreams, nil
+}
+
+// replaceRouteUpstreams replaces the upstream targets of a route
+func replaceRouteUpstreams(tx *gorm.DB, routeID uint, upstreams []RouteUpstream) error {
+	if err := tx.Where("route_id = ?", routeID).Delete(&RouteUpstream{}).Error; err != nil {
+		return err
+	}
+
+	rows := make([]RouteUpstream, 0, len(upstreams))
+	for _, upstream := range upstreams {
+		upstream.ID = 0
+		upstream.RouteID = routeID
+		rows = append(rows, upstream)
+	}
+	return tx.Create(&rows).Error
+}
+
+// preloadRouteUpstreams preloads a route's upstream targets in position order
+func preloadRouteUpstreams(db *gorm.DB) *gorm.DB {
+	return db.Preload("Upstreams", func(db *gorm.DB) *gorm.DB {
+		return db.Order("position")
+	})
+}
+
+// migrateRouteUpstreams gives routes created before multi-upstream support a single
+// target matching their upstream. Soft-deleted routes are left alone.
+func migrateRouteUpstreams() error {
+	result := DB.Exec(`INSERT INTO route_upstreams (route_id, target, weight, position, created_at, updated_at)
+		SELECT routes.id, routes.upstream, ?, 0, NOW(), NOW() FROM routes
+		WHERE routes.deleted_at IS NULL
+		AND NOT EXISTS (SELECT 1 FROM route_upstreams WHERE route_upstreams.route_id = routes.id)`, defaultUpstreamWeight)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected > 0 {
+		log.Printf("Created upstream targets for %d routes", result.RowsAffected)
+	}
+	return nil
+}